@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -109,36 +110,54 @@ func main() {
 	subscribe := []string{"config/aqi/"}
 
 	c := construct()
-	m := microservice.New("aqi", time.Minute*10)
+	m := microservice.New("aqi", time.Second)
 	m.RegisterAndSubscribe(register, subscribe)
 
+	poll := func(m *microservice.Service) bool {
+		m.Logger.LogInfo(m.Name, "polling Aqi")
+		stateAsJson, err := c.Poll()
+		if err == nil {
+			m.Logger.LogInfo(m.Name, "publish Aqi")
+			_ = m.Pubsub.Publish("state/sensor/aqi/", stateAsJson)
+		} else {
+			m.Logger.LogError(m.Name, err.Error())
+		}
+		return true
+	}
+
+	var polling *microservice.Schedule
+	m.SetReady("config", false)
 	m.RegisterHandler("config/aqi/", func(m *microservice.Service, topic string, msg []byte) bool {
 		configAqi, err := config.AqiConfigFromJSON(msg)
 		if err == nil {
 			m.Logger.LogInfo(m.Name, "received configuration")
 			c.config = configAqi
+			m.SetReady("config", true)
+			m.SetConfigVersion(config.Version(msg))
+
+			// (Re)start polling at the configured interval, the jitter spreads
+			// the requests of restarted services
+			interval := time.Duration(configAqi.Interval) * time.Second
+			if interval <= 0 {
+				interval = 10 * time.Minute
+			}
+			if polling != nil {
+				polling.Stop()
+			}
+			polling = m.Every(interval, poll, microservice.Immediately(), microservice.WithJitter(10*time.Second))
 		} else {
 			m.Logger.LogError(m.Name, "received bad configuration, "+err.Error())
 		}
 		return true
 	})
 
-	m.RegisterHandler("tick/", func(m *microservice.Service, topic string, msg []byte) bool {
-		if c != nil && c.config != nil {
-			m.Logger.LogInfo(m.Name, "polling Aqi")
-			stateAsJson, err := c.Poll()
-			if err == nil {
-				m.Logger.LogInfo(m.Name, "publish Aqi")
-				_ = m.Pubsub.Publish("state/sensor/aqi/", stateAsJson)
-			} else {
-				m.Logger.LogError(m.Name, err.Error())
-			}
-		} else if c != nil && c.config == nil {
+	m.Every(30*time.Second, func(m *microservice.Service) bool {
+		if c.config == nil {
 			// Try and request our configuration
 			_ = m.Pubsub.PublishStr("config/request/", "aqi")
 		}
 		return true
-	})
+	}, microservice.Immediately())
 
-	m.Loop()
+	m.Loop(context.Background())
 }
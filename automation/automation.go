@@ -8,6 +8,7 @@ package main
 // - time-based logic (morning 6:20 turn on bedroom lights)
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -23,8 +24,9 @@ func main() {
 	register := []string{"config/request/", "config/automation/"}
 	subscribe := []string{"config/automation/"}
 
-	m := microservice.New("automation")
+	m := microservice.New("automation", time.Second)
 	m.RegisterAndSubscribe(register, subscribe)
+	m.Use(microservice.Recover(), microservice.Timing())
 
 	auto := new(m)
 
@@ -56,36 +58,13 @@ func main() {
 		return true
 	})
 
-	m.RegisterHandler("state/sensor/conbee/", func(m *microservice.Service, topic string, msg []byte) bool {
-		//m.Logger.LogInfo(m.Name, "conbee sensor state: "+string(msg))
-		state, err := config.SensorStateFromJSON(msg)
-		if err == nil {
-			auto.handleEvent(topic, state)
-		} else {
-			m.Logger.LogError(m.Name, err.Error())
-		}
-		return true
-	})
-
-	m.RegisterHandler("state/sensor/calendar/", func(m *microservice.Service, topic string, msg []byte) bool {
-		state, err := config.SensorStateFromJSON(msg)
-		if err == nil {
-			auto.handleEvent(topic, state)
-		} else {
-			m.Logger.LogError(m.Name, err.Error())
-		}
-		return true
-	})
-
-	m.RegisterHandler("state/presence/", func(m *microservice.Service, topic string, msg []byte) bool {
-		state, err := config.SensorStateFromJSON(msg)
-		if err == nil {
-			auto.handleEvent(topic, state)
-		} else {
-			m.Logger.LogError(m.Name, err.Error())
-		}
+	handleSensorState := func(m *microservice.Service, topic string, state *config.SensorState) bool {
+		auto.handleEvent(topic, state)
 		return true
-	})
+	}
+	microservice.RegisterTypedHandler(m, "state/sensor/conbee/", handleSensorState)
+	microservice.RegisterTypedHandler(m, "state/sensor/calendar/", handleSensorState)
+	microservice.RegisterTypedHandler(m, "state/presence/", handleSensorState)
 
 	tickCount := 0
 	m.RegisterHandler("tick/", func(m *microservice.Service, topic string, msg []byte) bool {
@@ -107,7 +86,7 @@ func main() {
 		return true
 	})
 
-	m.Loop()
+	m.Loop(context.Background())
 }
 
 type homePresence struct {
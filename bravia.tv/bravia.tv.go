@@ -9,7 +9,9 @@ package main
 // - Sony Bravia TVs: Turn On/Off
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/jurgen-kluft/go-home/config"
 	microservice "github.com/jurgen-kluft/go-home/micro-service"
@@ -78,14 +80,17 @@ func (c *instance) changeInput(name string, input string) {
 
 func main() {
 	c := new()
-	defer c.Close()
 
 	register := []string{c.ccfg, "state/tv/bravia/", "config/request/"}
 	subscribe := []string{c.ccfg, "state/tv/bravia/"}
 
-	m := microservice.New("tv/bravia")
+	m := microservice.New("tv/bravia", time.Second)
 	m.RegisterAndSubscribe(register, subscribe)
 
+	m.OnShutdown(func(m *microservice.Service) {
+		c.Close()
+	})
+
 	m.RegisterHandler("config/tv/bravia/", func(m *microservice.Service, topic string, msg []byte) bool {
 		var err error
 		c.config, err = config.BraviaTVConfigFromJSON(msg)
@@ -101,6 +106,8 @@ func main() {
 		return true
 	})
 
+	// Changing the power or input of a TV is a slow HTTP call
+	m.SetConcurrency("state/tv/bravia/", 1, 16, microservice.DropOldest)
 	m.RegisterHandler("state/tv/bravia/", func(m *microservice.Service, topic string, msg []byte) bool {
 		m.Logger.LogInfo(m.Name, "received state")
 		state, err := config.SensorStateFromJSON(msg)
@@ -135,5 +142,5 @@ func main() {
 		return true
 	})
 
-	m.Loop()
+	m.Loop(context.Background())
 }
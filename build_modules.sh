@@ -1,6 +1,6 @@
 #!/usr/bin/env bash
 
-declare modules=('ahk' 'aqi' 'automation' 'bravia.tv' 'calendar' 'conbee.lights' 'conbee.sensors' 'config/config' 'config/strcrypt' 'config/pubconf' 'flux' 'presence' 'samsung.tv' 'shout' 'suncalc' 'weather' 'wemo' 'yee')
+declare modules=('ahk' 'aqi' 'automation' 'bravia.tv' 'calendar' 'conbee.lights' 'conbee.sensors' 'config/config' 'config/strcrypt' 'config/pubconf' 'esphome' 'flux' 'homeassistant' 'mqtt-broker' 'presence' 'samsung.tv' 'shout' 'suncalc' 'topic-bridge' 'weather' 'wemo' 'yee' 'zigbee2mqtt')
 
 export GO_HOME_KEY=2D4B6150645267552D4B615064526755
 
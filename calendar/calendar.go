@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -261,48 +262,55 @@ func main() {
 	register := []string{"config/calendar/", "config/request/", "state/sensor/calendar/"}
 	subscribe := []string{"config/calendar/"}
 
-	m := microservice.New("calendar")
+	m := microservice.New("calendar", time.Second)
 	m.RegisterAndSubscribe(register, subscribe)
 
 	c := new()
 	c.service = m
 
-	tickCount := 150
-
+	var loading, processing *microservice.Schedule
+	m.SetReady("config", false)
 	m.RegisterHandler("config/calendar/", func(m *microservice.Service, topic string, msg []byte) bool {
 		m.Logger.LogInfo(m.Name, "received configuration")
 		err := c.initialize(msg)
 		if err != nil {
-			c = nil
 			m.Logger.LogError(c.name, err.Error())
-		} else {
-			tickCount = 150
-		}
-		return true
-	})
-
-	m.RegisterHandler("tick/", func(m *microservice.Service, topic string, msg []byte) bool {
-		if tickCount%5 == 0 {
-			if c != nil && c.config == nil {
-				m.Pubsub.PublishStr("config/request/", m.Name)
+			if loading != nil {
+				loading.Stop()
+				processing.Stop()
 			}
+			c = nil
+			m.SetReady("config", false)
+			return true
 		}
-		if tickCount%450 == 0 {
-			if c != nil && c.config != nil {
-				c.load()
-				m.Logger.LogInfo(m.Name, "(re)loaded calendars")
-			}
+		m.SetReady("config", true)
+		m.SetConfigVersion(config.Version(msg))
+
+		// (Re)load the calendars every 7.5 minutes and update the sensors every minute
+		if loading != nil {
+			loading.Stop()
+			processing.Stop()
 		}
-		if tickCount%60 == 0 {
-			if c != nil && c.config != nil {
-				if err := c.process(); err != nil {
-					m.Logger.LogError(m.Name, err.Error())
-				}
+		loading = m.Every(450*time.Second, func(m *microservice.Service) bool {
+			c.load()
+			m.Logger.LogInfo(m.Name, "(re)loaded calendars")
+			return true
+		}, microservice.Immediately())
+		processing = m.Every(time.Minute, func(m *microservice.Service) bool {
+			if err := c.process(); err != nil {
+				m.Logger.LogError(m.Name, err.Error())
 			}
-		}
-		tickCount++
+			return true
+		}, microservice.Immediately())
 		return true
 	})
 
-	m.Loop()
+	m.Every(5*time.Second, func(m *microservice.Service) bool {
+		if c != nil && c.config == nil {
+			m.Pubsub.PublishStr("config/request/", m.Name)
+		}
+		return true
+	}, microservice.Immediately())
+
+	m.Loop(context.Background())
 }
@@ -2,6 +2,10 @@ package config
 
 import "encoding/json"
 
+func init() {
+	Register(Type{Name: "aqi", File: "aqi.config.json", Channel: "config/aqi/", New: func() Config { return &AqiConfig{} }})
+}
+
 // AqiConfigFromJSON parser the incoming JSON string and returns an Config instance for Aqi
 func AqiConfigFromJSON(data []byte) (*AqiConfig, error) {
 	r := &AqiConfig{}
@@ -30,7 +34,7 @@ type AqiConfig struct {
 	Token    CryptString `json:"token"`
 	City     string      `json:"city"`
 	URL      string      `json:"url"`
-	Interval int         `json:"interval"`
+	Interval int         `json:"interval" schema:"required,minimum=1"`
 	Levels   []AqiLevel  `json:"levels"`
 }
 
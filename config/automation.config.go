@@ -2,6 +2,10 @@ package config
 
 import "encoding/json"
 
+func init() {
+	Register(Type{Name: "automation", File: "automation.config.json", Channel: "config/automation/", New: func() Config { return &AutomationConfig{} }})
+}
+
 const (
 	BedroomLightStand         = "Bedroom Light Stand"
 	BedroomLightMain          = "Bedroom Light Main"
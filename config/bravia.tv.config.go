@@ -2,6 +2,10 @@ package config
 
 import "encoding/json"
 
+func init() {
+	Register(Type{Name: "tv/bravia", File: "bravia.tv.config.json", Channel: "config/bravia.tv/", New: func() Config { return &BraviaTVConfig{} }})
+}
+
 const (
 	LivingroomBraviaTV = "Livingroom Sony Bravia-TV"
 )
@@ -35,6 +35,10 @@ import (
 	"fmt"
 )
 
+func init() {
+	Register(Type{Name: "calendar", File: "calendar.config.json", Channel: "config/calendar/", New: func() Config { return &CalendarConfig{} }})
+}
+
 func CalendarConfigFromJSON(data []byte) (*CalendarConfig, error) {
 	r := &CalendarConfig{}
 	err := json.Unmarshal(data, r)
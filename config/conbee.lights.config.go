@@ -5,6 +5,10 @@ import (
 	"io/ioutil"
 )
 
+func init() {
+	Register(Type{Name: "conbee/lights", File: "conbee.lights.config.json", Channel: "config/conbee/lights/", New: func() Config { return &ConbeeLightsConfig{} }})
+}
+
 // ConbeeLightsConfigFromJSON parser the incoming JSON string and returns an Config instance for Aqi
 func ConbeeLightsConfigFromJSON(data []byte) (*ConbeeLightsConfig, error) {
 	r := &ConbeeLightsConfig{}
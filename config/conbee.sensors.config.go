@@ -5,6 +5,10 @@ import (
 	"io/ioutil"
 )
 
+func init() {
+	Register(Type{Name: "conbee/sensors", File: "conbee.sensors.config.json", Channel: "config/conbee/sensors/", New: func() Config { return &ConbeeSensorsConfig{} }})
+}
+
 // ConbeeConfigFromJSON parser the incoming JSON string and returns an Config instance for Aqi
 func ConbeeSensorsConfigFromJSON(data []byte) (*ConbeeSensorsConfig, error) {
 	r := &ConbeeSensorsConfig{}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+)
+
+const usage = `usage:
+  config [-home <home>] [-pubsub <profile>] [-set <name>.<field>=<value> ...] [command]
+
+  config                                  run the configuration service
+  config validate [name | file | name=file ...]
+                                          validate configuration files, all the
+                                          registered ones when none are given
+  config schema <name>                    print the JSON Schema of a configuration type
+  config resolve <name | file | name=file>
+                                          print a configuration with its layers applied
+  config history <name>                   print the versions of a configuration, newest first
+  config rollback <name | name=file> <version>
+                                          restore the file of a configuration to an earlier
+                                          version, the running service publishes it
+`
+
+// command runs the command line of the config service and returns the exit code
+func command(layers *config.Layers, args []string, stdout io.Writer, stderr io.Writer) int {
+	switch args[0] {
+	case "validate":
+		return validateCommand(layers, args[1:], stdout, stderr)
+	case "resolve":
+		if len(args) != 2 {
+			fmt.Fprint(stderr, usage)
+			return 2
+		}
+		file, err := configurationOf(args[1])
+		if err != nil {
+			fmt.Fprintln(stderr, err.Error())
+			return 2
+		}
+		layered, err := layers.Load(file.Name, file.ConfigFilename)
+		if err != nil {
+			fmt.Fprintln(stderr, err.Error())
+			return 1
+		}
+		fmt.Fprintln(stdout, string(layered.Data))
+		return 0
+	case "schema":
+		if len(args) != 2 {
+			fmt.Fprint(stderr, usage)
+			return 2
+		}
+		s, err := config.SchemaOf(args[1])
+		if err != nil {
+			fmt.Fprintln(stderr, err.Error())
+			return 1
+		}
+		data, _ := json.MarshalIndent(s, "", "  ")
+		fmt.Fprintln(stdout, string(data))
+		return 0
+	case "history":
+		if len(args) != 2 {
+			fmt.Fprint(stderr, usage)
+			return 2
+		}
+		return historyCommand(newHistory(historyDir), args[1], stdout, stderr)
+	case "rollback":
+		if len(args) != 3 {
+			fmt.Fprint(stderr, usage)
+			return 2
+		}
+		return rollbackCommand(newHistory(historyDir), layers, args[1], args[2], stdout, stderr)
+	}
+	fmt.Fprint(stderr, usage)
+	return 2
+}
+
+func validateCommand(layers *config.Layers, args []string, stdout io.Writer, stderr io.Writer) int {
+	var files []*configuration
+	if len(args) == 0 {
+		for _, t := range config.Types() {
+			files = append(files, &configuration{Name: t.Name, ConfigFilename: t.File})
+		}
+	}
+	for _, arg := range args {
+		file, err := configurationOf(arg)
+		if err != nil {
+			fmt.Fprintln(stderr, err.Error())
+			return 2
+		}
+		files = append(files, file)
+	}
+
+	failed := false
+	for _, file := range files {
+		if _, err := layers.Load(file.Name, file.ConfigFilename); err != nil {
+			failed = true
+			fmt.Fprintln(stderr, err.Error())
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: ok\n", file.ConfigFilename)
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// configurationOf returns the type and file of a 'validate' argument, which is
+// the name of a type (its default file), a file that has the name of the
+// default file of a type or 'name=file'.
+func configurationOf(arg string) (*configuration, error) {
+	if name, file, found := strings.Cut(arg, "="); found {
+		if _, exists := config.Lookup(name); !exists {
+			return nil, fmt.Errorf("configuration type %s is not registered", name)
+		}
+		return &configuration{Name: name, ConfigFilename: file}, nil
+	}
+	if t, exists := config.Lookup(arg); exists {
+		return &configuration{Name: t.Name, ConfigFilename: t.File}, nil
+	}
+	for _, t := range config.Types() {
+		if filepath.Base(arg) == t.File {
+			return &configuration{Name: t.Name, ConfigFilename: arg}, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot tell the configuration type of %s, use name=%s", arg, arg)
+}
+
+func historyCommand(h *history, name string, stdout io.Writer, stderr io.Writer) int {
+	versions, err := h.summaries(name)
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	for _, v := range versions {
+		line := fmt.Sprintf("%s  %s  %s", v.Version, v.Time.Format(time.RFC3339), v.Source)
+		if v.Author != "" {
+			line += " by " + v.Author
+		}
+		if len(v.Changes) > 0 {
+			line += ", changed " + strings.Join(v.Changes, ", ")
+		}
+		fmt.Fprintln(stdout, line)
+	}
+	return 0
+}
+
+// rollbackCommand restores the file that the config service loaded the
+// configuration from, 'config/config/' may have moved it. A 'name=file'
+// argument restores that file.
+func rollbackCommand(h *history, layers *config.Layers, arg string, prefix string, stdout io.Writer, stderr io.Writer) int {
+	c, err := configurationOf(arg)
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 2
+	}
+	if !strings.Contains(arg, "=") {
+		file, err := h.file(c.Name)
+		if err != nil {
+			fmt.Fprintln(stderr, err.Error())
+			return 1
+		}
+		if file != "" {
+			c.ConfigFilename = file
+		}
+	}
+	v, err := h.rollback(c.Name, c.ConfigFilename, layers.OverlayPath(c.ConfigFilename), prefix, os.Getenv("USER"), time.Now())
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: restored version %s\n", c.ConfigFilename, v.Version)
+	return 0
+}
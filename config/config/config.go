@@ -1,24 +1,43 @@
 package main
 
 import (
+	gocontext "context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/jurgen-kluft/go-home/config"
 	microservice "github.com/jurgen-kluft/go-home/micro-service"
+	"github.com/jurgen-kluft/go-home/transport"
 )
 
+// The watcher hands the changed configuration files to the loop of the
+// service on this topic, it is not a channel of the broker.
+const changedTopic = "config/changed/"
+
+// historyDir is the directory of the history of every configuration
+const historyDir = "history"
+
 // Configs holds all the config objects that we can have
 type context struct {
-	configs *configs
-	watcher *configFileWatcher
-	service *microservice.Service
+	configs  *configs
+	watcher  *configFileWatcher
+	service  *microservice.Service
+	debounce time.Duration
+	history  *history
+	layers   *config.Layers
+	// good holds the last-known-good version of every configuration, it is
+	// served when the file has become invalid.
+	good map[string]*version
 }
 
-func newContext() *context {
-	ctx := &context{}
-	ctx.watcher = newConfigFileWatcher()
+func newContext(m *microservice.Service, layers *config.Layers) *context {
+	ctx := &context{service: m, debounce: 250 * time.Millisecond, layers: layers}
+	ctx.history = newHistory(historyDir)
+	ctx.good = map[string]*version{}
 	return ctx
 }
 
@@ -38,142 +57,280 @@ func configFromJSON(data []byte) (*configs, error) {
 	return c, err
 }
 
-func (c *context) configFromJSON(configname string, jsondata []byte) (config.Config, error) {
-	var ci config.Config
+// registeredConfigs returns the configurations of all the registered types
+// with their default file and channel.
+func registeredConfigs() *configs {
+	c := &configs{Configurations: map[string]*configuration{}}
+	for _, t := range config.Types() {
+		c.Configurations[t.Name] = &configuration{Name: t.Name, ConfigFilename: t.File, ChannelName: t.Channel}
+	}
+	return c
+}
+
+// override changes the file and channel of the registered configurations, a
+// configuration that is not a registered type cannot be parsed and is skipped.
+func (c *configs) override(o *configs) error {
 	var err error
+	for name, configuration := range o.Configurations {
+		current, exists := c.Configurations[name]
+		if !exists {
+			err = fmt.Errorf("configuration %s is not a registered type", name)
+			continue
+		}
+		if configuration.ConfigFilename != "" {
+			current.ConfigFilename = configuration.ConfigFilename
+		}
+		if configuration.ChannelName != "" {
+			current.ChannelName = configuration.ChannelName
+		}
+	}
+	return err
+}
+
+// configFromJSON parses the JSON of configuration 'configname' with the type
+// that registered itself under that name in the config package.
+func (c *context) configFromJSON(configname string, jsondata []byte) (config.Config, error) {
 	c.service.Logger.LogInfo(c.service.Name, fmt.Sprintf("configuration %s, FromJSON", configname))
-	switch configname {
-	case "aqi":
-		ci, err = config.AqiConfigFromJSON(jsondata)
-	case "automation":
-		ci, err = config.AutomationConfigFromJSON(jsondata)
-	case "calendar":
-		ci, err = config.CalendarConfigFromJSON(jsondata)
-	case "conbee/lights":
-		ci, err = config.ConbeeLightsConfigFromJSON(jsondata)
-	case "conbee/sensors":
-		ci, err = config.ConbeeSensorsConfigFromJSON(jsondata)
-	case "flux":
-		ci, err = config.FluxConfigFromJSON(jsondata)
-	case "huebridge":
-		ci, err = config.HueBridgeConfigFromJSON(jsondata)
-	case "presence":
-		ci, err = config.PresenceConfigFromJSON(jsondata)
-	case "shout":
-		ci, err = config.ShoutConfigFromJSON(jsondata)
-	case "suncalc":
-		ci, err = config.SuncalcConfigFromJSON(jsondata)
-	case "tv/bravia":
-		ci, err = config.BraviaTVConfigFromJSON(jsondata)
-	case "tv/samsung":
-		ci, err = config.SamsungTVConfigFromJSON(jsondata)
-	case "weather":
-		ci, err = config.WeatherConfigFromJSON(jsondata)
-	case "wemo":
-		ci, err = config.WemoConfigFromJSON(jsondata)
-	case "yee":
-		ci, err = config.YeeConfigFromJSON(jsondata)
-	}
-	return ci, err
+	return config.Parse(configname, jsondata)
 }
 
+// initializeConfigFileWatcher replaces the watcher with one that watches the
+// files of the current configurations.
 func (c *context) initializeConfigFileWatcher() {
+	if c.watcher != nil {
+		c.watcher.close()
+		c.watcher = nil
+	}
+	m := c.service
+	watcher, err := newConfigFileWatcher(c.debounce, func(name string) {
+		m.ProcessMessages <- &microservice.Message{Topic: changedTopic, Payload: []byte(name)}
+	}, func(err error) {
+		m.Logger.LogError(m.Name, err.Error())
+	})
+	if err != nil {
+		m.Logger.LogError(m.Name, err.Error())
+		return
+	}
+	c.watcher = watcher
 	for name, configuration := range c.configs.Configurations {
-		c.watcher.watchConfigFile(configuration.ConfigFilename, name)
+		if err := c.watcher.watchConfigFile(configuration.ConfigFilename, name); err != nil {
+			m.Logger.LogError(m.Name, err.Error())
+		}
+		// The overlay of the home is watched when the home has a directory
+		overlay := c.layers.OverlayPath(configuration.ConfigFilename)
+		if _, err := os.Stat(filepath.Dir(overlay)); overlay != "" && err == nil {
+			if err := c.watcher.watchConfigFile(overlay, name); err != nil {
+				m.Logger.LogError(m.Name, err.Error())
+			}
+		}
 	}
 }
 
-func (c *context) updateConfigFileWatcher() {
-	events := c.watcher.update()
-	for _, event := range events {
-		if event.Event == MODIFIED {
-			_, exists := c.configs.Configurations[event.User]
-			if exists {
-				c.sendConfigOnChannel(event.User)
-			}
-		}
+// reloadConfig publishes configuration 'configtype' after its file changed,
+// a file that does not validate is not published and the last-known-good
+// configuration stays in use.
+func (c *context) reloadConfig(configtype string) error {
+	v, configuration, err := c.loadConfig(configtype)
+	if err != nil {
+		c.logErrors(err)
+		return fmt.Errorf("configuration %s is invalid, keeping the last-known-good configuration", configtype)
 	}
+	if good, exists := c.good[configtype]; exists && good.Version == v.Version {
+		return nil
+	}
+	c.good[configtype] = v
+	return c.publish(configtype, configuration, v)
 }
 
+// rollbackConfig restores the file of configuration 'configtype' to an
+// earlier version and publishes it, e.g. {"name": "automation", "version": "1f2e3d", "author": "jurgen"}.
+// A rollback rewrites files, so 'config/rollback/' must be protected with a
+// key in config.PubSubKeys, a rollback on an unprotected topic is refused.
+func (c *context) rollbackConfig(request *rollbackRequest) error {
+	if !c.service.Keyring.Protects(rollbackTopic) {
+		return fmt.Errorf("rollback of %s refused, %s is not protected by a key", request.Name, rollbackTopic)
+	}
+	configuration, exists := c.configs.Configurations[request.Name]
+	if !exists {
+		return fmt.Errorf("configuration %s does not exist", request.Name)
+	}
+	overlay := c.layers.OverlayPath(configuration.ConfigFilename)
+	if _, err := c.history.rollback(request.Name, configuration.ConfigFilename, overlay, request.Version, request.Author, c.service.Now()); err != nil {
+		return err
+	}
+	c.publishHistory(request.Name)
+	return c.reloadConfig(request.Name)
+}
+
+// checkAllConfigurationFiles loads every configuration, the valid ones are
+// the last-known-good configurations to start with.
 func (c *context) checkAllConfigurationFiles() (err error) {
-	for name, configuration := range c.configs.Configurations {
-		var data []byte
-		data, err = ioutil.ReadFile(configuration.ConfigFilename)
+	c.good = map[string]*version{}
+	for name := range c.configs.Configurations {
+		var v *version
+		v, _, err = c.loadConfig(name)
 		if err != nil {
-			c.service.Logger.LogError(c.service.Name, err.Error())
-		} else {
-			if data != nil {
-				v, err := c.configFromJSON(name, data)
-				if err != nil {
-					c.service.Logger.LogError(c.service.Name, err.Error())
-				} else {
-					data, err = v.ToJSON()
-					if err != nil {
-						c.service.Logger.LogError(c.service.Name, err.Error())
-					}
-				}
-			} else {
-				c.service.Logger.LogError(c.service.Name, fmt.Sprintf("Configuration %s did not have a ReflectType", name))
-			}
+			c.logErrors(err)
+			continue
 		}
+		c.good[name] = v
 	}
 	return
 }
 
+// logErrors logs every problem of a configuration file on its own line
+func (c *context) logErrors(err error) {
+	if errs, ok := err.(config.ValidationErrors); ok {
+		for _, e := range errs {
+			c.service.Logger.LogError(c.service.Name, e.Error())
+		}
+		return
+	}
+	c.service.Logger.LogError(c.service.Name, err.Error())
+}
+
 func (c *context) registerAllConfigurationChannels() (err error) {
 	for name, configuration := range c.configs.Configurations {
 		c.service.Logger.LogInfo(c.service.Name, fmt.Sprintf("Register pubsub channel %s for %s", configuration.ChannelName, name))
 		err = c.service.Register(configuration.ChannelName)
+		c.service.Register(historyChannel(name))
+		c.service.SetOptions(historyChannel(name), transport.Options{QoS: 1, Retain: true})
 	}
 	return
 }
 
+// loadConfig will load and parse the JSON based config file of 'configtype'
+// with its layers, the version holds the files and the JSON to publish.
+func (c *context) loadConfig(configtype string) (v *version, configuration *configuration, err error) {
+	if c.configs == nil {
+		return nil, nil, fmt.Errorf("haven't received configuration, so cannot send configuration requests")
+	}
+	configuration, exists := c.configs.Configurations[configtype]
+	if !exists {
+		return nil, nil, fmt.Errorf("configuration %s does not exist", configtype)
+	}
+	layered, err := c.layers.Load(configtype, configuration.ConfigFilename)
+	if err != nil {
+		return nil, configuration, err
+	}
+	cfg, err := c.configFromJSON(configtype, layered.Data)
+	if err != nil {
+		return nil, configuration, err
+	}
+	jsondata, err := cfg.ToJSON()
+	if err != nil {
+		return nil, configuration, err
+	}
+	file, err := filepath.Abs(configuration.ConfigFilename)
+	if err != nil {
+		return nil, configuration, err
+	}
+	v = &version{Version: config.VersionOf(jsondata), Source: "file", File: file, Content: string(layered.Base), Overlay: string(layered.Overlay)}
+	v.published, err = config.WithVersion(jsondata, v.Version)
+	return v, configuration, err
+}
+
+// currentConfig loads configuration 'configtype', when its file is invalid
+// the last-known-good configuration is returned.
+func (c *context) currentConfig(configtype string) (*version, *configuration, error) {
+	v, configuration, err := c.loadConfig(configtype)
+	if err == nil {
+		if good, exists := c.good[configtype]; !exists || good.Version != v.Version {
+			c.good[configtype] = v
+		}
+		return c.good[configtype], configuration, nil
+	}
+	good, exists := c.good[configtype]
+	if !exists || configuration == nil {
+		return nil, configuration, err
+	}
+	c.logErrors(err)
+	c.service.Logger.LogInfo(c.service.Name, fmt.Sprintf("configuration %s is invalid, serving the last-known-good configuration", configtype))
+	return good, configuration, nil
+}
+
+// publish publishes version 'v' of configuration 'configtype' and adds it to
+// the history when it differs from the latest version there.
+func (c *context) publish(configtype string, configuration *configuration, v *version) error {
+	if v.Time.IsZero() {
+		v.Time = c.service.Now()
+	}
+	added, err := c.history.add(configtype, v)
+	if err != nil {
+		c.service.Logger.LogError(c.service.Name, err.Error())
+	} else if added {
+		c.publishHistory(configtype)
+	}
+	c.service.Logger.LogInfo(c.service.Name, fmt.Sprintf("Publish %s version %s on channel %s", configtype, v.Version, configuration.ChannelName))
+	return c.service.Pubsub.Publish(configuration.ChannelName, v.published)
+}
+
+// publishHistory publishes the versions of configuration 'configtype', newest
+// first and without their content, on 'config/history/<name>/'.
+func (c *context) publishHistory(configtype string) {
+	summaries, err := c.history.summaries(configtype)
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(summaries); err == nil {
+			err = c.service.Pubsub.Publish(historyChannel(configtype), data)
+		}
+	}
+	if err != nil {
+		c.service.Logger.LogError(c.service.Name, err.Error())
+	}
+}
+
+func historyChannel(configtype string) string {
+	return "config/history/" + configtype + "/"
+}
+
 // SendConfigOnChannel will load the JSON based config file and publish it onto pubsub
 func (c *context) sendConfigOnChannel(configtype string) (err error) {
-	if c.configs != nil {
-		configuration, exists := c.configs.Configurations[configtype]
-		if exists {
-			var configJSONData []byte
-			configJSONData, err = ioutil.ReadFile(configuration.ConfigFilename)
-			if err != nil {
-				return err
-			}
-			if configJSONData != nil {
-				v, err := c.configFromJSON(configtype, configJSONData)
-				if err == nil {
-					jsondata, err := v.ToJSON()
-					if err == nil {
-						c.service.Logger.LogInfo(c.service.Name, fmt.Sprintf("Publish %s on channel %s", string(jsondata), configuration.ChannelName))
-						err = c.service.Pubsub.Publish(configuration.ChannelName, jsondata)
-					}
-				}
-			} else {
-				err = fmt.Errorf("configuration %s did not have JSON data", configtype)
-			}
-		} else {
-			err = fmt.Errorf("configuration %s does not exist", configtype)
-		}
-	} else {
-		err = fmt.Errorf("haven't received configuration, so cannot send configuration requests")
+	v, configuration, err := c.currentConfig(configtype)
+	if err == nil {
+		err = c.publish(configtype, configuration, v)
 	}
 	return
 }
 
-func main() {
-	register := []string{"config/config/", "config/request/"}
-	subscribe := []string{"config/config/", "config/request/"}
+// rollbackTopic is where a rollback is requested, see rollbackConfig
+const rollbackTopic = "config/rollback/"
+
+type rollbackRequest struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Author  string `json:"author"`
+}
 
-	m := microservice.New("config")
+func setup(m *microservice.Service, layers *config.Layers) *context {
+	register := []string{"config/config/", "config/request/"}
+	subscribe := []string{"config/config/", "config/request/", rollbackTopic}
 	m.RegisterAndSubscribe(register, subscribe)
 
-	ctx := newContext()
-	ctx.service = m
+	ctx := newContext(m, layers)
+
+	// The registered configuration types are served from the start, a
+	// 'config/config/' message can move their file or channel.
+	ctx.configs = registeredConfigs()
+	ctx.checkAllConfigurationFiles()
+	ctx.registerAllConfigurationChannels()
+	ctx.initializeConfigFileWatcher()
+
+	m.OnShutdown(func(m *microservice.Service) {
+		if ctx.watcher != nil {
+			ctx.watcher.close()
+		}
+	})
 
 	m.RegisterHandler("config/config/", func(m *microservice.Service, topic string, msg []byte) bool {
-		config, err := configFromJSON(msg)
+		overrides, err := configFromJSON(msg)
 		if err == nil {
 			m.Logger.LogInfo(m.Name, "received configuration")
-			ctx.configs = config
+			configs := registeredConfigs()
+			if err := configs.override(overrides); err != nil {
+				m.Logger.LogError(m.Name, err.Error())
+			}
+			ctx.configs = configs
 			ctx.checkAllConfigurationFiles()
 			ctx.registerAllConfigurationChannels()
 			ctx.initializeConfigFileWatcher()
@@ -193,17 +350,60 @@ func main() {
 		return true
 	})
 
-	tickCount := 0
-	m.RegisterHandler("tick/", func(m *microservice.Service, topic string, msg []byte) bool {
-		if tickCount == 5 {
-			tickCount = 0
-			// Any config files updated ?
-			ctx.updateConfigFileWatcher()
-		} else {
-			tickCount += 1
+	// Request/reply variant of 'config/request/', the reply is the configuration
+	m.RegisterResponder("config/get/", func(m *microservice.Service, topic string, msg []byte) ([]byte, error) {
+		configname := string(msg)
+		m.Logger.LogInfo(m.Name, "configuration for '"+configname+"' requested.")
+		v, _, err := ctx.currentConfig(configname)
+		if err != nil {
+			return nil, err
+		}
+		return v.published, nil
+	})
+
+	m.RegisterHandler(rollbackTopic, func(m *microservice.Service, topic string, msg []byte) bool {
+		request := &rollbackRequest{}
+		err := json.Unmarshal(msg, request)
+		if err == nil {
+			m.Logger.LogInfo(m.Name, fmt.Sprintf("rollback of '%s' to version %s requested.", request.Name, request.Version))
+			err = ctx.rollbackConfig(request)
+		}
+		if err != nil {
+			ctx.logErrors(err)
+		}
+		return true
+	})
+
+	m.RegisterHandler(changedTopic, func(m *microservice.Service, topic string, msg []byte) bool {
+		configname := string(msg)
+		if _, exists := ctx.configs.Configurations[configname]; !exists {
+			return true
+		}
+		m.Logger.LogInfo(m.Name, "configuration file of '"+configname+"' changed.")
+		if err := ctx.reloadConfig(configname); err != nil {
+			m.Logger.LogError(m.Name, err.Error())
 		}
 		return true
 	})
 
-	m.Loop()
+	return ctx
+}
+
+func main() {
+	layers := config.LayersFromEnv(os.Environ())
+	layers.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		os.Exit(command(layers, flag.Args(), os.Stdout, os.Stderr))
+	}
+
+	// The flags override the broker that New resolved from the environment
+	m := microservice.New("config", time.Second)
+	m.PubsubCfg, m.PubsubErr = config.ResolvePubSub(layers)
+	if m.PubsubErr != nil {
+		m.Logger.LogError(m.Name, m.PubsubErr.Error())
+		os.Exit(1)
+	}
+	setup(m, layers)
+	m.Loop(gocontext.Background())
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+	microservice "github.com/jurgen-kluft/go-home/micro-service"
+)
+
+func TestRegisteredConfigsParse(t *testing.T) {
+	configs := registeredConfigs()
+	if len(configs.Configurations) == 0 {
+		t.Fatal("expected registered configuration types")
+	}
+	for name, configuration := range configs.Configurations {
+		data, err := os.ReadFile(filepath.Join("..", configuration.ConfigFilename))
+		if err != nil {
+			t.Errorf("%s: %s", name, err.Error())
+			continue
+		}
+		c, err := config.Parse(name, data)
+		var keyErr aes.KeySizeError
+		if errors.As(err, &keyErr) && os.Getenv("GO_HOME_KEY") == "" {
+			// The secrets of this configuration cannot be decrypted without the key
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", name, err.Error())
+			continue
+		}
+		// The published configuration carries its version
+		if data, err = c.ToJSON(); err == nil {
+			_, err = config.WithVersion(data, config.VersionOf(data))
+		}
+		if err != nil {
+			t.Errorf("%s: %s", name, err.Error())
+		}
+	}
+}
+
+func TestOverrideConfigs(t *testing.T) {
+	configs := registeredConfigs()
+	overrides, err := configFromJSON([]byte(`{"configurations": {
+		"flux": {"name": "flux", "filename": "home2/flux.config.json"},
+		"heating": {"name": "heating", "filename": "heating.config.json", "channel": "config/heating/"}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := configs.override(overrides); err == nil {
+		t.Error("expected an error for a type that is not registered")
+	}
+	flux := configs.Configurations["flux"]
+	if flux.ConfigFilename != "home2/flux.config.json" || flux.ChannelName != "config/flux/" {
+		t.Errorf("unexpected flux configuration %+v", flux)
+	}
+	if _, exists := configs.Configurations["heating"]; exists {
+		t.Error("a type that is not registered should not be served")
+	}
+}
+
+func TestValidateReportsPosition(t *testing.T) {
+	data := []byte(`{
+	"seasons": [],
+	"lighttype": [
+		{"lightname": "hue", "channel": "state/light/hue/", "ct": {"min": 2700, "max": 5000}, "colour": "blue"}
+	]
+}`)
+	err := config.ValidateFile("flux", "flux.config.json", data)
+	errs, ok := err.(config.ValidationErrors)
+	if !ok {
+		t.Fatalf("expected validation errors, got %v", err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %d: %v", len(errs), errs)
+	}
+	if errs[0].Line != 4 || errs[0].Path != "lighttype[0]" || !strings.Contains(errs[0].Message, "colour") || errs[0].File != "flux.config.json" {
+		t.Errorf("unexpected error %s", errs[0].Error())
+	}
+
+	data = []byte(`{"lighttype": [{"channel": "state/light/hue/", "ct": {"min": 5000, "max": 2700}}]}`)
+	err = config.Validate("flux", data)
+	if err == nil || !strings.Contains(err.Error(), "lighttype[0].ct: min 5000 is more than max 2700") {
+		t.Errorf("expected a range error, got %v", err)
+	}
+
+	err = config.Validate("presence", []byte(`{"host": "192.168.1.1", "update_history": 5}`))
+	if err == nil || !strings.Contains(err.Error(), "update_interval_sec") {
+		t.Errorf("expected a missing field error, got %v", err)
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "suncalc.config.json")
+	if err := os.WriteFile(path, []byte(`{"config": {"latitude": 131.2, "longitude": 121.4}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if code := command(nil, []string{"validate", path}, stdout, stderr); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), path+":1:25: config.latitude:") {
+		t.Errorf("unexpected output %q", stderr.String())
+	}
+	if code := command(nil, []string{"validate", "unknown.json"}, stdout, stderr); code != 2 {
+		t.Errorf("expected exit code 2, got %d", code)
+	}
+}
+
+func TestShippedConfigsValidate(t *testing.T) {
+	for _, ty := range config.Types() {
+		data, err := os.ReadFile(filepath.Join("..", ty.File))
+		if err != nil {
+			t.Errorf("%s: %s", ty.Name, err.Error())
+			continue
+		}
+		err = config.ValidateFile(ty.Name, ty.File, data)
+		var keyErr aes.KeySizeError
+		if errors.As(err, &keyErr) && os.Getenv("GO_HOME_KEY") == "" {
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestReloadKeepsLastKnownGood(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flux.config.json")
+	valid := `{"lighttype": [{"channel": "state/light/hue/", "ct": {"min": 2700, "max": 5000}}]}`
+	os.WriteFile(path, []byte(valid), 0644)
+
+	m := microservice.New("config", time.Second)
+	ctx := setup(m, nil)
+	ctx.debounce = 20 * time.Millisecond
+	ctx.history = newHistory(t.TempDir())
+	h := microservice.NewHarness(m, time.Now())
+	defer h.Shutdown()
+	h.Inject("config/config/", []byte(`{"configurations": {"flux": {"filename": "`+path+`"}}}`))
+
+	h.Inject("config/request/", []byte("flux"))
+	if published := h.Published("config/flux/"); len(published) != 1 {
+		t.Fatalf("expected the configuration to be published, got %d", len(published))
+	}
+
+	// A file that does not validate is not published
+	os.WriteFile(path, []byte(`{"lighttype": [{"channel": "state/light/hue/", "ct": {"min": 5000, "max": 2700}}]}`), 0644)
+	time.Sleep(200 * time.Millisecond)
+	h.Drain()
+	if published := h.Published("config/flux/"); len(published) != 1 {
+		t.Fatalf("expected the invalid configuration not to be published, got %d", len(published))
+	}
+	reply, err := h.Request("config/get/", []byte("flux"), time.Second)
+	if err != nil || !strings.Contains(string(reply), `"max":5000`) {
+		t.Errorf("expected the last-known-good configuration, got %s (%v)", reply, err)
+	}
+
+	os.WriteFile(path, []byte(strings.Replace(valid, "5000", "6500", 1)), 0644)
+	time.Sleep(200 * time.Millisecond)
+	h.Drain()
+	last, _ := h.LastPublished("config/flux/")
+	if !strings.Contains(string(last), `"max":6500`) {
+		t.Errorf("expected the changed configuration to be published, got %s", last)
+	}
+}
+
+func TestHistoryAndRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flux.config.json")
+	first := `{"lighttype": [{"channel": "state/light/hue/", "ct": {"min": 2700, "max": 5000}}]}`
+	os.WriteFile(path, []byte(first), 0644)
+
+	m := microservice.New("config", time.Second)
+	ctx := setup(m, nil)
+	ctx.debounce = time.Hour
+	ctx.history = newHistory(t.TempDir())
+	h := microservice.NewHarness(m, time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+	defer h.Shutdown()
+	h.Inject("config/config/", []byte(`{"configurations": {"flux": {"filename": "`+path+`"}}}`))
+
+	h.Inject("config/request/", []byte("flux"))
+	published, _ := h.LastPublished("config/flux/")
+	firstVersion := config.Version(published)
+	if len(firstVersion) != 12 {
+		t.Fatalf("expected the version in the published configuration, got %s", published)
+	}
+	if _, err := config.FluxConfigFromJSON(published); err != nil {
+		t.Errorf("the published configuration should parse: %v", err)
+	}
+
+	os.WriteFile(path, []byte(`{"lighttype": [{"channel": "state/light/hue/", "ct": {"min": 2700, "max": 6500}}], "seasons": []}`), 0644)
+	m.ProcessMessages <- &microservice.Message{Topic: changedTopic, Payload: []byte("flux")}
+	h.Drain()
+	published, _ = h.LastPublished("config/flux/")
+	secondVersion := config.Version(published)
+	if secondVersion == firstVersion {
+		t.Fatalf("expected a new version, got %s", secondVersion)
+	}
+
+	var versions []*version
+	data, _ := h.LastPublished("config/history/flux/")
+	if err := json.Unmarshal(data, &versions); err != nil || len(versions) != 2 {
+		t.Fatalf("expected 2 versions, got %s", data)
+	}
+	if versions[0].Source != "file" || strings.Join(versions[0].Changes, ",") != "lighttype,seasons" || versions[0].Content != "" {
+		t.Errorf("unexpected latest version %+v", versions[0])
+	}
+
+	// A rollback rewrites files, it is refused on an unprotected topic
+	rollback := []byte(`{"name": "flux", "version": "` + firstVersion[:6] + `", "author": "jurgen"}`)
+	h.Inject("config/rollback/", rollback)
+	published, _ = h.LastPublished("config/flux/")
+	if version := config.Version(published); version != secondVersion {
+		t.Errorf("a rollback on an unprotected topic should be refused, got version %s", version)
+	}
+	m.Keyring, _ = microservice.NewKeyring(map[string]config.PubSubKey{"config/rollback/": {Sign: "202122232425262728292a2b2c2d2e2f"}})
+	h.Inject("config/rollback/", rollback)
+	published, _ = h.LastPublished("config/flux/")
+	if version := config.Version(published); version != secondVersion {
+		t.Errorf("an unsigned rollback should be rejected, got version %s", version)
+	}
+	sealed, _ := m.Keyring.Seal("config/rollback/", rollback)
+	h.Inject("config/rollback/", sealed)
+	published, _ = h.LastPublished("config/flux/")
+	if version := config.Version(published); version != firstVersion {
+		t.Errorf("expected version %s after the rollback, got %s", firstVersion, version)
+	}
+	if content, _ := os.ReadFile(path); string(content) != first {
+		t.Errorf("expected the file to be restored, got %s", content)
+	}
+	data, _ = h.LastPublished("config/history/flux/")
+	json.Unmarshal(data, &versions)
+	if len(versions) != 3 || versions[0].Source != "rollback to "+firstVersion || versions[0].Author != "jurgen" {
+		t.Errorf("unexpected history %s", data)
+	}
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if code := historyCommand(ctx.history, "flux", stdout, stderr); code != 0 || strings.Count(stdout.String(), "\n") != 3 {
+		t.Errorf("unexpected history output %q %q", stdout.String(), stderr.String())
+	}
+
+	// The command line restores the file the service loaded, not flux.config.json
+	if code := rollbackCommand(ctx.history, nil, "flux", secondVersion[:6], stdout, stderr); code != 0 {
+		t.Fatalf("rollback failed, %q", stderr.String())
+	}
+	if content, _ := os.ReadFile(path); !strings.Contains(string(content), `"max": 6500`) {
+		t.Errorf("expected %s to be restored, got %s", path, content)
+	}
+}
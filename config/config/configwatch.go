@@ -1,123 +1,119 @@
 package main
 
 import (
-	"os"
-)
+	"path/filepath"
+	"sync"
+	"time"
 
-// These values represent the events fswatch knows about. Watch uses a
-// fsstat call to look up file information; a file will only have a NOPERM
-// event if the parent directory has no search permission (i.e. parent
-// directory doesn't have executable permissions for the current user).
-const (
-	NONE     = iota // No event, initial state.
-	CREATED         // File was created.
-	DELETED         // File was deleted.
-	MODIFIED        // File was modified.
-	PERM            // Changed permissions
-	NOEXIST         // File does not exist.
-	NOPERM          // No permissions for the file (see const block comment).
-	INVALID         // Any type of error not represented above.
+	"github.com/fsnotify/fsnotify"
 )
 
+// configFileWatcher watches the directories of the configuration files, an
+// editor that saves by writing a new file and renaming it over the old one
+// would otherwise leave a watch on a file that is gone. The events of a file
+// are debounced, 'changed' is called once the file has not been written to
+// for the debounce duration so that a file is never read half-written.
 type configFileWatcher struct {
-	configFiles map[string]*configFileWatchItem
-}
-
-func newConfigFileWatcher() *configFileWatcher {
-	watcher := &configFileWatcher{}
-	watcher.configFiles = map[string]*configFileWatchItem{}
-	return watcher
+	watcher  *fsnotify.Watcher
+	debounce time.Duration
+	changed  func(user string)
+	failed   func(err error)
+	files    map[string]string
+	dirs     map[string]bool
+	timers   map[string]*time.Timer
+	lock     sync.Mutex
 }
 
-func (c *configFileWatcher) watchConfigFile(path string, user string) {
-	wi := new(configFileWatchItem)
-	wi.path = path
-	wi.user = user
-	wi.lastEvent = NONE
-
-	fi, err := os.Stat(path)
-	if err == nil {
-		wi.statInfo = fi
-	} else if os.IsNotExist(err) {
-		wi.lastEvent = NOEXIST
-	} else if os.IsPermission(err) {
-		wi.lastEvent = NOPERM
-	} else {
-		wi.lastEvent = INVALID
+func newConfigFileWatcher(debounce time.Duration, changed func(user string), failed func(err error)) (*configFileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
 	}
-
-	c.configFiles[path] = wi
-
-	return
-}
-
-type configFileEvent struct {
-	Path  string
-	User  string
-	Event int
+	c := &configFileWatcher{
+		watcher:  watcher,
+		debounce: debounce,
+		changed:  changed,
+		failed:   failed,
+		files:    map[string]string{},
+		dirs:     map[string]bool{},
+		timers:   map[string]*time.Timer{},
+	}
+	go c.run()
+	return c, nil
 }
 
-func (c *configFileWatcher) update() []configFileEvent {
-	events := []configFileEvent{}
-	for fname, fitem := range c.configFiles {
-		if fitem.update() {
-			event := configFileEvent{Path: fname, User: fitem.user, Event: fitem.lastEvent}
-			events = append(events, event)
-		}
+// watchConfigFile calls 'changed' with 'user' when the file at 'path' is
+// written, created or replaced.
+func (c *configFileWatcher) watchConfigFile(path string, user string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
 	}
-
-	return events
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.files[path] = user
+	dir := filepath.Dir(path)
+	if c.dirs[dir] {
+		return nil
+	}
+	if err := c.watcher.Add(dir); err != nil {
+		return err
+	}
+	c.dirs[dir] = true
+	return nil
 }
 
-type configFileWatchItem struct {
-	path      string
-	user      string
-	statInfo  os.FileInfo
-	lastEvent int
+// close stops watching, pending changes are dropped
+func (c *configFileWatcher) close() {
+	c.lock.Lock()
+	for path, timer := range c.timers {
+		timer.Stop()
+		delete(c.timers, path)
+	}
+	c.lock.Unlock()
+	c.watcher.Close()
 }
 
-func (wi *configFileWatchItem) update() bool {
-	fi, err := os.Stat(wi.path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			if wi.lastEvent == NOEXIST {
-				return false
-			} else if wi.lastEvent == DELETED {
-				wi.lastEvent = NOEXIST
-				return false
-			} else {
-				wi.lastEvent = DELETED
-				return true
+func (c *configFileWatcher) run() {
+	for {
+		select {
+		case event, ok := <-c.watcher.Events:
+			if !ok {
+				return
 			}
-		} else if os.IsPermission(err) {
-			if wi.lastEvent == NOPERM {
-				return false
+			// A file that is removed or renamed away keeps its configuration,
+			// the file that replaces it shows up as a create.
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) {
+				c.touched(filepath.Clean(event.Name))
 			}
-			wi.lastEvent = NOPERM
-			return true
-		} else {
-			wi.lastEvent = INVALID
-			return false
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			c.failed(err)
 		}
 	}
+}
 
-	if wi.lastEvent == NOEXIST {
-		wi.lastEvent = CREATED
-		wi.statInfo = fi
-		return true
-	} else if fi.ModTime().After(wi.statInfo.ModTime()) {
-		wi.statInfo = fi
-		switch wi.lastEvent {
-		case NONE, CREATED, NOPERM, INVALID:
-			wi.lastEvent = MODIFIED
-		case DELETED, NOEXIST:
-			wi.lastEvent = CREATED
-		}
-		return true
-	} else if fi.Mode() != wi.statInfo.Mode() {
-		wi.lastEvent = PERM
-		wi.statInfo = fi
-		return true
+// touched (re)starts the debounce timer of the file at 'path'
+func (c *configFileWatcher) touched(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	user, watched := c.files[path]
+	if !watched {
+		return
 	}
-	return false
+	if timer, exists := c.timers[path]; exists {
+		timer.Reset(c.debounce)
+		return
+	}
+	c.timers[path] = time.AfterFunc(c.debounce, func() {
+		c.lock.Lock()
+		_, pending := c.timers[path]
+		delete(c.timers, path)
+		c.lock.Unlock()
+		if pending {
+			c.changed(user)
+		}
+	})
 }
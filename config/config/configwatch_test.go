@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestWatcher(t *testing.T, path string) chan string {
+	changed := make(chan string, 16)
+	watcher, err := newConfigFileWatcher(50*time.Millisecond, func(user string) {
+		changed <- user
+	}, func(err error) {
+		t.Error(err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(watcher.close)
+	if err := watcher.watchConfigFile(path, "flux"); err != nil {
+		t.Fatal(err)
+	}
+	return changed
+}
+
+func expectChanges(t *testing.T, changed chan string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case user := <-changed:
+			if user != "flux" {
+				t.Errorf("unexpected change of %s", user)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %d changes, got %d", n, i)
+		}
+	}
+	select {
+	case <-changed:
+		t.Errorf("expected %d changes, got more", n)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "flux.config.json")
+	os.WriteFile(path, []byte(`{}`), 0644)
+	changed := newTestWatcher(t, path)
+
+	for i := 0; i < 5; i++ {
+		os.WriteFile(path, []byte(`{"seasons": []}`), 0644)
+	}
+	os.WriteFile(filepath.Join(dir, "other.json"), []byte(`{}`), 0644)
+	expectChanges(t, changed, 1)
+}
+
+func TestWatcherRenameAndReplace(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "flux.config.json")
+	os.WriteFile(path, []byte(`{}`), 0644)
+	changed := newTestWatcher(t, path)
+
+	// Save as an editor does, write a new file and rename it over the old one
+	for i := 0; i < 2; i++ {
+		tmp := filepath.Join(dir, ".flux.config.json.swp")
+		os.WriteFile(tmp, []byte(`{"seasons": []}`), 0644)
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+		expectChanges(t, changed, 1)
+	}
+}
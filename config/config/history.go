@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+)
+
+// maxVersions is the number of versions kept in the history of a configuration
+const maxVersions = 50
+
+// version is a configuration as it was published, Content and Overlay are the
+// base file and the overlay of the home it was resolved from so that a
+// rollback restores the files as they were written. File is the path of the
+// base file, the file of a configuration can be moved by 'config/config/'.
+type version struct {
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+	// Source is what changed the configuration, e.g. 'file' or 'rollback to 1f2e3d4c5b6a'
+	Source string `json:"source"`
+	// Author is who changed the configuration, when that is known
+	Author string `json:"author,omitempty"`
+	// Changes are the top level fields that differ from the previous version
+	Changes []string `json:"changes,omitempty"`
+	File    string   `json:"file,omitempty"`
+	Content string   `json:"content,omitempty"`
+	Overlay string   `json:"overlay,omitempty"`
+	// published is the configuration as it is published, with its version
+	published []byte
+}
+
+// summary returns the version without its content
+func (v *version) summary() *version {
+	s := *v
+	s.Content = ""
+	s.Overlay = ""
+	return &s
+}
+
+// history keeps the versions of every configuration in a file per
+// configuration in 'dir', the config service adds a version when it
+// publishes a configuration that differs from the last one.
+type history struct {
+	dir string
+}
+
+func newHistory(dir string) *history {
+	return &history{dir: dir}
+}
+
+func (h *history) path(name string) string {
+	return filepath.Join(h.dir, name+".history.json")
+}
+
+// load returns the versions of configuration 'name', oldest first
+func (h *history) load(name string) ([]*version, error) {
+	data, err := os.ReadFile(h.path(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions := []*version{}
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("history of %s: %w", name, err)
+	}
+	return versions, nil
+}
+
+func (h *history) save(name string, versions []*version) error {
+	if len(versions) > maxVersions {
+		versions = versions[len(versions)-maxVersions:]
+	}
+	data, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(h.path(name), data)
+}
+
+// add appends 'v' to the history of configuration 'name', it returns false
+// when 'v' is the latest version already.
+func (h *history) add(name string, v *version) (bool, error) {
+	versions, err := h.load(name)
+	if err != nil {
+		return false, err
+	}
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		if latest.Version == v.Version {
+			if latest.File == v.File {
+				return false, nil
+			}
+			// The same configuration was moved to another file
+			latest.File = v.File
+			return false, h.save(name, versions)
+		}
+		v.Changes = latest.changesTo(v)
+	}
+	return true, h.save(name, append(versions, v))
+}
+
+// find returns the version of configuration 'name' that starts with 'prefix'
+func (h *history) find(name string, prefix string) (*version, error) {
+	versions, err := h.load(name)
+	if err != nil {
+		return nil, err
+	}
+	var found *version
+	for _, v := range versions {
+		if prefix != "" && strings.HasPrefix(v.Version, prefix) {
+			if found != nil && found.Version != v.Version {
+				return nil, fmt.Errorf("version %s of %s is ambiguous", prefix, name)
+			}
+			found = v
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("configuration %s has no version %s", name, prefix)
+	}
+	return found, nil
+}
+
+// file returns the path of the file that configuration 'name' was last
+// loaded from, or "" when the history does not know.
+func (h *history) file(name string) (string, error) {
+	versions, err := h.load(name)
+	if err != nil || len(versions) == 0 {
+		return "", err
+	}
+	return versions[len(versions)-1].File, nil
+}
+
+// summaries returns the versions of configuration 'name' without their
+// content, newest first, as published on 'config/history/<name>/'.
+func (h *history) summaries(name string) ([]*version, error) {
+	versions, err := h.load(name)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]*version, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		summaries = append(summaries, versions[i].summary())
+	}
+	return summaries, nil
+}
+
+// changesTo returns the top level fields of the files that differ in 'v'
+func (previous *version) changesTo(v *version) []string {
+	changed := changedFields([]byte(previous.Content), []byte(v.Content))
+	for _, field := range changedFields([]byte(previous.Overlay), []byte(v.Overlay)) {
+		if !contains(changed, field) {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func contains(fields []string, field string) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// changedFields returns the top level fields of two JSON objects that differ
+func changedFields(previous []byte, current []byte) []string {
+	before := map[string]json.RawMessage{}
+	after := map[string]json.RawMessage{}
+	json.Unmarshal(previous, &before)
+	json.Unmarshal(current, &after)
+	changed := []string{}
+	for field, value := range after {
+		if !jsonEqual(before[field], value) {
+			changed = append(changed, field)
+		}
+	}
+	for field := range before {
+		if _, exists := after[field]; !exists {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func jsonEqual(a json.RawMessage, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// writeFileAtomic replaces the file at 'path' by renaming a new file over it,
+// a reader never sees a half-written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode()
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// rollback restores the file of configuration 'name', and the overlay of the
+// home when the version had one, to the version that starts with 'prefix' and
+// records the rollback in the history. The config service validates and
+// publishes the restored configuration when it sees the change.
+func (h *history) rollback(name string, path string, overlayPath string, prefix string, author string, now time.Time) (*version, error) {
+	old, err := h.find(name, prefix)
+	if err != nil {
+		return nil, err
+	}
+	restore := map[string]string{path: old.Content}
+	if old.Overlay != "" && overlayPath != "" {
+		restore[overlayPath] = old.Overlay
+	}
+	for file, content := range restore {
+		if err := config.ValidateOverlayFile(name, file, []byte(content)); err != nil {
+			return nil, err
+		}
+	}
+	for file, content := range restore {
+		if err := writeFileAtomic(file, []byte(content)); err != nil {
+			return nil, err
+		}
+	}
+	v := &version{Version: old.Version, Time: now, Source: "rollback to " + old.Version, Author: author, File: path, Content: old.Content, Overlay: old.Overlay}
+	versions, err := h.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) > 0 {
+		v.Changes = versions[len(versions)-1].changesTo(v)
+	}
+	return v, h.save(name, append(versions, v))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+	microservice "github.com/jurgen-kluft/go-home/micro-service"
+)
+
+func TestMerge(t *testing.T) {
+	var base, overlay interface{}
+	json.Unmarshal([]byte(`{
+		"host": "10.0.0.1", "port": 1883, "removed": true,
+		"devices": [{"name": "bed", "address": "10.0.0.5"}, {"name": "desk", "address": "10.0.0.6"}],
+		"channels": ["a", "b"]
+	}`), &base)
+	json.Unmarshal([]byte(`{
+		"host": "10.0.1.1", "removed": null,
+		"devices": [{"name": "desk", "address": "10.0.1.6"}, {"name": "hall", "address": "10.0.1.7"}],
+		"channels": ["c"]
+	}`), &overlay)
+	merged, _ := json.Marshal(config.Merge(base, overlay))
+	expected := `{"channels":["c"],"devices":[{"address":"10.0.0.5","name":"bed"},{"address":"10.0.1.6","name":"desk"},{"address":"10.0.1.7","name":"hall"}],"host":"10.0.1.1","port":1883}`
+	if string(merged) != expected {
+		t.Errorf("unexpected merge\n%s\n%s", merged, expected)
+	}
+}
+
+func TestLayersLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "presence.config.json")
+	os.WriteFile(path, []byte(`{"host": "192.168.1.1", "port": 8080, "update_history": 5, "update_interval_sec": 10}`), 0644)
+	os.MkdirAll(filepath.Join(dir, "home2"), 0755)
+	os.WriteFile(filepath.Join(dir, "home2", "presence.config.json"), []byte(`{"host": "10.0.0.1"}`), 0644)
+
+	layers := config.LayersFromEnv([]string{"GOHOME_HOME=home2", "GOHOME__PRESENCE__UPDATE_INTERVAL_SEC=20", "GOHOME__FLUX__SEASONS=[]"})
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	layers.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-set", "presence.update_history=7", "-set", "presence.update_interval_sec=30"}); err != nil {
+		t.Fatal(err)
+	}
+
+	layered, err := layers.Load("presence", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved := map[string]interface{}{}
+	json.Unmarshal(layered.Data, &resolved)
+	if resolved["host"] != "10.0.0.1" || resolved["update_history"] != 7.0 || resolved["update_interval_sec"] != 30.0 || resolved["port"] != 8080.0 {
+		t.Errorf("unexpected configuration %s", layered.Data)
+	}
+	if layered.OverlayPath == "" || string(layered.Overlay) != `{"host": "10.0.0.1"}` {
+		t.Errorf("expected the overlay, got %q", layered.Overlay)
+	}
+
+	// An error in an overlay points at the overlay
+	os.WriteFile(filepath.Join(dir, "home2", "presence.config.json"), []byte(`{"hots": "10.0.0.1"}`), 0644)
+	if _, err := layers.Load("presence", path); err == nil || !strings.Contains(err.Error(), filepath.Join("home2", "presence.config.json")+":1:2") {
+		t.Errorf("expected an error in the overlay, got %v", err)
+	}
+	// The resolved configuration is validated as a whole
+	os.WriteFile(filepath.Join(dir, "home2", "presence.config.json"), []byte(`{"host": null}`), 0644)
+	if _, err := layers.Load("presence", path); err == nil || !strings.Contains(err.Error(), "missing required field 'host'") {
+		t.Errorf("expected a missing field, got %v", err)
+	}
+	if err := fs.Parse([]string{"-set", "presence"}); err == nil {
+		t.Error("expected an error for a -set without a value")
+	}
+}
+
+func TestResolvePubSub(t *testing.T) {
+	cfg, err := config.ResolvePubSub(config.LayersFromEnv([]string{"GOHOME__PUBSUB__MQTT_BROKER_HOST=10.0.0.60"}))
+	if err != nil || cfg["transport"] != "mqtt" || cfg["mqtt.broker.host"] != "10.0.0.60" {
+		t.Errorf("unexpected pubsub configuration %v (%v)", cfg, err)
+	}
+	if config.PubSubMQTTHome["mqtt.broker.host"] == "10.0.0.60" {
+		t.Error("the profile should not change")
+	}
+
+	layers := config.LayersFromEnv([]string{"GOHOME_PUBSUB=nats.work"})
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	layers.RegisterFlags(fs)
+	fs.Parse([]string{"-pubsub", "nats.home", "-set", "pubsub.host=tcp://10.0.0.23:8080"})
+	cfg, err = config.ResolvePubSub(layers)
+	if err != nil || cfg["transport"] != "nats" || cfg["host"] != "tcp://10.0.0.23:8080" || cfg["license"] != config.PubSubNATSHome["license"] {
+		t.Errorf("unexpected pubsub configuration %v (%v)", cfg, err)
+	}
+
+	// Keys that the profile does not have get the dots of the transport keys
+	cfg, err = config.ResolvePubSub(config.LayersFromEnv([]string{
+		"GOHOME__PUBSUB__MQTT_BROKER_SCHEME=ssl",
+		"GOHOME__PUBSUB__MQTT_TLS_CA=/etc/gohome/tls/ca.pem",
+		"GOHOME__PUBSUB__MQTT_BROKER_CLIENTID=home2",
+		"GOHOME__PUBSUB__MQTT_KEEP_ALIVE=30",
+	}))
+	if err != nil || cfg["mqtt.broker.scheme"] != "ssl" || cfg["mqtt.tls.ca"] != "/etc/gohome/tls/ca.pem" || cfg["mqtt.broker.clientId"] != "home2" || cfg["mqtt.keep.alive"] != "30" {
+		t.Errorf("unexpected pubsub configuration %v (%v)", cfg, err)
+	}
+	if _, exists := cfg["mqtt_broker_scheme"]; exists {
+		t.Errorf("an override should not be stored under its environment name, %v", cfg)
+	}
+
+	if cfg, err := config.ResolvePubSub(&config.Layers{PubSub: "zigbee"}); err == nil || cfg != nil {
+		t.Error("expected an error and no broker for an unknown profile")
+	}
+
+	// Without a profile PubSubCfg selects the broker
+	defer func(cfg map[string]string) { config.PubSubCfg = cfg }(config.PubSubCfg)
+	config.PubSubCfg = config.PubSubNATSWork
+	cfg, err = config.ResolvePubSub(&config.Layers{Home: "home2"})
+	if err != nil || cfg["host"] != config.PubSubNATSWork["host"] {
+		t.Errorf("expected the broker of PubSubCfg, got %v (%v)", cfg, err)
+	}
+	cfg, _ = config.ResolvePubSub(&config.Layers{Home: "nats.home"})
+	if cfg["host"] != config.PubSubNATSHome["host"] {
+		t.Errorf("expected the profile named after the home, got %v", cfg)
+	}
+}
+
+func TestServiceAppliesLayers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "flux.config.json")
+	os.WriteFile(path, []byte(`{"lighttype": [{"channel": "state/light/hue/", "ct": {"min": 2700, "max": 5000}}]}`), 0644)
+	os.MkdirAll(filepath.Join(dir, "home2"), 0755)
+	overlay := filepath.Join(dir, "home2", "flux.config.json")
+	os.WriteFile(overlay, []byte(`{"lighttype": [{"channel": "state/light/wiz/", "ct": {"min": 2200, "max": 6500}}]}`), 0644)
+
+	m := microservice.New("config", time.Second)
+	ctx := setup(m, &config.Layers{Home: "home2"})
+	ctx.debounce = time.Hour
+	ctx.history = newHistory(t.TempDir())
+	h := microservice.NewHarness(m, time.Now())
+	defer h.Shutdown()
+	h.Inject("config/config/", []byte(`{"configurations": {"flux": {"filename": "`+path+`"}}}`))
+
+	h.Inject("config/request/", []byte("flux"))
+	published, _ := h.LastPublished("config/flux/")
+	flux, err := config.FluxConfigFromJSON(published)
+	if err != nil || len(flux.Lighttype) != 1 || flux.Lighttype[0].Channel != "state/light/wiz/" {
+		t.Fatalf("expected the overlay to be applied, got %s", published)
+	}
+	versions, _ := ctx.history.load("flux")
+	if len(versions) != 1 || versions[0].Overlay == "" {
+		t.Errorf("expected the overlay in the history, got %+v", versions)
+	}
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"encoding/json"
+)
+
+func init() {
+	Register(Type{Name: "esphome", File: "esphome.config.json", Channel: "config/esphome/", New: func() Config { return &EsphomeConfig{} }})
+}
+
+// EsphomeConfig holds the ESPHome devices that are connected over the native API
+type EsphomeConfig struct {
+	SensorsOut string          `json:"sensors.out"`
+	Commands   []string        `json:"commands"`
+	Devices    []EsphomeDevice `json:"devices"`
+}
+
+// EsphomeDevice is an ESPHome device, its states are published as a SensorState
+// with Name and Type. Entities maps the object id of an entity on the name of
+// its attribute, when empty every entity is published under its object id.
+// Controls maps the name of one of our devices (e.g. 'Bedroom Light Stand') on
+// the object id of a switch or light of the device.
+type EsphomeDevice struct {
+	Name     string            `json:"name" schema:"required"`
+	Type     string            `json:"type"`
+	Address  string            `json:"address" schema:"required"`
+	Password string            `json:"password,omitempty"`
+	Entities map[string]string `json:"entities,omitempty"`
+	Controls map[string]string `json:"controls,omitempty"`
+}
+
+// EsphomeConfigFromJSON converts a json string to a EsphomeConfig instance
+func EsphomeConfigFromJSON(data []byte) (*EsphomeConfig, error) {
+	config := &EsphomeConfig{}
+	err := json.Unmarshal(data, config)
+	return config, err
+}
+
+// FromJSON converts a json string to a EsphomeConfig instance
+func (c *EsphomeConfig) FromJSON(data []byte) error {
+	config := EsphomeConfig{}
+	err := json.Unmarshal(data, &config)
+	*c = config
+	return err
+}
+
+// ToJSON converts a EsphomeConfig to a JSON string
+func (c *EsphomeConfig) ToJSON() (data []byte, err error) {
+	data, err = json.Marshal(c)
+	return
+}
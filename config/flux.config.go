@@ -2,9 +2,14 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 )
 
+func init() {
+	Register(Type{Name: "flux", File: "flux.config.json", Channel: "config/flux/", New: func() Config { return &FluxConfig{} }})
+}
+
 // FluxConfigFromJSON converts a json string to a FluxConfig instance
 func FluxConfigFromJSON(data []byte) (*FluxConfig, error) {
 	r := &FluxConfig{}
@@ -36,7 +41,7 @@ type FluxConfig struct {
 type Lighttime struct {
 	CT          FromTo         `json:"ct"`
 	Bri         FromTo         `json:"bri"`
-	Darkorlight Darkorlight    `json:"darkorlight"`
+	Darkorlight Darkorlight    `json:"darkorlight" schema:"enum=dark|light|twilight"`
 	TimeSlot    TaggedTimeSlot `json:"timeslot"`
 }
 
@@ -51,7 +56,7 @@ type Lighttype struct {
 	MetricsName string `json:"metricsname"`
 	LightName   string `json:"lightname"`
 	LightType   string `json:"lighttype"`
-	Channel     string `json:"channel"`
+	Channel     string `json:"channel" schema:"required"`
 	CT          MinMax `json:"ct"`
 	BRI         MinMax `json:"bri"`
 }
@@ -67,8 +72,16 @@ func (f FromTo) LinearInterpolated(x float64) float64 {
 }
 
 type MinMax struct {
-	Min float64 `json:"min"`
-	Max float64 `json:"max"`
+	Min float64 `json:"min" schema:"required"`
+	Max float64 `json:"max" schema:"required"`
+}
+
+// Validate checks that Min is not more than Max
+func (m MinMax) Validate() error {
+	if m.Min > m.Max {
+		return fmt.Errorf("min %g is more than max %g", m.Min, m.Max)
+	}
+	return nil
 }
 
 // LinearInterpolated returns interpolated value between Min-Max
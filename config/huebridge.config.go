@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 )
 
+func init() {
+	Register(Type{Name: "huebridge", File: "huebridge.config.json", Channel: "config/huebridge/", New: func() Config { return &HueBridgeConfig{} }})
+}
+
 // HueBridgeConfig is a struct that holds information for our emulated Hue Bridge
 type HueBridgeConfig struct {
 	IPPort            string                    `json:"ip_port"`
@@ -0,0 +1,395 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// HomeEnv names the home that the services run in, e.g. GOHOME_HOME=home2.
+// The overlays of a home are in the directory of that name next to the base
+// configuration files, e.g. home2/flux.config.json.
+const HomeEnv = "GOHOME_HOME"
+
+// PubSubEnv selects one of PubSubProfiles, e.g. GOHOME_PUBSUB=nats.home
+const PubSubEnv = "GOHOME_PUBSUB"
+
+// OverrideEnvPrefix starts the environment variables that set a field of a
+// configuration, GOHOME__<NAME>__<FIELD>[__<FIELD>...]=<value>, e.g.
+// GOHOME__PRESENCE__UPDATE_INTERVAL_SEC=10 or GOHOME__PUBSUB__MQTT_BROKER_HOST=10.0.0.60.
+// The '/', '-' and '.' of names and fields are written as '_'.
+const OverrideEnvPrefix = "GOHOME__"
+
+// Layers are the layers of a configuration on top of its base file, from the
+// lowest to the highest: the overlay of the home, the environment variables
+// and the command line flags.
+type Layers struct {
+	Home      string
+	PubSub    string
+	Overrides []Override
+}
+
+// Override sets the field at Path of configuration Name to Value, a Value
+// that is not JSON is a string. An index in Path selects an element of an
+// array, the length of the array appends an element.
+type Override struct {
+	Name   string
+	Path   []string
+	Value  string
+	Source string
+}
+
+// LayersFromEnv returns the layers that 'environ' (see os.Environ) selects
+func LayersFromEnv(environ []string) *Layers {
+	l := &Layers{}
+	for _, variable := range environ {
+		key, value, _ := strings.Cut(variable, "=")
+		switch {
+		case key == HomeEnv:
+			l.Home = value
+		case key == PubSubEnv:
+			l.PubSub = value
+		case strings.HasPrefix(key, OverrideEnvPrefix):
+			path := strings.Split(strings.ToLower(key[len(OverrideEnvPrefix):]), "__")
+			if len(path) < 2 {
+				continue
+			}
+			l.Overrides = append(l.Overrides, Override{Name: path[0], Path: path[1:], Value: value, Source: key})
+		}
+	}
+	return l
+}
+
+// RegisterFlags adds the flags of the layers to 'fs', they are applied after
+// the environment variables:
+//
+//	-home home2
+//	-pubsub nats.home
+//	-set presence.update_interval_sec=10 (repeatable)
+func (l *Layers) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&l.Home, "home", l.Home, "The home whose overlays are applied, see "+HomeEnv)
+	fs.StringVar(&l.PubSub, "pubsub", l.PubSub, "The profile of the broker, see "+PubSubEnv)
+	fs.Func("set", "Set a field of a configuration, e.g. presence.update_interval_sec=10", func(s string) error {
+		field, value, found := strings.Cut(s, "=")
+		name, path, dotted := strings.Cut(field, ".")
+		if !found || !dotted || name == "" || path == "" {
+			return fmt.Errorf("expected <name>.<field>=<value>, got %s", s)
+		}
+		l.Overrides = append(l.Overrides, Override{Name: name, Path: strings.Split(path, "."), Value: value, Source: "-set " + s})
+		return nil
+	})
+}
+
+// OverlayPath returns the path of the overlay of the home of configuration
+// file 'path', it is empty when no home is selected.
+func (l *Layers) OverlayPath(path string) string {
+	if l == nil || l.Home == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(path), l.Home, filepath.Base(path))
+}
+
+// overridesOf returns the overrides of configuration 'name', in the order
+// in which they are applied.
+func (l *Layers) overridesOf(name string) []Override {
+	if l == nil {
+		return nil
+	}
+	overrides := []Override{}
+	for _, o := range l.Overrides {
+		if normalize(o.Name) == normalize(name) {
+			overrides = append(overrides, o)
+		}
+	}
+	return overrides
+}
+
+// Layered is a configuration resolved from its layers, Data is the JSON of
+// the configuration and Base and Overlay are the files it was resolved from.
+type Layered struct {
+	Data        []byte
+	Base        []byte
+	Overlay     []byte
+	OverlayPath string
+}
+
+// Load reads configuration file 'path' of type 'name' and applies the layers.
+// The files are validated on their own so that an error points at the line
+// in the file, the resolved configuration is validated as a whole. Without
+// an overlay or overrides the configuration is the file as it is.
+func (l *Layers) Load(name string, path string) (*Layered, error) {
+	base, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Layered{Data: base, Base: base}
+	if overlayPath := l.OverlayPath(path); overlayPath != "" {
+		r.Overlay, err = os.ReadFile(overlayPath)
+		if err == nil {
+			r.OverlayPath = overlayPath
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	overrides := l.overridesOf(name)
+	if r.OverlayPath == "" && len(overrides) == 0 {
+		if err := ValidateFile(name, path, base); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	if err := ValidateOverlayFile(name, path, base); err != nil {
+		return nil, err
+	}
+	doc, err := decodeJSON(base)
+	if err != nil {
+		return nil, err
+	}
+	if r.OverlayPath != "" {
+		if err := ValidateOverlayFile(name, r.OverlayPath, r.Overlay); err != nil {
+			return nil, err
+		}
+		overlay, err := decodeJSON(r.Overlay)
+		if err != nil {
+			return nil, err
+		}
+		doc = Merge(doc, overlay)
+	}
+	for _, o := range overrides {
+		if doc, err = set(doc, o.Path, parseValue(o.Value)); err != nil {
+			return nil, fmt.Errorf("%s: %w", o.Source, err)
+		}
+	}
+	if r.Data, err = json.MarshalIndent(doc, "", "  "); err != nil {
+		return nil, err
+	}
+	if err := ValidateFile(name, path+" (resolved)", r.Data); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Merge returns 'overlay' merged onto 'base', both decoded JSON:
+//
+//   - objects are merged field by field, a null field of the overlay removes
+//     the field
+//   - arrays of objects that all have a "name" are merged by name, the
+//     objects of the overlay that have a new name are appended
+//   - other arrays and all other values of the overlay replace those of the base
+func Merge(base interface{}, overlay interface{}) interface{} {
+	switch o := overlay.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			b = map[string]interface{}{}
+		}
+		merged := make(map[string]interface{}, len(b))
+		for key, value := range b {
+			merged[key] = value
+		}
+		for key, value := range o {
+			if existing, exists := lookupKey(merged, key); exists {
+				key = existing
+			}
+			if value == nil {
+				delete(merged, key)
+				continue
+			}
+			merged[key] = Merge(merged[key], value)
+		}
+		return merged
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok || !named(b) || !named(o) {
+			return o
+		}
+		merged := append([]interface{}{}, b...)
+		for _, item := range o {
+			name := item.(map[string]interface{})["name"]
+			found := false
+			for i, existing := range merged {
+				if existing.(map[string]interface{})["name"] == name {
+					merged[i] = Merge(existing, item)
+					found = true
+					break
+				}
+			}
+			if !found {
+				merged = append(merged, item)
+			}
+		}
+		return merged
+	}
+	return overlay
+}
+
+// named returns true when all the items are objects with a name
+func named(items []interface{}) bool {
+	for _, item := range items {
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if _, ok := object["name"].(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// set sets the field at 'path' of 'doc' to 'value', a field of an object may
+// span several elements of the path, e.g. mqtt.broker.host.
+func set(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	switch d := doc.(type) {
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i > len(d) {
+			return nil, fmt.Errorf("'%s' is not an index of an array of %d", path[0], len(d))
+		}
+		if i == len(d) {
+			d = append(d, nil)
+		}
+		item, err := set(d[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		d[i] = item
+		return d, nil
+	case map[string]interface{}, nil:
+		object, _ := d.(map[string]interface{})
+		if object == nil {
+			object = map[string]interface{}{}
+		}
+		key, n := matchKey(object, path)
+		item, err := set(object[key], path[n:], value)
+		if err != nil {
+			return nil, err
+		}
+		object[key] = item
+		return object, nil
+	}
+	return nil, fmt.Errorf("cannot set '%s' of %v", strings.Join(path, "."), doc)
+}
+
+// matchKey returns the key of 'object' that the start of 'path' names and
+// the number of elements of the path it spans, the longest match wins. A
+// path that names no key names a new key.
+func matchKey(object map[string]interface{}, path []string) (string, int) {
+	for n := len(path); n > 0; n-- {
+		if key, exists := lookupKey(object, strings.Join(path[:n], "_")); exists {
+			return key, n
+		}
+	}
+	return path[0], 1
+}
+
+// fullKey returns the key of 'object' that the whole of 'path' names
+func fullKey(object map[string]interface{}, path []string) (string, bool) {
+	key, n := matchKey(object, path)
+	if _, exists := object[key]; !exists || n != len(path) {
+		return "", false
+	}
+	return key, true
+}
+
+func lookupKey(object map[string]interface{}, name string) (string, bool) {
+	if _, exists := object[name]; exists {
+		return name, true
+	}
+	for key := range object {
+		if normalize(key) == normalize(name) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func normalize(name string) string {
+	return strings.NewReplacer("/", "_", "-", "_", ".", "_").Replace(strings.ToLower(name))
+}
+
+// parseValue returns the decoded JSON of 'value' or the value as a string
+func parseValue(value string) interface{} {
+	if decoded, err := decodeJSON([]byte(value)); err == nil {
+		return decoded
+	}
+	return value
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return v, nil
+}
+
+// PubSubSchema are the entries the transports read from a pubsub profile, an
+// override of an entry that the profile does not have is matched against
+// them, e.g. GOHOME__PUBSUB__MQTT_TLS_CA sets 'mqtt.tls.ca'.
+var PubSubSchema = []string{
+	"transport", "host", "license", "secret",
+	"mqtt.broker.scheme", "mqtt.broker.host", "mqtt.broker.port", "mqtt.broker.clientId",
+	"mqtt.broker.username", "mqtt.broker.password", "mqtt.broker.password.file",
+	"mqtt.qos", "mqtt.overflow",
+	"mqtt.tls.ca", "mqtt.tls.cert", "mqtt.tls.key", "mqtt.tls.pin", "mqtt.tls.servername",
+}
+
+// ResolvePubSub returns the configuration of the broker: the profile that
+// the layers select, or the profile with the name of the home, with the
+// overrides of 'pubsub' applied, e.g. -set pubsub.mqtt.broker.host=10.0.0.60.
+// PubSubCfg is the broker when neither selects a profile, an unknown
+// profile is an error.
+func ResolvePubSub(l *Layers) (map[string]string, error) {
+	selected := PubSubCfg
+	if l != nil && l.Home != "" {
+		if profile, exists := PubSubProfiles[l.Home]; exists {
+			selected = profile
+		}
+	}
+	if l != nil && l.PubSub != "" {
+		profile, exists := PubSubProfiles[l.PubSub]
+		if !exists {
+			return nil, fmt.Errorf("unknown pubsub profile %s", l.PubSub)
+		}
+		selected = profile
+	}
+	cfg := make(map[string]string, len(selected))
+	object := make(map[string]interface{}, len(selected))
+	for key, value := range selected {
+		cfg[key] = value
+		object[key] = value
+	}
+	schema := make(map[string]interface{}, len(PubSubSchema))
+	for _, key := range PubSubSchema {
+		schema[key] = nil
+	}
+	for _, o := range l.overridesOf("pubsub") {
+		key, found := fullKey(object, o.Path)
+		if !found {
+			key, found = fullKey(schema, o.Path)
+		}
+		if !found {
+			// An entry that is not known, the levels of an environment
+			// variable are separated by '_'
+			key = strings.Replace(strings.Join(o.Path, "."), "_", ".", -1)
+		}
+		cfg[key] = o.Value
+		object[key] = o.Value
+	}
+	return cfg, nil
+}
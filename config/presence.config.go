@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 )
 
+func init() {
+	Register(Type{Name: "presence", File: "presence.config.json", Channel: "config/presence/", New: func() Config { return &PresenceConfig{} }})
+}
+
 func PresenceConfigFromJSON(data []byte) (*PresenceConfig, error) {
 	r := &PresenceConfig{}
 	err := json.Unmarshal(data, r)
@@ -25,12 +29,12 @@ func (r *PresenceConfig) ToJSON() ([]byte, error) {
 
 type PresenceConfig struct {
 	Name              string      `json:"name"`
-	Host              string      `json:"host"`
+	Host              string      `json:"host" schema:"required"`
 	Port              int         `json:"port"`
 	User              CryptString `json:"user"`
 	Password          CryptString `json:"password"`
-	UpdateHistory     int         `json:"update_history"`
-	UpdateIntervalSec int         `json:"update_interval_sec"`
+	UpdateHistory     int         `json:"update_history" schema:"required,minimum=1"`
+	UpdateIntervalSec int         `json:"update_interval_sec" schema:"required,minimum=1"`
 	Devices           []struct {
 		Name string        `json:"name"`
 		Mac  []CryptString `json:"macs"`
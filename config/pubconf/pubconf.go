@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
+	"github.com/jurgen-kluft/go-home/config"
 	microservice "github.com/jurgen-kluft/go-home/micro-service"
 	"github.com/urfave/cli"
 )
@@ -23,23 +26,60 @@ func main() {
 			Value: "config/flux/",
 			Usage: "The channel to publish to",
 		},
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "The registered configuration type, its file and channel are the defaults of --file and --channel",
+		},
+		&cli.BoolFlag{
+			Name:  "list",
+			Usage: "List the registered configuration types",
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
+		if c.Bool("list") {
+			for _, t := range config.Types() {
+				fmt.Printf("%-16s %-28s %s\n", t.Name, t.File, t.Channel)
+			}
+			return nil
+		}
 
 		filename := c.String("file")
+		channel := c.String("channel")
+		name := c.String("name")
+		if name != "" {
+			t, exists := config.Lookup(name)
+			if !exists {
+				return fmt.Errorf("configuration type %s is not registered, see --list", name)
+			}
+			if !c.IsSet("file") {
+				filename = t.File
+			}
+			if !c.IsSet("channel") {
+				channel = t.Channel
+			}
+		}
 
 		filedata, err := os.ReadFile(filename)
 		if err != nil {
 			return err
 		}
 		jsonbytes := filedata
+		if name != "" {
+			// Publish the configuration as the config service would
+			v, err := config.Parse(name, filedata)
+			if err != nil {
+				return err
+			}
+			if jsonbytes, err = v.ToJSON(); err != nil {
+				return err
+			}
+		}
 
-		channel := c.String("channel")
 		register := []string{channel}
 		subscribe := []string{}
 
-		m := microservice.New("pubconf")
+		m := microservice.New("pubconf", time.Second)
 		m.RegisterAndSubscribe(register, subscribe)
 
 		m.RegisterHandler("*", func(m *microservice.Service, topic string, msg []byte) bool {
@@ -57,7 +97,7 @@ func main() {
 			return false
 		})
 
-		m.Loop()
+		m.Loop(context.Background())
 
 		return nil
 	}
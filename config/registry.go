@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Type describes a configuration type, the config service publishes the
+// configuration read from File on Channel when service Name requests it.
+type Type struct {
+	Name    string
+	File    string
+	Channel string
+	New     func() Config
+}
+
+var (
+	typesLock sync.RWMutex
+	types     = map[string]Type{}
+)
+
+// Register adds a configuration type, it is called from the init function
+// of the file that declares the type. Registering a name twice panics.
+func Register(t Type) {
+	typesLock.Lock()
+	defer typesLock.Unlock()
+	if t.Name == "" || t.New == nil {
+		panic("config: Register of a type without name or constructor")
+	}
+	if _, exists := types[t.Name]; exists {
+		panic("config: Register called twice for " + t.Name)
+	}
+	types[t.Name] = t
+}
+
+// Lookup returns the configuration type registered as 'name'
+func Lookup(name string) (Type, bool) {
+	typesLock.RLock()
+	defer typesLock.RUnlock()
+	t, exists := types[name]
+	return t, exists
+}
+
+// Types returns all the registered configuration types sorted by name
+func Types() []Type {
+	typesLock.RLock()
+	defer typesLock.RUnlock()
+	list := make([]Type, 0, len(types))
+	for _, t := range types {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Parse converts the JSON of configuration type 'name' into its Config
+func Parse(name string, data []byte) (Config, error) {
+	t, exists := Lookup(name)
+	if !exists {
+		return nil, fmt.Errorf("configuration type %s is not registered", name)
+	}
+	c := t.New()
+	if err := c.FromJSON(data); err != nil {
+		return nil, fmt.Errorf("configuration %s: %w", name, err)
+	}
+	return c, nil
+}
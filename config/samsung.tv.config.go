@@ -2,6 +2,10 @@ package config
 
 import "encoding/json"
 
+func init() {
+	Register(Type{Name: "tv/samsung", File: "samsung.tv.config.json", Channel: "config/samsung.tv/", New: func() Config { return &SamsungTVConfig{} }})
+}
+
 const (
 	BedroomSamsungTV = "Bedroom Samsung-TV"
 )
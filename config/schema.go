@@ -0,0 +1,609 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is a JSON Schema (draft-07) generated from a configuration type
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+}
+
+// The checks of a configuration type beyond its structure, e.g. MinMax
+// checks that Min <= Max.
+type validator interface {
+	Validate() error
+}
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	durationType    = reflect.TypeOf(time.Duration(0))
+	cryptStringType = reflect.TypeOf(CryptString{})
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	validatorType   = reflect.TypeOf((*validator)(nil)).Elem()
+)
+
+// SchemaOf returns the JSON Schema of the configuration type registered as 'name'
+func SchemaOf(name string) (*Schema, error) {
+	t, exists := Lookup(name)
+	if !exists {
+		return nil, fmt.Errorf("configuration type %s is not registered", name)
+	}
+	s := GenerateSchema(t.New())
+	s.Schema = "http://json-schema.org/draft-07/schema#"
+	s.Title = name
+	return s, nil
+}
+
+// GenerateSchema returns the JSON Schema of the type of 'v', the 'schema' tag
+// of a field marks it as required or adds a range or enum, e.g.
+// `schema:"required,minimum=1"` or `schema:"enum=dark|light|twilight"`.
+func GenerateSchema(v interface{}) *Schema {
+	return schemaOf(reflect.TypeOf(v))
+}
+
+func schemaOf(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == durationType:
+		return &Schema{Type: "integer"}
+	case t == cryptStringType:
+		return &Schema{Type: "string"}
+	case reflect.PtrTo(t).Implements(unmarshalerType):
+		// A type with its own JSON representation can be anything
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		zero := 0.0
+		return &Schema{Type: "integer", Minimum: &zero}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOf(t.Elem())}
+	case reflect.Struct:
+		s := &Schema{Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: false}
+		for _, f := range jsonFields(t) {
+			property := schemaOf(f.field.Type)
+			if applySchemaTag(property, f.field.Tag.Get("schema")) {
+				s.Required = append(s.Required, f.name)
+			}
+			s.Properties[f.name] = property
+		}
+		sort.Strings(s.Required)
+		return s
+	}
+	return &Schema{}
+}
+
+// applySchemaTag applies the options of a 'schema' tag, it returns true when
+// the field is required.
+func applySchemaTag(s *Schema, tag string) (required bool) {
+	for _, option := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "required":
+			required = true
+		case "minimum", "maximum":
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				if key == "minimum" {
+					s.Minimum = &f
+				} else {
+					s.Maximum = &f
+				}
+			}
+		case "enum":
+			s.Enum = strings.Split(value, "|")
+		}
+	}
+	return required
+}
+
+// jsonField is a field of a struct as encoding/json sees it
+type jsonField struct {
+	name  string
+	index []int
+	field reflect.StructField
+}
+
+// jsonFields returns the fields of a struct by their JSON name, the fields of
+// an embedded struct are promoted.
+func jsonFields(t reflect.Type) []jsonField {
+	fields := []jsonField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, options, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && options == "" {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for _, embedded := range jsonFields(f.Type) {
+				embedded.index = append([]int{i}, embedded.index...)
+				fields = append(fields, embedded)
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{name: name, index: []int{i}, field: f})
+	}
+	return fields
+}
+
+// ValidationError is a problem in a configuration file, Path is the JSON path
+// of the value, e.g. 'seasons[0].ct.min'.
+type ValidationError struct {
+	File    string
+	Line    int
+	Column  int
+	Path    string
+	Message string
+	// Err is the error of parsing the configuration, if that was the problem
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "(root)"
+	}
+	if e.File != "" {
+		return fmt.Sprintf("%s:%d:%d: %s: %s", e.File, e.Line, e.Column, path, e.Message)
+	}
+	return fmt.Sprintf("%d:%d: %s: %s", e.Line, e.Column, path, e.Message)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors are all the problems of a configuration file
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (errs ValidationErrors) Unwrap() []error {
+	unwrapped := make([]error, len(errs))
+	for i, err := range errs {
+		unwrapped[i] = err
+	}
+	return unwrapped
+}
+
+// Validate checks the JSON of configuration type 'name' against its schema:
+// unknown fields, missing required fields, types and ranges. When that holds
+// the configuration is parsed and its own checks run. The error is a
+// ValidationErrors, every error has the line and column of the value.
+func Validate(name string, data []byte) error {
+	return validate(name, data, false)
+}
+
+// ValidateOverlay checks a part of the JSON of configuration type 'name', as
+// an overlay holds it: unknown fields, types and ranges. Required fields may
+// be missing and a null value removes a field, the configuration that results
+// from all the layers is validated with Validate.
+func ValidateOverlay(name string, data []byte) error {
+	return validate(name, data, true)
+}
+
+func validate(name string, data []byte, partial bool) error {
+	t, exists := Lookup(name)
+	if !exists {
+		return fmt.Errorf("configuration type %s is not registered", name)
+	}
+	s, _ := SchemaOf(name)
+	v := &validation{data: data, partial: partial}
+	root, err := parseJSON(data)
+	if err != nil {
+		offset := len(data)
+		if serr, ok := err.(*json.SyntaxError); ok {
+			offset = int(serr.Offset)
+		}
+		v.add(offset, "", err.Error())
+		return v.errs
+	}
+	v.check(root, s, "")
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	if partial {
+		return nil
+	}
+
+	c := t.New()
+	if err := c.FromJSON(data); err != nil {
+		e := v.at(0, "", err.Error())
+		e.Err = err
+		v.errs = append(v.errs, e)
+		return v.errs
+	}
+	v.checkValues(reflect.ValueOf(c), root, "")
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+// ValidateFile validates configuration file 'path' as configuration type 'name'
+func ValidateFile(name string, path string, data []byte) error {
+	return inFile(path, Validate(name, data))
+}
+
+// ValidateOverlayFile validates overlay file 'path' of configuration type 'name'
+func ValidateOverlayFile(name string, path string, data []byte) error {
+	return inFile(path, ValidateOverlay(name, data))
+}
+
+func inFile(path string, err error) error {
+	if errs, ok := err.(ValidationErrors); ok {
+		for _, e := range errs {
+			e.File = path
+		}
+	}
+	return err
+}
+
+type validation struct {
+	data    []byte
+	partial bool
+	errs    ValidationErrors
+}
+
+func (v *validation) at(offset int, path string, message string) *ValidationError {
+	if offset > len(v.data) {
+		offset = len(v.data)
+	}
+	line := 1 + bytes.Count(v.data[:offset], []byte("\n"))
+	column := offset - bytes.LastIndexByte(v.data[:offset], '\n')
+	return &ValidationError{Line: line, Column: column, Path: path, Message: message}
+}
+
+func (v *validation) add(offset int, path string, message string) {
+	v.errs = append(v.errs, v.at(offset, path, message))
+}
+
+func (v *validation) check(n *jsonNode, s *Schema, path string) {
+	if n.kind == 'z' && (v.partial || s.Type == "object" || s.Type == "array" || s.Type == "") {
+		return
+	}
+	switch s.Type {
+	case "object":
+		if n.kind != '{' {
+			v.add(n.offset, path, "expected an object, got "+n.describe())
+			return
+		}
+		present := map[string]bool{}
+		for _, key := range n.keys {
+			child := n.fields[key]
+			property, exists := lookupProperty(s.Properties, key)
+			present[strings.ToLower(key)] = exists
+			if !exists {
+				if additional, ok := s.AdditionalProperties.(*Schema); ok {
+					property = additional
+				} else if s.AdditionalProperties == false {
+					v.add(n.keyOffsets[key], path, fmt.Sprintf("unknown field '%s'%s", key, suggest(key, s.Properties)))
+					continue
+				} else {
+					continue
+				}
+			}
+			v.check(child, property, join(path, key))
+		}
+		for _, required := range s.Required {
+			if v.partial {
+				break
+			}
+			if !present[strings.ToLower(required)] {
+				v.add(n.offset, path, fmt.Sprintf("missing required field '%s'", required))
+			}
+		}
+	case "array":
+		if n.kind != '[' {
+			v.add(n.offset, path, "expected an array, got "+n.describe())
+			return
+		}
+		for i, item := range n.items {
+			v.check(item, s.Items, fmt.Sprintf("%s[%d]", path, i))
+		}
+	case "string":
+		if n.kind != 's' {
+			v.add(n.offset, path, "expected a string, got "+n.describe())
+			return
+		}
+		if len(s.Enum) > 0 {
+			found := false
+			for _, e := range s.Enum {
+				found = found || e == n.value.(string)
+			}
+			if !found {
+				v.add(n.offset, path, fmt.Sprintf("'%s' is not one of %s", n.value, strings.Join(s.Enum, ", ")))
+			}
+		}
+	case "boolean":
+		if n.kind != 'b' {
+			v.add(n.offset, path, "expected a boolean, got "+n.describe())
+		}
+	case "integer", "number":
+		if n.kind != 'n' {
+			v.add(n.offset, path, "expected a number, got "+n.describe())
+			return
+		}
+		number := n.value.(json.Number)
+		if s.Type == "integer" && strings.ContainsAny(number.String(), ".eE") {
+			v.add(n.offset, path, "expected an integer, got "+number.String())
+			return
+		}
+		f, _ := number.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			v.add(n.offset, path, fmt.Sprintf("%s is less than the minimum %g", number, *s.Minimum))
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			v.add(n.offset, path, fmt.Sprintf("%s is more than the maximum %g", number, *s.Maximum))
+		}
+	}
+}
+
+// checkValues runs the checks of the values that implement Validate, 'n' is
+// the JSON node of the value so that an error points at its position.
+func (v *validation) checkValues(value reflect.Value, n *jsonNode, path string) {
+	if n == nil {
+		return
+	}
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	if value.CanAddr() && value.Addr().Type().Implements(validatorType) {
+		if err := value.Addr().Interface().(validator).Validate(); err != nil {
+			v.add(n.offset, path, err.Error())
+		}
+	} else if value.Type().Implements(validatorType) {
+		if err := value.Interface().(validator).Validate(); err != nil {
+			v.add(n.offset, path, err.Error())
+		}
+	}
+
+	switch value.Kind() {
+	case reflect.Struct:
+		if value.Type() == timeType {
+			return
+		}
+		for _, f := range jsonFields(value.Type()) {
+			v.checkValues(value.FieldByIndex(f.index), n.lookup(f.name), join(path, f.name))
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len() && i < len(n.items); i++ {
+			v.checkValues(value.Index(i), n.items[i], fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Map:
+		for _, key := range value.MapKeys() {
+			if key.Kind() == reflect.String {
+				element := reflect.New(value.Type().Elem()).Elem()
+				element.Set(value.MapIndex(key))
+				v.checkValues(element, n.fields[key.String()], join(path, key.String()))
+			}
+		}
+	}
+}
+
+// lookupProperty finds the property of a key, like encoding/json an exact
+// match is preferred over a case-insensitive one.
+func lookupProperty(properties map[string]*Schema, key string) (*Schema, bool) {
+	if property, exists := properties[key]; exists {
+		return property, true
+	}
+	for name, property := range properties {
+		if strings.EqualFold(name, key) {
+			return property, true
+		}
+	}
+	return nil, false
+}
+
+// lookup finds the node of a field the same way as lookupProperty
+func (n *jsonNode) lookup(name string) *jsonNode {
+	if child, exists := n.fields[name]; exists || n.fields == nil {
+		return child
+	}
+	for _, key := range n.keys {
+		if strings.EqualFold(name, key) {
+			return n.fields[key]
+		}
+	}
+	return nil
+}
+
+func join(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// suggest returns a hint for a misspelled field, e.g. 'update_intervl_sec'
+func suggest(key string, properties map[string]*Schema) string {
+	best, distance := "", 3
+	for name := range properties {
+		if d := editDistance(strings.ToLower(key), strings.ToLower(name)); d < distance || (d == distance && best != "" && name < best) {
+			best, distance = name, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean '%s'?", best)
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// jsonNode is a parsed JSON value with its offset in the document. The kind
+// is '{', '[', 's' (string), 'n' (number), 'b' (boolean) or 'z' (null).
+type jsonNode struct {
+	kind       byte
+	offset     int
+	value      interface{}
+	keys       []string
+	fields     map[string]*jsonNode
+	keyOffsets map[string]int
+	items      []*jsonNode
+}
+
+func (n *jsonNode) describe() string {
+	switch n.kind {
+	case '{':
+		return "an object"
+	case '[':
+		return "an array"
+	case 's':
+		return fmt.Sprintf("string '%s'", n.value)
+	case 'n':
+		return fmt.Sprintf("number %s", n.value)
+	case 'b':
+		return fmt.Sprintf("%v", n.value)
+	}
+	return "null"
+}
+
+// parseJSON parses a document into nodes that remember their offset
+func parseJSON(data []byte) (*jsonNode, error) {
+	p := &jsonParser{data: data, dec: json.NewDecoder(bytes.NewReader(data))}
+	p.dec.UseNumber()
+	n, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.dec.Token(); err == nil {
+		return nil, &json.SyntaxError{Offset: p.dec.InputOffset()}
+	}
+	return n, nil
+}
+
+type jsonParser struct {
+	data []byte
+	dec  *json.Decoder
+}
+
+// start returns the offset of the next token, the decoder only reports the
+// end of the previous one.
+func (p *jsonParser) start() int {
+	offset := int(p.dec.InputOffset())
+	for offset < len(p.data) && strings.IndexByte(" \t\r\n,:", p.data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+func (p *jsonParser) value() (*jsonNode, error) {
+	offset := p.start()
+	token, err := p.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	n := &jsonNode{offset: offset, value: token}
+	switch t := token.(type) {
+	case json.Delim:
+		if t == '{' {
+			n.kind = '{'
+			n.fields = map[string]*jsonNode{}
+			n.keyOffsets = map[string]int{}
+			for p.dec.More() {
+				keyOffset := p.start()
+				key, err := p.dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				child, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				name := key.(string)
+				if _, duplicate := n.fields[name]; !duplicate {
+					n.keys = append(n.keys, name)
+				}
+				n.fields[name] = child
+				n.keyOffsets[name] = keyOffset
+			}
+		} else {
+			n.kind = '['
+			for p.dec.More() {
+				child, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				n.items = append(n.items, child)
+			}
+		}
+		if _, err := p.dec.Token(); err != nil {
+			return nil, err
+		}
+	case string:
+		n.kind = 's'
+	case json.Number:
+		n.kind = 'n'
+	case bool:
+		n.kind = 'b'
+	default:
+		n.kind = 'z'
+	}
+	return n, nil
+}
@@ -4,28 +4,66 @@ package config
 // 2D4B615064526755
 
 var PubSubNATSHome = map[string]string{
-	"host":    "tcp://10.0.0.22:8080",
-	"license": "c1aVVz_sTmIi_FTcugWsjzTsQ4kJrslAAAAAAAAAAAI",
-	"secret":  "1ZPCl42pPIyq6ZsZbaV4OUexWw97cZvf",
+	"transport": "nats",
+	"host":      "tcp://10.0.0.22:8080",
+	"license":   "c1aVVz_sTmIi_FTcugWsjzTsQ4kJrslAAAAAAAAAAAI",
+	"secret":    "1ZPCl42pPIyq6ZsZbaV4OUexWw97cZvf",
 }
 
 var PubSubNATSWork = map[string]string{
-	"host":    "tcp://127.0.0.1:8080",
-	"license": "6YUwQVizikSOTIMfKtAvrcW5hwFBLFL2AAAAAAAAAAI",
-	"secret":  "BQQ1M7WIVGhWzjEilfV5ENHwYekj3T2z",
+	"transport": "nats",
+	"host":      "tcp://127.0.0.1:8080",
+	"license":   "6YUwQVizikSOTIMfKtAvrcW5hwFBLFL2AAAAAAAAAAI",
+	"secret":    "BQQ1M7WIVGhWzjEilfV5ENHwYekj3T2z",
 }
 
 var PubSubMQTTHome = map[string]string{
+	"transport":            "mqtt",
 	"mqtt.broker.host":     "10.0.0.58",
 	"mqtt.broker.port":     "1883",
 	"mqtt.broker.clientId": "gohome",
 	"mqtt.broker.username": "gohome",
 	"mqtt.broker.password": "gohome",
+	// A credential per service, the ACL of the embedded broker (mqtt-broker)
+	// is bound to the username, '{service}' is the name of the service with
+	// '/' replaced by '-' (e.g. 'tv-bravia').
+	// "mqtt.broker.username":      "{service}",
+	// "mqtt.broker.password.file": "/etc/gohome/mqtt/{service}.password",
+	// TLS with CA pinning and a client certificate per service, the ACL is
+	// bound to the common name of the certificate.
+	// "mqtt.broker.scheme": "ssl",
+	// "mqtt.tls.ca":        "/etc/gohome/tls/ca.pem",
+	// "mqtt.tls.cert":      "/etc/gohome/tls/{service}.pem",
+	// "mqtt.tls.key":       "/etc/gohome/tls/{service}.key",
+	// "mqtt.tls.pin":       "<hex sha256 of the public key of the broker or its CA>",
 }
 
-//var PubSubCfg = PubSubNATSWork
+// PubSubProfiles are the brokers that a home can select, see ResolvePubSub
+var PubSubProfiles = map[string]map[string]string{
+	"nats.home": PubSubNATSHome,
+	"nats.work": PubSubNATSWork,
+	"mqtt.home": PubSubMQTTHome,
+}
+
+// PubSubCfg is the broker when neither GOHOME_HOME nor GOHOME_PUBSUB selects a
+// profile, the "transport" entry decides which client is used
 var PubSubCfg = PubSubMQTTHome
 
+// PubSubKey protects the payloads on the topics that start with a prefix,
+// Encrypt is an AES key (16, 24 or 32 bytes) and Sign a HMAC-SHA256 key, both
+// hex encoded. An empty key disables encryption or signing.
+type PubSubKey struct {
+	Encrypt string
+	Sign    string
+}
+
+// PubSubKeys are the keys per topic prefix, the longest matching prefix is used
+var PubSubKeys = map[string]PubSubKey{
+	// "state/sensor/conbee/": {Sign: "8b1f0c4e..."},
+	// "state/presence/":      {Encrypt: "5d6e2a90...", Sign: "c03f7b12..."},
+	// "config/rollback/":     {Sign: "e71a4d09..."},
+}
+
 var InfluxSecretsHome = map[string]string{
 	"host":     "http://10.0.0.22:8086",
 	"username": "influxdb",
@@ -2,6 +2,7 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"time"
 )
 
@@ -45,6 +46,14 @@ func SensorStateFromJSON(data []byte) (*SensorState, error) {
 	return s, err
 }
 
+// Validate checks that the SensorState identifies its sensor
+func (s *SensorState) Validate() error {
+	if s.Name == "" {
+		return errors.New("sensor state without a name")
+	}
+	return nil
+}
+
 // FromJSON converts a json string to a SensorState instance
 func (s *SensorState) FromJSON(data []byte) error {
 	c := SensorState{}
@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 )
 
+func init() {
+	Register(Type{Name: "shout", File: "shout.config.json", Channel: "config/shout/", New: func() Config { return &ShoutConfig{} }})
+}
+
 type ShoutConfig struct {
 	UserToken CryptString `json:"usertoken"`
 	AppToken  CryptString `json:"apptoken"`
@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 )
 
+func init() {
+	Register(Type{Name: "suncalc", File: "suncalc.config.json", Channel: "config/suncalc/", New: func() Config { return &SuncalcConfig{} }})
+}
+
 func SuncalcConfigFromJSON(data []byte) (*SuncalcConfig, error) {
 	r := &SuncalcConfig{}
 	err := json.Unmarshal(data, r)
@@ -35,8 +39,8 @@ type CAngles struct {
 }
 
 type Geo struct {
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude" schema:"required,minimum=-90,maximum=90"`
+	Longitude float64 `json:"longitude" schema:"required,minimum=-180,maximum=180"`
 }
 
 type CMoment struct {
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"encoding/json"
+)
+
+func init() {
+	Register(Type{Name: "topic-bridge", File: "topic.bridge.config.json", Channel: "config/topic-bridge/", New: func() Config { return &TopicBridgeConfig{} }})
+}
+
+// TopicBridgeConfig holds the rules that republish the messages of legacy
+// topics (e.g. 'state/sensor/aqi/') under the topic naming convention.
+type TopicBridgeConfig struct {
+	Rules []TopicRule `json:"rules"`
+}
+
+// TopicRule maps the messages on Legacy (a topic filter) on a topic, when
+// Sensor is set only a SensorState with that name matches. An empty Category
+// or Device is taken from the attribute name or sensor name. Field is the
+// name under which a payload that is not a SensorState is republished.
+type TopicRule struct {
+	Legacy     string `json:"legacy" schema:"required"`
+	Sensor     string `json:"sensor,omitempty"`
+	DeviceType string `json:"device_type"`
+	Location   string `json:"location"`
+	Room       string `json:"room"`
+	Zone       string `json:"zone"`
+	Category   string `json:"category,omitempty"`
+	Device     string `json:"device,omitempty"`
+	Field      string `json:"field,omitempty"`
+}
+
+// TopicBridgeConfigFromJSON converts a json string to a TopicBridgeConfig instance
+func TopicBridgeConfigFromJSON(data []byte) (*TopicBridgeConfig, error) {
+	config := &TopicBridgeConfig{}
+	err := json.Unmarshal(data, config)
+	return config, err
+}
+
+// FromJSON converts a json string to a TopicBridgeConfig instance
+func (c *TopicBridgeConfig) FromJSON(data []byte) error {
+	config := TopicBridgeConfig{}
+	err := json.Unmarshal(data, &config)
+	*c = config
+	return err
+}
+
+// ToJSON converts a TopicBridgeConfig to a JSON string
+func (c *TopicBridgeConfig) ToJSON() (data []byte, err error) {
+	data, err = json.Marshal(c)
+	return
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// VersionField is the field of a published configuration that holds its version
+const VersionField = "version"
+
+// VersionOf returns the version of a configuration, the first 12 hex digits
+// of the SHA-256 of its JSON.
+func VersionOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// WithVersion adds the version field to the JSON object of a configuration,
+// the services ignore it when they parse the configuration.
+func WithVersion(data []byte, version string) ([]byte, error) {
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("config: cannot add a version, %w", err)
+	}
+	object[VersionField], _ = json.Marshal(version)
+	return json.Marshal(object)
+}
+
+// Version returns the version of a published configuration, so that a service
+// can report which configuration it runs. It is empty when there is none.
+func Version(data []byte) string {
+	object := struct {
+		Version string `json:"version"`
+	}{}
+	json.Unmarshal(data, &object)
+	return object.Version
+}
@@ -5,6 +5,10 @@ import (
 	"time"
 )
 
+func init() {
+	Register(Type{Name: "weather", File: "weather.config.json", Channel: "config/weather/", New: func() Config { return &WeatherConfig{} }})
+}
+
 func WeatherConfigFromJSON(data []byte) (*WeatherConfig, error) {
 	r := &WeatherConfig{}
 	err := json.Unmarshal(data, r)
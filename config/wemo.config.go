@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 )
 
+func init() {
+	Register(Type{Name: "wemo", File: "wemo.config.json", Channel: "config/wemo/", New: func() Config { return &WemoConfig{} }})
+}
+
 type WemoConfig struct {
 	Name    string `json:"name"`
 	Devices []struct {
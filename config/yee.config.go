@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 )
 
+func init() {
+	Register(Type{Name: "yee", File: "yee.config.json", Channel: "config/yee/", New: func() Config { return &YeeConfig{} }})
+}
+
 const (
 	FrontdoorHallLight = "Frontdoor hall light"
 )
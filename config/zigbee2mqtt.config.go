@@ -0,0 +1,46 @@
+package config
+
+import (
+	"encoding/json"
+)
+
+func init() {
+	Register(Type{Name: "zigbee2mqtt", File: "zigbee2mqtt.config.json", Channel: "config/zigbee2mqtt/", New: func() Config { return &Zigbee2MQTTConfig{} }})
+}
+
+// Zigbee2MQTTConfig maps the devices of Zigbee2MQTT on our sensors and lights
+type Zigbee2MQTTConfig struct {
+	BaseTopic  string              `json:"base_topic"`
+	SensorsOut string              `json:"sensors.out"`
+	Commands   []string            `json:"commands"`
+	Devices    []Zigbee2MQTTDevice `json:"devices"`
+}
+
+// Zigbee2MQTTDevice maps the friendly name of a Zigbee2MQTT device on the
+// name (e.g. 'Kitchen Motion') and type of our SensorState.
+type Zigbee2MQTTDevice struct {
+	FriendlyName string `json:"friendly_name" schema:"required"`
+	Name         string `json:"name" schema:"required"`
+	Type         string `json:"type"`
+}
+
+// Zigbee2MQTTConfigFromJSON converts a json string to a Zigbee2MQTTConfig instance
+func Zigbee2MQTTConfigFromJSON(data []byte) (*Zigbee2MQTTConfig, error) {
+	config := &Zigbee2MQTTConfig{}
+	err := json.Unmarshal(data, config)
+	return config, err
+}
+
+// FromJSON converts a json string to a Zigbee2MQTTConfig instance
+func (c *Zigbee2MQTTConfig) FromJSON(data []byte) error {
+	config := Zigbee2MQTTConfig{}
+	err := json.Unmarshal(data, &config)
+	*c = config
+	return err
+}
+
+// ToJSON converts a Zigbee2MQTTConfig to a JSON string
+func (c *Zigbee2MQTTConfig) ToJSON() (data []byte, err error) {
+	data, err = json.Marshal(c)
+	return
+}
@@ -0,0 +1,151 @@
+// Package apitest is a mock ESPHome device that speaks the plaintext native
+// API, for the tests of the api package and the esphome service.
+package apitest
+
+import (
+	"bufio"
+	"net"
+	"sync"
+
+	"github.com/jurgen-kluft/go-home/esphome/api"
+)
+
+// Device is a mock device with a fixed set of entities
+type Device struct {
+	Name     string
+	Password string
+	Entities []api.Entity
+	// Commands receives the switch and light commands sent to the device
+	Commands chan api.Command
+
+	listener net.Listener
+	states   map[uint32]api.State
+	conns    map[net.Conn]bool
+	lock     sync.Mutex
+}
+
+// NewDevice starts a device that listens on a free port of localhost
+func NewDevice(name string, password string, entities ...api.Entity) (*Device, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	d := &Device{
+		Name:     name,
+		Password: password,
+		Entities: entities,
+		Commands: make(chan api.Command, 16),
+		listener: listener,
+		states:   map[uint32]api.State{},
+		conns:    map[net.Conn]bool{},
+	}
+	go d.accept()
+	return d, nil
+}
+
+// Addr returns the address of the device
+func (d *Device) Addr() string {
+	return d.listener.Addr().String()
+}
+
+// SetState changes the state of an entity and sends it to the subscribed clients
+func (d *Device) SetState(state api.State) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.states[state.Entity.Key] = state
+	kind, data := state.Marshal()
+	for conn, subscribed := range d.conns {
+		if subscribed {
+			conn.Write(api.EncodeFrame(kind, data))
+		}
+	}
+}
+
+// Disconnect closes the connections of the clients, as a device that restarts
+func (d *Device) Disconnect() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for conn := range d.conns {
+		conn.Close()
+		delete(d.conns, conn)
+	}
+}
+
+// Close stops the device
+func (d *Device) Close() {
+	d.listener.Close()
+	d.Disconnect()
+}
+
+func (d *Device) accept() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		d.lock.Lock()
+		d.conns[conn] = false
+		d.lock.Unlock()
+		go d.serve(conn)
+	}
+}
+
+func (d *Device) write(conn net.Conn, kind uint32, data []byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	conn.Write(api.EncodeFrame(kind, data))
+}
+
+func (d *Device) serve(conn net.Conn) {
+	defer func() {
+		d.lock.Lock()
+		delete(d.conns, conn)
+		d.lock.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := api.ReadFrame(r)
+		if err != nil {
+			return
+		}
+		switch frame.Type {
+		case api.HelloRequestType:
+			hello := &api.HelloResponse{APIVersionMajor: api.APIVersionMajor, APIVersionMinor: api.APIVersionMinor, ServerInfo: "apitest", Name: d.Name}
+			d.write(conn, api.HelloResponseType, hello.Marshal())
+		case api.ConnectRequestType:
+			request := &api.ConnectRequest{}
+			request.Unmarshal(frame.Data)
+			response := &api.ConnectResponse{InvalidPassword: request.Password != d.Password}
+			d.write(conn, api.ConnectResponseType, response.Marshal())
+			if response.InvalidPassword {
+				return
+			}
+		case api.ListEntitiesRequestType:
+			for _, entity := range d.Entities {
+				kind, data := entity.Marshal()
+				d.write(conn, kind, data)
+			}
+			d.write(conn, api.ListEntitiesDoneType, nil)
+		case api.SubscribeStatesRequestType:
+			d.lock.Lock()
+			d.conns[conn] = true
+			for _, state := range d.states {
+				kind, data := state.Marshal()
+				conn.Write(api.EncodeFrame(kind, data))
+			}
+			d.lock.Unlock()
+		case api.SwitchCommandRequestType, api.LightCommandRequestType:
+			command := api.Command{}
+			if command.Unmarshal(frame.Type, frame.Data) == nil {
+				d.Commands <- command
+			}
+		case api.PingRequestType:
+			d.write(conn, api.PingResponseType, nil)
+		case api.DisconnectRequestType:
+			d.write(conn, api.DisconnectResponseType, nil)
+			return
+		}
+	}
+}
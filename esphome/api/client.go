@@ -0,0 +1,205 @@
+// Package api is a client of the native API of ESPHome devices, the plaintext
+// protocol of protobuf messages over TCP (port 6053). Devices that use the
+// noise encryption are not supported.
+package api
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrInvalidPassword is returned when the device refuses the API password
+var ErrInvalidPassword = errors.New("esphome: invalid password")
+
+// ErrDisconnected is returned by Subscribe when the device ends the connection
+var ErrDisconnected = errors.New("esphome: device disconnected")
+
+// Client is a connection to a device
+type Client struct {
+	// Name is the name of the device, from its HelloResponse
+	Name string
+	// Entities are the entities of the device by key
+	Entities map[uint32]Entity
+	// Keepalive is the interval of the pings to the device, the connection is
+	// considered lost when nothing is received for three intervals.
+	Keepalive time.Duration
+
+	conn net.Conn
+	r    *bufio.Reader
+	lock sync.Mutex
+}
+
+// Dial connects to the device at 'address' (host:port), see NewClient
+func Dial(address string, password string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn, password, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient says hello to the device, logs in with 'password' and lists its
+// entities, each step has to finish within 'timeout'.
+func NewClient(conn net.Conn, password string, timeout time.Duration) (*Client, error) {
+	c := &Client{Entities: map[uint32]Entity{}, Keepalive: 20 * time.Second, conn: conn, r: bufio.NewReader(conn)}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := &HelloRequest{ClientInfo: "go-home", APIVersionMajor: APIVersionMajor, APIVersionMinor: APIVersionMinor}
+	frame, err := c.exchange(HelloRequestType, hello.Marshal(), HelloResponseType)
+	if err != nil {
+		return nil, err
+	}
+	response := &HelloResponse{}
+	if err := response.Unmarshal(frame.Data); err != nil {
+		return nil, err
+	}
+	if response.APIVersionMajor != APIVersionMajor {
+		return nil, fmt.Errorf("esphome: unsupported API version %d.%d", response.APIVersionMajor, response.APIVersionMinor)
+	}
+	c.Name = response.Name
+
+	connect := &ConnectRequest{Password: password}
+	if frame, err = c.exchange(ConnectRequestType, connect.Marshal(), ConnectResponseType); err != nil {
+		return nil, err
+	}
+	connected := &ConnectResponse{}
+	if err := connected.Unmarshal(frame.Data); err != nil {
+		return nil, err
+	}
+	if connected.InvalidPassword {
+		return nil, ErrInvalidPassword
+	}
+
+	if err := c.send(ListEntitiesRequestType, nil); err != nil {
+		return nil, err
+	}
+	for {
+		frame, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if frame.Type == ListEntitiesDoneType {
+			return c, nil
+		}
+		if _, supported := listTypes[frame.Type]; !supported {
+			continue
+		}
+		entity := Entity{}
+		if err := entity.Unmarshal(frame.Type, frame.Data); err != nil {
+			return nil, err
+		}
+		c.Entities[entity.Key] = entity
+	}
+}
+
+// Subscribe asks the device for the state updates of its entities and calls
+// 'handler' for every update until the connection is lost or closed.
+func (c *Client) Subscribe(handler func(state State)) error {
+	if err := c.send(SubscribeStatesRequestType, nil); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(c.Keepalive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.send(PingRequestType, nil)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(3 * c.Keepalive))
+		frame, err := c.read()
+		if err != nil {
+			return err
+		}
+		if _, isState := stateTypes[frame.Type]; !isState {
+			continue
+		}
+		state := State{}
+		if err := state.Unmarshal(frame.Type, frame.Data); err != nil {
+			return err
+		}
+		if entity, exists := c.Entities[state.Entity.Key]; exists {
+			state.Entity = entity
+			handler(state)
+		}
+	}
+}
+
+// Send sends a command to a switch or light
+func (c *Client) Send(command Command) error {
+	kind, data := command.Marshal()
+	return c.send(kind, data)
+}
+
+// Close says goodbye to the device and closes the connection
+func (c *Client) Close() error {
+	c.send(DisconnectRequestType, nil)
+	return c.conn.Close()
+}
+
+func (c *Client) send(kind uint32, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, err := c.conn.Write(EncodeFrame(kind, data))
+	return err
+}
+
+// exchange sends a request and waits for the response of type 'expect'
+func (c *Client) exchange(kind uint32, data []byte, expect uint32) (Frame, error) {
+	if err := c.send(kind, data); err != nil {
+		return Frame{}, err
+	}
+	for {
+		frame, err := c.read()
+		if err != nil {
+			return frame, err
+		}
+		if frame.Type == expect {
+			return frame, nil
+		}
+	}
+}
+
+// read returns the next frame, the requests of the device itself are answered
+func (c *Client) read() (Frame, error) {
+	for {
+		frame, err := ReadFrame(c.r)
+		if err != nil {
+			return frame, err
+		}
+		switch frame.Type {
+		case PingRequestType:
+			err = c.send(PingResponseType, nil)
+		case GetTimeRequestType:
+			err = c.send(GetTimeResponseType, newGetTimeResponse(time.Now()).Marshal())
+		case DisconnectRequestType:
+			c.send(DisconnectResponseType, nil)
+			return frame, ErrDisconnected
+		default:
+			return frame, nil
+		}
+		if err != nil {
+			return frame, err
+		}
+	}
+}
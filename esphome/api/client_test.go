@@ -0,0 +1,96 @@
+package api_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/esphome/api"
+	"github.com/jurgen-kluft/go-home/esphome/api/apitest"
+)
+
+var (
+	presence    = api.Entity{Kind: api.BinarySensor, Key: 1, ObjectID: "bed_presence", Name: "Bed Presence"}
+	temperature = api.Entity{Kind: api.Sensor, Key: 2, ObjectID: "temperature", Name: "Temperature", Unit: "°C"}
+	relay       = api.Entity{Kind: api.Switch, Key: 3, ObjectID: "relay", Name: "Relay"}
+)
+
+func TestClientReceivesStatesAndSendsCommands(t *testing.T) {
+	device, err := apitest.NewDevice("bedroom", "secret", presence, temperature, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	device.SetState(api.State{Entity: temperature, Float: 21.5})
+
+	c, err := api.Dial(device.Addr(), "secret", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Name != "bedroom" || len(c.Entities) != 3 || c.Entities[2].Unit != "°C" {
+		t.Fatalf("unexpected device %s with entities %v", c.Name, c.Entities)
+	}
+
+	states := make(chan api.State, 4)
+	go c.Subscribe(func(state api.State) { states <- state })
+
+	next := func() api.State {
+		select {
+		case state := <-states:
+			return state
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected a state update")
+		}
+		return api.State{}
+	}
+	if state := next(); state.Entity.ObjectID != "temperature" || state.Float != 21.5 {
+		t.Errorf("unexpected state %+v", state)
+	}
+	device.SetState(api.State{Entity: presence, Bool: true})
+	if state := next(); state.Entity.ObjectID != "bed_presence" || !state.Bool {
+		t.Errorf("unexpected state %+v", state)
+	}
+
+	if err := c.Send(api.Command{Kind: api.Switch, Key: 3, State: true}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case command := <-device.Commands:
+		if command.Kind != api.Switch || command.Key != 3 || !command.State {
+			t.Errorf("unexpected command %+v", command)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the device to receive the command")
+	}
+}
+
+func TestClientInvalidPassword(t *testing.T) {
+	device, err := apitest.NewDevice("bedroom", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	if _, err := api.Dial(device.Addr(), "wrong", time.Second); !errors.Is(err, api.ErrInvalidPassword) {
+		t.Errorf("expected an invalid password, got %v", err)
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	light := api.Command{Kind: api.Light, Key: 0xdeadbeef, State: true}
+	kind, data := light.Marshal()
+	frame, err := api.ReadFrame(bufio.NewReader(bytes.NewReader(api.EncodeFrame(kind, data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := api.Command{}
+	if err := decoded.Unmarshal(frame.Type, frame.Data); err != nil || decoded != light {
+		t.Errorf("expected %+v, got %+v (%v)", light, decoded, err)
+	}
+
+	if _, err := api.ReadFrame(bufio.NewReader(bytes.NewReader([]byte{1, 0, 0}))); err == nil {
+		t.Error("expected an error for an encrypted frame")
+	}
+}
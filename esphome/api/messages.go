@@ -0,0 +1,334 @@
+package api
+
+import "time"
+
+// The message types of the native API, see api.proto of ESPHome
+const (
+	HelloRequestType           = 1
+	HelloResponseType          = 2
+	ConnectRequestType         = 3
+	ConnectResponseType        = 4
+	DisconnectRequestType      = 5
+	DisconnectResponseType     = 6
+	PingRequestType            = 7
+	PingResponseType           = 8
+	ListEntitiesRequestType    = 11
+	ListBinarySensorType       = 12
+	ListCoverType              = 13
+	ListFanType                = 14
+	ListLightType              = 15
+	ListSensorType             = 16
+	ListSwitchType             = 17
+	ListTextSensorType         = 18
+	ListEntitiesDoneType       = 19
+	SubscribeStatesRequestType = 20
+	BinarySensorStateType      = 21
+	LightStateType             = 24
+	SensorStateType            = 25
+	SwitchStateType            = 26
+	TextSensorStateType        = 27
+	LightCommandRequestType    = 32
+	SwitchCommandRequestType   = 33
+	GetTimeRequestType         = 36
+	GetTimeResponseType        = 37
+)
+
+// The version of the native API that the client implements
+const (
+	APIVersionMajor uint32 = 1
+	APIVersionMinor uint32 = 9
+)
+
+// The kinds of entity that are supported
+const (
+	BinarySensor = "binary_sensor"
+	Sensor       = "sensor"
+	TextSensor   = "text_sensor"
+	Switch       = "switch"
+	Light        = "light"
+)
+
+var listTypes = map[uint32]string{
+	ListBinarySensorType: BinarySensor,
+	ListSensorType:       Sensor,
+	ListTextSensorType:   TextSensor,
+	ListSwitchType:       Switch,
+	ListLightType:        Light,
+}
+
+var stateTypes = map[uint32]string{
+	BinarySensorStateType: BinarySensor,
+	SensorStateType:       Sensor,
+	TextSensorStateType:   TextSensor,
+	SwitchStateType:       Switch,
+	LightStateType:        Light,
+}
+
+// HelloRequest is the first message of a client
+type HelloRequest struct {
+	ClientInfo      string
+	APIVersionMajor uint32
+	APIVersionMinor uint32
+}
+
+// Marshal encodes the message
+func (m *HelloRequest) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, m.ClientInfo)
+	e.uint32(2, m.APIVersionMajor)
+	e.uint32(3, m.APIVersionMinor)
+	return e.data
+}
+
+// Unmarshal decodes the message
+func (m *HelloRequest) Unmarshal(data []byte) error {
+	return decode(data, func(f field) {
+		switch f.number {
+		case 1:
+			m.ClientInfo = f.string()
+		case 2:
+			m.APIVersionMajor = f.uint32()
+		case 3:
+			m.APIVersionMinor = f.uint32()
+		}
+	})
+}
+
+// HelloResponse is the answer of a device to the HelloRequest
+type HelloResponse struct {
+	APIVersionMajor uint32
+	APIVersionMinor uint32
+	ServerInfo      string
+	Name            string
+}
+
+// Marshal encodes the message
+func (m *HelloResponse) Marshal() []byte {
+	e := &encoder{}
+	e.uint32(1, m.APIVersionMajor)
+	e.uint32(2, m.APIVersionMinor)
+	e.string(3, m.ServerInfo)
+	e.string(4, m.Name)
+	return e.data
+}
+
+// Unmarshal decodes the message
+func (m *HelloResponse) Unmarshal(data []byte) error {
+	return decode(data, func(f field) {
+		switch f.number {
+		case 1:
+			m.APIVersionMajor = f.uint32()
+		case 2:
+			m.APIVersionMinor = f.uint32()
+		case 3:
+			m.ServerInfo = f.string()
+		case 4:
+			m.Name = f.string()
+		}
+	})
+}
+
+// ConnectRequest authenticates the client with the API password of the device
+type ConnectRequest struct {
+	Password string
+}
+
+// Marshal encodes the message
+func (m *ConnectRequest) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, m.Password)
+	return e.data
+}
+
+// Unmarshal decodes the message
+func (m *ConnectRequest) Unmarshal(data []byte) error {
+	return decode(data, func(f field) {
+		if f.number == 1 {
+			m.Password = f.string()
+		}
+	})
+}
+
+// ConnectResponse is the answer of a device to the ConnectRequest
+type ConnectResponse struct {
+	InvalidPassword bool
+}
+
+// Marshal encodes the message
+func (m *ConnectResponse) Marshal() []byte {
+	e := &encoder{}
+	e.bool(1, m.InvalidPassword)
+	return e.data
+}
+
+// Unmarshal decodes the message
+func (m *ConnectResponse) Unmarshal(data []byte) error {
+	return decode(data, func(f field) {
+		if f.number == 1 {
+			m.InvalidPassword = f.bool()
+		}
+	})
+}
+
+// Entity is an entity of a device, e.g. a sensor or a switch. The key
+// identifies the entity in the state and command messages.
+type Entity struct {
+	Kind     string
+	Key      uint32
+	ObjectID string
+	Name     string
+	UniqueID string
+	Unit     string
+}
+
+// Marshal encodes the entity as the ListEntities response of its kind
+func (m *Entity) Marshal() (uint32, []byte) {
+	e := &encoder{}
+	e.string(1, m.ObjectID)
+	e.fixed32(2, m.Key)
+	e.string(3, m.Name)
+	e.string(4, m.UniqueID)
+	if m.Kind == Sensor {
+		e.string(6, m.Unit)
+	}
+	for kind, name := range listTypes {
+		if name == m.Kind {
+			return kind, e.data
+		}
+	}
+	return 0, nil
+}
+
+// Unmarshal decodes a ListEntities response, every kind starts with the
+// object id, key, name and unique id.
+func (m *Entity) Unmarshal(kind uint32, data []byte) error {
+	m.Kind = listTypes[kind]
+	return decode(data, func(f field) {
+		switch f.number {
+		case 1:
+			m.ObjectID = f.string()
+		case 2:
+			m.Key = f.uint32()
+		case 3:
+			m.Name = f.string()
+		case 4:
+			m.UniqueID = f.string()
+		case 6:
+			if m.Kind == Sensor {
+				m.Unit = f.string()
+			}
+		}
+	})
+}
+
+// State is a state update of an entity, which of Bool, Float and Text holds
+// the state depends on the kind of the entity. Missing is set when a sensor
+// has no state yet.
+type State struct {
+	Entity  Entity
+	Bool    bool
+	Float   float32
+	Text    string
+	Missing bool
+}
+
+// Marshal encodes the state as the state response of the kind of its entity
+func (m *State) Marshal() (uint32, []byte) {
+	e := &encoder{}
+	e.fixed32(1, m.Entity.Key)
+	switch m.Entity.Kind {
+	case BinarySensor, Switch, Light:
+		e.bool(2, m.Bool)
+	case Sensor:
+		e.float(2, m.Float)
+	case TextSensor:
+		e.string(2, m.Text)
+	}
+	if m.Entity.Kind != Switch && m.Entity.Kind != Light {
+		e.bool(3, m.Missing)
+	}
+	for kind, name := range stateTypes {
+		if name == m.Entity.Kind {
+			return kind, e.data
+		}
+	}
+	return 0, nil
+}
+
+// Unmarshal decodes a state response, the entity only holds its key and kind
+func (m *State) Unmarshal(kind uint32, data []byte) error {
+	m.Entity.Kind = stateTypes[kind]
+	return decode(data, func(f field) {
+		switch f.number {
+		case 1:
+			m.Entity.Key = f.uint32()
+		case 2:
+			switch m.Entity.Kind {
+			case BinarySensor, Switch, Light:
+				m.Bool = f.bool()
+			case Sensor:
+				m.Float = f.float()
+			case TextSensor:
+				m.Text = f.string()
+			}
+		case 3:
+			if m.Entity.Kind != Switch && m.Entity.Kind != Light {
+				m.Missing = f.bool()
+			}
+		}
+	})
+}
+
+// Command turns a switch or light on or off
+type Command struct {
+	Kind  string
+	Key   uint32
+	State bool
+}
+
+// Marshal encodes the command as a SwitchCommandRequest or LightCommandRequest
+func (m *Command) Marshal() (uint32, []byte) {
+	e := &encoder{}
+	e.fixed32(1, m.Key)
+	if m.Kind == Light {
+		e.bool(2, true)
+		e.bool(3, m.State)
+		return LightCommandRequestType, e.data
+	}
+	e.bool(2, m.State)
+	return SwitchCommandRequestType, e.data
+}
+
+// Unmarshal decodes a SwitchCommandRequest or LightCommandRequest
+func (m *Command) Unmarshal(kind uint32, data []byte) error {
+	m.Kind = Switch
+	stateField := 2
+	if kind == LightCommandRequestType {
+		m.Kind = Light
+		stateField = 3
+	}
+	return decode(data, func(f field) {
+		switch f.number {
+		case 1:
+			m.Key = f.uint32()
+		case stateField:
+			m.State = f.bool()
+		}
+	})
+}
+
+// GetTimeResponse answers the request of a device for the current time
+type GetTimeResponse struct {
+	EpochSeconds uint32
+}
+
+// Marshal encodes the message
+func (m *GetTimeResponse) Marshal() []byte {
+	e := &encoder{}
+	e.fixed32(1, m.EpochSeconds)
+	return e.data
+}
+
+func newGetTimeResponse(now time.Time) *GetTimeResponse {
+	return &GetTimeResponse{EpochSeconds: uint32(now.Unix())}
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// The protobuf wire types used by the messages of the native API
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// ErrMalformed is returned for a frame or message that cannot be decoded
+var ErrMalformed = errors.New("esphome: malformed message")
+
+// The largest frame that is accepted, the messages of a device are small
+const maxFrame = 1 << 20
+
+// Frame is a message of the plaintext protocol, a zero byte followed by the
+// varint length of the message, the varint message type and the message.
+type Frame struct {
+	Type uint32
+	Data []byte
+}
+
+// ReadFrame reads a plaintext frame
+func ReadFrame(r *bufio.Reader) (Frame, error) {
+	preamble, err := r.ReadByte()
+	if err != nil {
+		return Frame{}, err
+	}
+	if preamble != 0 {
+		return Frame{}, fmt.Errorf("esphome: unexpected preamble 0x%02x, is the noise encryption enabled?", preamble)
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return Frame{}, err
+	}
+	kind, err := binary.ReadUvarint(r)
+	if err != nil {
+		return Frame{}, err
+	}
+	if length > maxFrame {
+		return Frame{}, ErrMalformed
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Frame{}, err
+	}
+	return Frame{Type: uint32(kind), Data: data}, nil
+}
+
+// EncodeFrame returns a message as a plaintext frame
+func EncodeFrame(kind uint32, data []byte) []byte {
+	frame := []byte{0}
+	frame = binary.AppendUvarint(frame, uint64(len(data)))
+	frame = binary.AppendUvarint(frame, uint64(kind))
+	return append(frame, data...)
+}
+
+// encoder appends the fields of a protobuf message
+type encoder struct {
+	data []byte
+}
+
+func (e *encoder) tag(field int, wire int) {
+	e.data = binary.AppendUvarint(e.data, uint64(field<<3|wire))
+}
+
+func (e *encoder) uint32(field int, v uint32) {
+	if v != 0 {
+		e.tag(field, wireVarint)
+		e.data = binary.AppendUvarint(e.data, uint64(v))
+	}
+}
+
+func (e *encoder) bool(field int, v bool) {
+	if v {
+		e.tag(field, wireVarint)
+		e.data = append(e.data, 1)
+	}
+}
+
+func (e *encoder) fixed32(field int, v uint32) {
+	if v != 0 {
+		e.tag(field, wireFixed32)
+		e.data = binary.LittleEndian.AppendUint32(e.data, v)
+	}
+}
+
+func (e *encoder) float(field int, v float32) {
+	if v != 0 {
+		e.fixed32(field, math.Float32bits(v))
+	}
+}
+
+func (e *encoder) string(field int, v string) {
+	if v != "" {
+		e.tag(field, wireBytes)
+		e.data = binary.AppendUvarint(e.data, uint64(len(v)))
+		e.data = append(e.data, v...)
+	}
+}
+
+// field is a decoded field, 'value' holds a varint or fixed value and 'bytes'
+// a length delimited value.
+type field struct {
+	number int
+	value  uint64
+	bytes  []byte
+}
+
+func (f field) uint32() uint32 { return uint32(f.value) }
+
+func (f field) bool() bool { return f.value != 0 }
+
+func (f field) float() float32 { return math.Float32frombits(uint32(f.value)) }
+
+func (f field) string() string { return string(f.bytes) }
+
+// decode calls 'fn' for every field of a protobuf message, unknown fields are
+// skipped so that newer firmware remains readable.
+func decode(data []byte, fn func(f field)) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrMalformed
+		}
+		data = data[n:]
+		f := field{number: int(key >> 3)}
+		switch key & 7 {
+		case wireVarint:
+			f.value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return ErrMalformed
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return ErrMalformed
+			}
+			f.value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return ErrMalformed
+			}
+			f.bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case wireFixed32:
+			if len(data) < 4 {
+				return ErrMalformed
+			}
+			f.value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return ErrMalformed
+		}
+		fn(f)
+	}
+	return nil
+}
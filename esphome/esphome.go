@@ -0,0 +1,258 @@
+package main
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+	"github.com/jurgen-kluft/go-home/esphome/api"
+	microservice "github.com/jurgen-kluft/go-home/micro-service"
+)
+
+// The state updates of the devices are handed to the loop of the service on
+// this topic, it is not a channel of the broker.
+const updateTopic = "esphome/update/"
+
+// update is a state update of an entity of a device
+type update struct {
+	Device string    `json:"device"`
+	State  api.State `json:"state"`
+}
+
+// device is the connection to an ESPHome device, it reconnects until it is
+// stopped.
+type device struct {
+	config config.EsphomeDevice
+	client *api.Client
+	lock   sync.Mutex
+	quit   chan struct{}
+}
+
+func (d *device) connected() *api.Client {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.client
+}
+
+func (d *device) run(m *microservice.Service, timeout time.Duration) {
+	backoff := microservice.NewBackoff()
+	for {
+		client, err := api.Dial(d.config.Address, d.config.Password, timeout)
+		if err == nil {
+			// The device may have been stopped while dialing
+			d.lock.Lock()
+			select {
+			case <-d.quit:
+				d.lock.Unlock()
+				client.Close()
+				return
+			default:
+			}
+			d.client = client
+			d.lock.Unlock()
+			backoff.Reset()
+			m.Logger.LogInfo(m.Name, fmt.Sprintf("connected to %s (%s)", d.config.Name, d.config.Address))
+			err = client.Subscribe(func(state api.State) {
+				data, _ := json.Marshal(&update{Device: d.config.Name, State: state})
+				m.ProcessMessages <- &microservice.Message{Topic: updateTopic, Payload: data}
+			})
+			d.lock.Lock()
+			d.client = nil
+			d.lock.Unlock()
+			client.Close()
+		}
+		select {
+		case <-d.quit:
+			return
+		default:
+		}
+		m.Logger.LogError(m.Name, fmt.Sprintf("connection to %s: %s", d.config.Name, err.Error()))
+		select {
+		case <-d.quit:
+			return
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+func (d *device) stop() {
+	d.lock.Lock()
+	close(d.quit)
+	client := d.client
+	d.lock.Unlock()
+	if client != nil {
+		client.Close()
+	}
+}
+
+type context struct {
+	service  *microservice.Service
+	config   *config.EsphomeConfig
+	devices  map[string]*device
+	states   map[string]bool
+	channels map[string]bool
+	timeout  time.Duration
+}
+
+// configure replaces the connections to the devices
+func (c *context) configure(m *microservice.Service, cfg *config.EsphomeConfig) {
+	for _, d := range c.devices {
+		d.stop()
+	}
+	c.config = cfg
+	c.devices = map[string]*device{}
+	for _, dc := range cfg.Devices {
+		d := &device{config: dc, quit: make(chan struct{})}
+		c.devices[dc.Name] = d
+		go d.run(m, c.timeout)
+	}
+	if !c.channels[cfg.SensorsOut] {
+		c.channels[cfg.SensorsOut] = true
+		m.Register(cfg.SensorsOut)
+	}
+	for _, channel := range cfg.Commands {
+		if !c.channels[channel] {
+			c.channels[channel] = true
+			m.Subscribe(channel)
+			microservice.RegisterTypedHandler(m, channel, c.handleCommand)
+		}
+	}
+}
+
+// sensorState converts a state update into a SensorState, it returns nil for
+// an entity that is not configured or a sensor without a state.
+func (c *context) sensorState(u *update) *config.SensorState {
+	d, exists := c.devices[u.Device]
+	if !exists || u.State.Missing {
+		return nil
+	}
+	attr := u.State.Entity.ObjectID
+	if len(d.config.Entities) > 0 {
+		if attr, exists = d.config.Entities[u.State.Entity.ObjectID]; !exists {
+			return nil
+		}
+	}
+
+	state := config.NewSensorState(d.config.Name, d.config.Type)
+	state.Time = c.service.Now()
+	switch u.State.Entity.Kind {
+	case api.BinarySensor, api.Switch, api.Light:
+		state.AddBoolAttr(attr, u.State.Bool)
+	case api.Sensor:
+		state.AddFloatAttr(attr, float64(u.State.Float))
+	case api.TextSensor:
+		state.AddStringAttr(attr, u.State.Text)
+	default:
+		return nil
+	}
+	return state
+}
+
+func (c *context) handleUpdate(m *microservice.Service, topic string, msg []byte) bool {
+	u := &update{}
+	if err := json.Unmarshal(msg, u); err != nil || c.config == nil {
+		return true
+	}
+	c.states[u.Device+"/"+u.State.Entity.ObjectID] = u.State.Bool
+	state := c.sensorState(u)
+	if state == nil {
+		return true
+	}
+	data, err := state.ToJSON()
+	if err == nil {
+		err = m.Pubsub.Publish(c.config.SensorsOut, data)
+	}
+	if err != nil {
+		m.Logger.LogError(m.Name, err.Error())
+	}
+	return true
+}
+
+// handleCommand turns a switch or light of a device on or off, e.g.
+// {"name": "Living Room Stand", "stringattrs": [{"name": "power", "value": "on"}]}
+func (c *context) handleCommand(m *microservice.Service, topic string, state *config.SensorState) bool {
+	for _, d := range c.devices {
+		objectID, exists := d.config.Controls[state.Name]
+		if !exists {
+			continue
+		}
+		client := d.connected()
+		if client == nil {
+			m.Logger.LogError(m.Name, fmt.Sprintf("cannot control %s, %s is not connected", state.Name, d.config.Name))
+			return true
+		}
+		for _, entity := range client.Entities {
+			if entity.ObjectID != objectID || (entity.Kind != api.Switch && entity.Kind != api.Light) {
+				continue
+			}
+			command := api.Command{Kind: entity.Kind, Key: entity.Key}
+			switch strings.ToLower(state.GetValueAttr("power", "")) {
+			case "on":
+				command.State = true
+			case "off":
+				command.State = false
+			case "toggle":
+				command.State = !c.states[d.config.Name+"/"+objectID]
+			default:
+				m.Logger.LogError(m.Name, fmt.Sprintf("unknown command for %s", state.Name))
+				return true
+			}
+			if err := client.Send(command); err != nil {
+				m.Logger.LogError(m.Name, err.Error())
+			}
+			return true
+		}
+		m.Logger.LogError(m.Name, fmt.Sprintf("%s has no switch or light %s", d.config.Name, objectID))
+		return true
+	}
+	return true
+}
+
+func setup(m *microservice.Service) *context {
+	register := []string{"config/request/"}
+	subscribe := []string{"config/esphome/"}
+	m.RegisterAndSubscribe(register, subscribe)
+
+	c := &context{service: m, devices: map[string]*device{}, states: map[string]bool{}, channels: map[string]bool{}, timeout: 10 * time.Second}
+
+	m.OnShutdown(func(m *microservice.Service) {
+		for _, d := range c.devices {
+			d.stop()
+		}
+	})
+
+	m.SetReady("config", false)
+	m.RegisterHandler("config/esphome/", func(m *microservice.Service, topic string, msg []byte) bool {
+		cfg, err := config.EsphomeConfigFromJSON(msg)
+		if err != nil {
+			m.Logger.LogError(m.Name, err.Error())
+			return true
+		}
+		m.Logger.LogInfo(m.Name, "received configuration")
+		c.configure(m, cfg)
+		m.SetReady("config", true)
+		m.SetConfigVersion(config.Version(msg))
+		return true
+	})
+	m.RegisterHandler(updateTopic, c.handleUpdate)
+
+	m.Every(30*time.Second, func(m *microservice.Service) bool {
+		if c.config == nil {
+			m.Logger.LogInfo(m.Name, "requesting configuration")
+			m.Pubsub.PublishStr("config/request/", m.Name)
+		}
+		return true
+	}, microservice.Immediately())
+
+	return c
+}
+
+func main() {
+	m := microservice.New("esphome", time.Second)
+	setup(m)
+	m.Loop(gocontext.Background())
+}
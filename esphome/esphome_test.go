@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+	"github.com/jurgen-kluft/go-home/esphome/api"
+	"github.com/jurgen-kluft/go-home/esphome/api/apitest"
+	microservice "github.com/jurgen-kluft/go-home/micro-service"
+)
+
+var (
+	occupancy = api.Entity{Kind: api.BinarySensor, Key: 1, ObjectID: "occupancy", Name: "Occupancy"}
+	co2       = api.Entity{Kind: api.Sensor, Key: 2, ObjectID: "co2", Name: "CO2", Unit: "ppm"}
+	uptime    = api.Entity{Kind: api.Sensor, Key: 3, ObjectID: "uptime", Name: "Uptime", Unit: "s"}
+	relay     = api.Entity{Kind: api.Switch, Key: 4, ObjectID: "relay", Name: "Relay"}
+)
+
+// waitFor drains the service until 'channel' has 'n' publishes, the state
+// updates arrive from the connection to the device.
+func waitFor(t *testing.T, h *microservice.Harness, channel string, n int) [][]byte {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		h.Drain()
+		if published := h.Published(channel); len(published) >= n {
+			return published
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d publishes on %s", n, channel)
+	return nil
+}
+
+func TestEsphomeStatesAndCommands(t *testing.T) {
+	device, err := apitest.NewDevice("livingroom", "", occupancy, co2, uptime, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	device.SetState(api.State{Entity: co2, Float: 612})
+
+	m := microservice.New("esphome", time.Second)
+	c := setup(m)
+	h := microservice.NewHarness(m, time.Now())
+	defer h.Shutdown()
+	h.Inject("config/esphome/", []byte(fmt.Sprintf(testEsphomeConfig, device.Addr())))
+
+	published := waitFor(t, h, "state/sensor/esphome/", 1)
+	state, err := config.SensorStateFromJSON(published[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Name != "Livingroom Air" || state.Type != "airquality" || state.GetFloatAttr("co2", 0) != 612 {
+		t.Errorf("unexpected sensor state %s", string(published[0]))
+	}
+
+	// Entities that are not configured are not published
+	device.SetState(api.State{Entity: uptime, Float: 3600})
+	device.SetState(api.State{Entity: occupancy, Bool: true})
+	published = waitFor(t, h, "state/sensor/esphome/", 2)
+	state, _ = config.SensorStateFromJSON(published[1])
+	if len(state.BoolAttrs) != 1 || state.BoolAttrs[0].Name != "motion" || !state.BoolAttrs[0].Value {
+		t.Errorf("unexpected sensor state %s", string(published[1]))
+	}
+
+	h.Inject("state/light/automation/", []byte(`{"name": "Living Room Stand", "stringattrs": [{"name": "power", "value": "toggle"}]}`))
+	select {
+	case command := <-device.Commands:
+		if command.Key != relay.Key || !command.State {
+			t.Errorf("expected the relay to be turned on, got %+v", command)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the device to receive a command")
+	}
+	if len(c.devices) != 1 {
+		t.Errorf("expected 1 device, got %d", len(c.devices))
+	}
+}
+
+func TestEsphomeStopWhileDialing(t *testing.T) {
+	livingroom, err := apitest.NewDevice("livingroom", "", co2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer livingroom.Close()
+
+	// The connection to the device only proceeds once it is released
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	m := microservice.New("esphome", time.Second)
+	d := &device{config: config.EsphomeDevice{Name: "Livingroom Air", Address: listener.Addr().String()}, quit: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		d.run(m, 2*time.Second)
+		close(done)
+	}()
+
+	conn := <-accepted
+	defer conn.Close()
+	d.stop()
+	upstream, err := net.Dial("tcp", livingroom.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go io.Copy(upstream, conn)
+	go io.Copy(conn, upstream)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a device that was stopped while dialing kept its connection")
+	}
+}
+
+var testEsphomeConfig = `
+{
+    "sensors.out": "state/sensor/esphome/",
+    "commands": [ "state/light/automation/" ],
+    "devices": [
+        {
+            "name": "Livingroom Air",
+            "type": "airquality",
+            "address": "%s",
+            "entities": { "co2": "co2", "occupancy": "motion" },
+            "controls": { "Living Room Stand": "relay" }
+        }
+    ]
+}
+`
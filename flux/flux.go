@@ -1,6 +1,7 @@
 package main
 
 import (
+	gocontext "context"
 	"fmt"
 	"math"
 	"time"
@@ -104,7 +105,7 @@ func (c *context) process() error {
 		return fmt.Errorf("no configuration or no suncalc information received")
 	}
 
-	now := time.Now()
+	now := c.service.Now()
 
 	// Update our season
 	c.updateSeasonFromName(c.seasonName)
@@ -244,23 +245,33 @@ func (c *context) publishSensor(channel string, json string) {
 	c.service.Pubsub.Publish(channel, []byte(json))
 }
 
-func main() {
-	register := []string{"config/request/", "config/flux/", "state/sensor/weather/", "state/sensor/sun/", "state/sensor/season/"}
+// setup registers the channels and handlers of flux on the service
+func setup(m *microservice.Service) *context {
+	register := []string{"config/request/", "config/flux/", "state/sensor/weather/", "state/sensor/sun/", "state/sensor/season/", "state/sensor/darkorlight/"}
 	subscribe := []string{"config/flux/", "state/sensor/weather/", "state/sensor/sun/", "state/sensor/season/"}
 
-	m := microservice.New("flux")
 	m.RegisterAndSubscribe(register, subscribe)
+	m.Use(microservice.Recover(), microservice.Timing())
 
 	c := new()
 	c.service = m
 
+	m.OnShutdown(func(m *microservice.Service) {
+		if c.metrics != nil {
+			c.metrics.Close()
+		}
+	})
+
 	tickCount := 0
 
+	m.SetReady("config", false)
 	m.RegisterHandler("config/flux/", func(m *microservice.Service, topic string, msg []byte) bool {
 		var err error
 		c.config, err = config.FluxConfigFromJSON(msg)
 		if err == nil {
 			m.Logger.LogInfo(m.Name, "received configuration")
+			m.SetReady("config", true)
+			m.SetConfigVersion(config.Version(msg))
 			for _, ltype := range c.config.Lighttype {
 				m.Register(ltype.Channel)
 				if err == nil {
@@ -276,36 +287,21 @@ func main() {
 		return true
 	})
 
-	m.RegisterHandler("state/sensor/weather/", func(m *microservice.Service, topic string, msg []byte) bool {
-		var err error
-		c.weather, err = config.SensorStateFromJSON(msg)
-		if err == nil {
-			m.Logger.LogInfo(c.name, "received weather state")
-		} else {
-			m.Logger.LogError(c.name, err.Error())
-		}
+	microservice.RegisterTypedHandler(m, "state/sensor/weather/", func(m *microservice.Service, topic string, state *config.SensorState) bool {
+		m.Logger.LogInfo(c.name, "received weather state")
+		c.weather = state
 		return true
 	})
 
-	m.RegisterHandler("state/sensor/sun/", func(m *microservice.Service, topic string, msg []byte) bool {
-		var err error
-		c.suncalc, err = config.SensorStateFromJSON(msg)
-		if err == nil {
-			m.Logger.LogInfo(c.name, "received sun state")
-		} else {
-			m.Logger.LogError(c.name, err.Error())
-		}
+	microservice.RegisterTypedHandler(m, "state/sensor/sun/", func(m *microservice.Service, topic string, state *config.SensorState) bool {
+		m.Logger.LogInfo(c.name, "received sun state")
+		c.suncalc = state
 		return true
 	})
 
-	m.RegisterHandler("state/sensor/season/", func(m *microservice.Service, topic string, msg []byte) bool {
-		seasonSensorState, err := config.SensorStateFromJSON(msg)
-		if err == nil {
-			m.Logger.LogInfo(c.name, "received season state")
-			c.seasonName = seasonSensorState.GetValueAttr("season", "winter")
-		} else {
-			m.Logger.LogError(c.name, err.Error())
-		}
+	microservice.RegisterTypedHandler(m, "state/sensor/season/", func(m *microservice.Service, topic string, state *config.SensorState) bool {
+		m.Logger.LogInfo(c.name, "received season state")
+		c.seasonName = state.GetValueAttr("season", "winter")
 		return true
 	})
 
@@ -325,5 +321,11 @@ func main() {
 		return true
 	})
 
-	m.Loop()
+	return c
+}
+
+func main() {
+	m := microservice.New("flux", time.Second)
+	setup(m)
+	m.Loop(gocontext.Background())
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+	microservice "github.com/jurgen-kluft/go-home/micro-service"
+)
+
+func TestFluxPublishesDarkOrLight(t *testing.T) {
+	m := microservice.New("flux", time.Second)
+	setup(m)
+
+	now := time.Date(2020, 6, 21, 12, 0, 0, 0, time.Local)
+	h := microservice.NewHarness(m, now)
+
+	// Without a configuration flux should ask for one
+	h.Tick(1)
+	request, ok := h.LastPublished("config/request/")
+	if !ok || string(request) != "flux" {
+		t.Fatalf("expected a configuration request, got '%s'", string(request))
+	}
+
+	h.Inject("config/flux/", []byte(testFluxConfig))
+
+	sun := config.NewSensorState("sun", "suncalc")
+	sun.AddTimeWndAttr("day", now.Add(-6*time.Hour), now.Add(6*time.Hour))
+	sunjson, _ := sun.ToJSON()
+	h.Inject("state/sensor/sun/", sunjson)
+
+	h.Tick(1)
+	payload, ok := h.LastPublished("state/sensor/darkorlight/")
+	if !ok {
+		t.Fatal("expected flux to publish the dark-or-light state")
+	}
+	state, err := config.SensorStateFromJSON(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.GetValueAttr("DarkOrLight", "") != "light" {
+		t.Errorf("expected 'light', got '%s'", state.GetValueAttr("DarkOrLight", ""))
+	}
+}
+
+func TestFluxRejectsMalformedSensorState(t *testing.T) {
+	m := microservice.New("flux", time.Second)
+	c := setup(m)
+	h := microservice.NewHarness(m, time.Now())
+
+	h.Inject("state/sensor/sun/", []byte(`{"type": "suncalc"}`))
+	h.Inject("state/sensor/weather/", []byte(`{"name": `))
+
+	if c.suncalc != nil || c.weather != nil {
+		t.Error("malformed sensor states should not reach the handlers")
+	}
+	if m.DecodeFailures["state/sensor/sun/"] != 1 || m.DecodeFailures["state/sensor/weather/"] != 1 {
+		t.Errorf("expected the decode failures to be counted, got %v", m.DecodeFailures)
+	}
+	letters := h.Published(microservice.DeadLetterTopic("flux"))
+	if len(letters) != 2 {
+		t.Fatalf("expected 2 dead letters, got %d", len(letters))
+	}
+}
+
+var testFluxConfig = `
+{
+    "seasons": [ { "name": "winter", "ct": { "min": 0, "max": 1 }, "bri": { "min": 0, "max": 1 } } ],
+    "lighttime": [
+        {
+            "ct": { "from": 0, "to": 1 },
+            "bri": { "from": 0, "to": 1 },
+            "darkorlight": "light",
+            "timeslot": { "start": "day.begin", "end": "day.end" }
+        }
+    ]
+}
+`
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+	microservice "github.com/jurgen-kluft/go-home/micro-service"
+	"github.com/jurgen-kluft/go-home/topic"
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// The sensor states that are announced to Home Assistant
+var sources = []string{"state/sensor/#", "state/presence/", "state/light/+/flux/"}
+
+const (
+	// DiscoveryPrefix is the prefix Home Assistant looks for discovery messages under
+	DiscoveryPrefix = "homeassistant"
+	// StatePrefix is the prefix of the per-entity state topics
+	StatePrefix = "gohome"
+)
+
+// The birth message of Home Assistant, the entities are announced again when
+// Home Assistant (re)starts.
+const statusChannel = DiscoveryPrefix + "/status/"
+
+// deviceClass is how Home Assistant shows an attribute, by attribute name
+type deviceClass struct {
+	Class string
+	Unit  string
+}
+
+var deviceClasses = map[string]deviceClass{
+	"temperature": {Class: "temperature", Unit: "°C"},
+	"wind":        {Class: "wind_speed", Unit: "m/s"},
+	"aqi":         {Class: "aqi"},
+	"pm2.5":       {Class: "pm25", Unit: "µg/m³"},
+	"bri":         {Unit: "%"},
+}
+
+// entity is an attribute of a SensorState as a Home Assistant entity
+type entity struct {
+	ID        string
+	Component string
+	Discovery []byte
+	State     string
+}
+
+func (e *entity) discoveryChannel() string {
+	return fmt.Sprintf("%s/%s/%s/config/", DiscoveryPrefix, e.Component, e.ID)
+}
+
+func (e *entity) stateChannel() string {
+	return stateTopic(e.ID) + "/"
+}
+
+// stateTopic returns the MQTT topic Home Assistant reads the state of an entity from
+func stateTopic(id string) string {
+	return fmt.Sprintf("%s/%s/state", StatePrefix, id)
+}
+
+// discovery keeps the entities that have been announced
+type discovery struct {
+	entities map[string]*entity
+	service  string
+}
+
+func newDiscovery(service string) *discovery {
+	return &discovery{entities: map[string]*entity{}, service: service}
+}
+
+// entityID returns the object id of an attribute, Home Assistant only accepts
+// letters, digits, '_' and '-'.
+func entityID(sensor string, attr string) string {
+	return "gohome_" + strings.Replace(topic.Name(sensor+" "+attr), "-", "_", -1)
+}
+
+// translate returns the entities of a SensorState with their state and the
+// entities that have not been announced yet.
+func (d *discovery) translate(state *config.SensorState) (entities []*entity, announce []*entity) {
+	add := func(attr string, component string, value string, extra map[string]interface{}) {
+		id := entityID(state.Name, attr)
+		e, exists := d.entities[id]
+		if !exists {
+			e = &entity{ID: id, Component: component}
+			cfg := map[string]interface{}{
+				"name":                  attr,
+				"unique_id":             id,
+				"object_id":             id,
+				"state_topic":           stateTopic(id),
+				"availability_topic":    transport.StatusTopic(d.service),
+				"payload_available":     transport.StatusOnline,
+				"payload_not_available": transport.StatusOffline,
+				"device": map[string]interface{}{
+					"identifiers":  []string{"gohome_" + strings.Replace(topic.Name(state.Name), "-", "_", -1)},
+					"name":         state.Name,
+					"model":        state.Type,
+					"manufacturer": "go-home",
+				},
+			}
+			for k, v := range extra {
+				cfg[k] = v
+			}
+			e.Discovery, _ = json.Marshal(cfg)
+			d.entities[id] = e
+			announce = append(announce, e)
+		}
+		e.State = value
+		entities = append(entities, e)
+	}
+	measurement := func(attr string) map[string]interface{} {
+		extra := map[string]interface{}{"state_class": "measurement"}
+		if dc, exists := deviceClasses[strings.ToLower(attr)]; exists {
+			if dc.Class != "" {
+				extra["device_class"] = dc.Class
+			}
+			if dc.Unit != "" {
+				extra["unit_of_measurement"] = dc.Unit
+			}
+		}
+		return extra
+	}
+
+	for _, a := range state.FloatAttrs {
+		add(a.Name, "sensor", fmt.Sprint(a.Value), measurement(a.Name))
+	}
+	for _, a := range state.IntAttrs {
+		add(a.Name, "sensor", fmt.Sprint(a.Value), measurement(a.Name))
+	}
+	for _, a := range state.BoolAttrs {
+		value := "OFF"
+		if a.Value {
+			value = "ON"
+		}
+		add(a.Name, "binary_sensor", value, nil)
+	}
+	for _, a := range state.StringAttrs {
+		add(a.Name, "sensor", a.Value, nil)
+	}
+	for _, a := range state.TimeWndAttrs {
+		window, _ := json.Marshal(map[string]time.Time{"begin": a.Begin, "end": a.End})
+		add(a.Name, "sensor", string(window), map[string]interface{}{
+			"device_class":          "timestamp",
+			"value_template":        "{{ value_json.begin }}",
+			"json_attributes_topic": stateTopic(entityID(state.Name, a.Name)),
+		})
+	}
+	return entities, announce
+}
+
+// register registers the channels of a new entity, they are raw so that Home
+// Assistant receives the payloads without the trace envelope.
+func register(m *microservice.Service, e *entity) {
+	for _, channel := range []string{e.discoveryChannel(), e.stateChannel()} {
+		m.Register(channel)
+		m.SetOptions(channel, transport.Options{QoS: 1, Retain: true, Raw: true})
+	}
+}
+
+func publish(m *microservice.Service, channel string, payload []byte) {
+	if err := m.Pubsub.Publish(channel, payload); err != nil {
+		m.Logger.LogError(m.Name, err.Error())
+	}
+}
+
+// setup registers the channels and handlers of the discovery service
+func setup(m *microservice.Service) *discovery {
+	d := newDiscovery(m.Name)
+	m.Subscribe(statusChannel)
+	for _, source := range sources {
+		m.Subscribe(source)
+		microservice.RegisterTypedHandler(m, source, func(m *microservice.Service, topic string, state *config.SensorState) bool {
+			entities, announce := d.translate(state)
+			for _, e := range announce {
+				m.Logger.LogInfo(m.Name, "announcing "+e.ID)
+				register(m, e)
+				publish(m, e.discoveryChannel(), e.Discovery)
+			}
+			for _, e := range entities {
+				publish(m, e.stateChannel(), []byte(e.State))
+			}
+			return true
+		})
+	}
+
+	m.RegisterHandler(statusChannel, func(m *microservice.Service, topic string, msg []byte) bool {
+		if string(msg) == transport.StatusOnline {
+			m.Logger.LogInfo(m.Name, "Home Assistant (re)started, announcing all entities")
+			for _, e := range d.entities {
+				publish(m, e.discoveryChannel(), e.Discovery)
+				publish(m, e.stateChannel(), []byte(e.State))
+			}
+		}
+		return true
+	})
+	return d
+}
+
+func main() {
+	m := microservice.New("homeassistant", time.Second)
+	setup(m)
+	m.Loop(context.Background())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+	microservice "github.com/jurgen-kluft/go-home/micro-service"
+)
+
+func TestDiscoveryOfSensorState(t *testing.T) {
+	m := microservice.New("homeassistant", time.Second)
+	setup(m)
+	now := time.Date(2020, 6, 21, 12, 0, 0, 0, time.UTC)
+	h := microservice.NewHarness(m, now)
+
+	weather := config.NewSensorState("weather", "weather")
+	weather.AddFloatAttr("temperature", 21.5)
+	weather.AddTimeWndAttr("rain", now, now.Add(time.Hour))
+	payload, _ := weather.ToJSON()
+	h.Inject("state/sensor/weather/", payload)
+
+	discovery, ok := h.LastPublished("homeassistant/sensor/gohome_weather_temperature/config/")
+	if !ok {
+		t.Fatal("expected a discovery message for the temperature")
+	}
+	cfg := map[string]interface{}{}
+	if err := json.Unmarshal(discovery, &cfg); err != nil {
+		t.Fatalf("discovery message is not plain JSON: %s", err.Error())
+	}
+	if cfg["state_topic"] != "gohome/gohome_weather_temperature/state" || cfg["device_class"] != "temperature" || cfg["unit_of_measurement"] != "°C" {
+		t.Errorf("unexpected discovery message %s", string(discovery))
+	}
+	if state, _ := h.LastPublished("gohome/gohome_weather_temperature/state/"); string(state) != "21.5" {
+		t.Errorf("expected state '21.5', got '%s'", string(state))
+	}
+	if _, ok := h.LastPublished("homeassistant/sensor/gohome_weather_rain/config/"); !ok {
+		t.Error("expected a discovery message for the rain time window")
+	}
+
+	// A new state only updates the entities
+	weather.FloatAttrs[0].Value = 22
+	payload, _ = weather.ToJSON()
+	h.Inject("state/sensor/weather/", payload)
+	if n := len(h.Published("homeassistant/sensor/gohome_weather_temperature/config/")); n != 1 {
+		t.Errorf("expected the entity to be announced once, got %d", n)
+	}
+	if state, _ := h.LastPublished("gohome/gohome_weather_temperature/state/"); string(state) != "22" {
+		t.Errorf("expected state '22', got '%s'", string(state))
+	}
+
+	// When Home Assistant restarts everything is announced again
+	h.Inject("homeassistant/status/", []byte("online"))
+	if n := len(h.Published("homeassistant/sensor/gohome_weather_temperature/config/")); n != 2 {
+		t.Errorf("expected the entity to be announced again, got %d", n)
+	}
+}
+
+func TestDiscoveryComponents(t *testing.T) {
+	d := newDiscovery("homeassistant")
+	state := config.NewSensorState("Front Door", "magnet")
+	state.AddBoolAttr("open", true)
+	state.AddStringAttr("battery", "low")
+
+	entities, announce := d.translate(state)
+	if len(entities) != 2 || len(announce) != 2 {
+		t.Fatalf("expected 2 new entities, got %d/%d", len(entities), len(announce))
+	}
+	if entities[0].Component != "binary_sensor" || entities[0].State != "ON" || entities[0].ID != "gohome_front_door_open" {
+		t.Errorf("unexpected entity %+v", entities[0])
+	}
+	if entities[1].Component != "sensor" || entities[1].State != "low" {
+		t.Errorf("unexpected entity %+v", entities[1])
+	}
+	if _, announce = d.translate(state); len(announce) != 0 {
+		t.Error("known entities should not be announced again")
+	}
+}
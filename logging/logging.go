@@ -8,6 +8,7 @@ type Logger struct {
 	log     *logrus.Logger
 	process string
 	context map[string]*logrus.Entry
+	OnError func(context string, line string)
 }
 
 func New(process string) *Logger {
@@ -23,16 +24,13 @@ func New(process string) *Logger {
 }
 
 func (log *Logger) AddEntry(context string) {
-	logentry := logrus.WithFields(logrus.Fields{
+	// The entry uses the logger configured in New, changing the formatter of
+	// a shared logger here would race with the goroutines that are logging.
+	logentry := log.log.WithFields(logrus.Fields{
 		"process":  log.process,
 		"category": context,
 	})
 
-	logentry.Logger.Formatter.(*logrus.TextFormatter).DisableColors = false
-	logentry.Logger.Formatter.(*logrus.TextFormatter).FullTimestamp = true
-	logentry.Logger.Formatter.(*logrus.TextFormatter).DisableTimestamp = false
-	logentry.Logger.Formatter.(*logrus.TextFormatter).TimestampFormat = "Mon 15:04:05"
-
 	log.context[context] = logentry
 }
 
@@ -41,7 +39,16 @@ func (log *Logger) LogInfo(context string, line string) {
 	entry.Info(line)
 }
 
+// LogInfoFields logs a line with structured fields, e.g. the topic of a message
+func (log *Logger) LogInfoFields(context string, line string, fields map[string]interface{}) {
+	entry := log.context[context]
+	entry.WithFields(logrus.Fields(fields)).Info(line)
+}
+
 func (log *Logger) LogError(context string, line string) {
 	entry := log.context[context]
 	entry.Error(line)
+	if log.OnError != nil {
+		log.OnError(context, line)
+	}
 }
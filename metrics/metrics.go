@@ -46,7 +46,9 @@ func New() (*Metrics, error) {
 }
 
 func (m *Metrics) Close() {
-	m.client.Close()
+	if m.client != nil {
+		m.client.Close()
+	}
 }
 
 func (m *Metrics) Register(name string, tags map[string]string, fields map[string]interface{}) {
@@ -0,0 +1,44 @@
+package microservice
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes the delay before the next reconnect, the delay grows by
+// Factor with every failed attempt up to Max. The jitter spreads the
+// reconnects of all the services that lost the broker at the same moment.
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	Factor  float64
+	Jitter  float64 // A fraction of the delay, e.g. 0.2 is +/- 20%
+	attempt int
+}
+
+// NewBackoff returns a Backoff that starts at 1 second and grows to 2 minutes
+func NewBackoff() *Backoff {
+	return &Backoff{Min: time.Second, Max: 2 * time.Minute, Factor: 2, Jitter: 0.2}
+}
+
+// Next returns the delay before the next attempt
+func (b *Backoff) Next() time.Duration {
+	delay := float64(b.Min)
+	for i := 0; i < b.attempt && delay < float64(b.Max); i++ {
+		delay *= b.Factor
+	}
+	b.attempt++
+
+	delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	} else if delay < float64(b.Min) {
+		delay = float64(b.Min)
+	}
+	return time.Duration(delay)
+}
+
+// Reset starts over at Min, it is called once a connection succeeded
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,47 @@
+package microservice
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time to a service, tests replace it with a FakeClock
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock is a Clock that only moves when it is told to
+type FakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Set moves the clock to 'now'
+func (c *FakeClock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+}
+
+// Advance moves the clock forward by 'd'
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
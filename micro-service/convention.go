@@ -0,0 +1,64 @@
+package microservice
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jurgen-kluft/go-home/topic"
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// TopicCheck decides what happens with a publish on a topic that does not
+// follow the naming convention of mqtt/topics.md
+type TopicCheck int
+
+const (
+	// TopicCheckWarn logs the first publish on a non-conforming topic, the
+	// default while the services migrate to the convention.
+	TopicCheckWarn TopicCheck = iota
+	// TopicCheckReject refuses the publish with an error
+	TopicCheckReject
+	// TopicCheckOff does not check the topics
+	TopicCheckOff
+)
+
+// TopicCheckEnv is the environment variable that sets the TopicCheck of a
+// service, 'warn' (default), 'reject' or 'off'.
+const TopicCheckEnv = "GOHOME_TOPIC_CHECK"
+
+// TopicExempt are the topics of the services themselves rather than of the
+// devices, they are not checked. Raw channels are not checked either.
+var TopicExempt = []string{"config/#", "service/#", "reply/#", "deadletter/#"}
+
+func topicCheckFromEnv() TopicCheck {
+	switch os.Getenv(TopicCheckEnv) {
+	case "reject":
+		return TopicCheckReject
+	case "off":
+		return TopicCheckOff
+	}
+	return TopicCheckWarn
+}
+
+// checkTopic validates the topic of a publish against the naming convention
+func (m *Service) checkTopic(channel string) error {
+	if m.TopicCheck == TopicCheckOff || isTick(channel) || m.options(channel).Raw {
+		return nil
+	}
+	for _, filter := range m.TopicExempt {
+		if transport.MatchTopic(filter, channel) {
+			return nil
+		}
+	}
+	err := topic.Validate(channel)
+	if err == nil {
+		return nil
+	}
+	if m.TopicCheck == TopicCheckReject {
+		return fmt.Errorf("PubSub.Publish failed for channel %s, %s", channel, err.Error())
+	}
+	if m.Stats.nonconformingOn(channel) == 1 {
+		m.Logger.LogInfo(m.Name, "publishing on a topic that does not follow the naming convention, "+err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package microservice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+func TestTopicCheck(t *testing.T) {
+	m := New("convention", time.Second)
+	m.Register("state/sensor/aqi/")
+	m.Register("sensor/outside/garden/main/pm2-5/aqi/")
+	m.Register("config/request/")
+	m.Register("homeassistant/sensor/aqi/config/")
+	m.SetOptions("homeassistant/sensor/aqi/config/", transport.Options{Raw: true})
+	h := NewHarness(m, time.Now())
+
+	m.TopicCheck = TopicCheckWarn
+	for i := 0; i < 3; i++ {
+		if err := m.Pubsub.PublishStr("state/sensor/aqi/", "{}"); err != nil {
+			t.Errorf("warn mode should not refuse a publish, %v", err)
+		}
+	}
+	if m.Stats.nonconforming["state/sensor/aqi/"] != 3 {
+		t.Errorf("the non-conforming publishes were not counted, %v", m.Stats.nonconforming)
+	}
+
+	m.TopicCheck = TopicCheckReject
+	if err := m.Pubsub.PublishStr("state/sensor/aqi/", "{}"); err == nil {
+		t.Errorf("reject mode should refuse a non-conforming topic")
+	}
+	for _, channel := range []string{"sensor/outside/garden/main/pm2-5/aqi/", "config/request/", "homeassistant/sensor/aqi/config/"} {
+		if err := m.Pubsub.PublishStr(channel, "{}"); err != nil {
+			t.Errorf("%s should be accepted, %v", channel, err)
+		}
+	}
+	if len(h.Published("state/sensor/aqi/")) != 3 {
+		t.Errorf("the refused publish should not reach the broker")
+	}
+}
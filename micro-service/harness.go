@@ -0,0 +1,185 @@
+package microservice
+
+import (
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport/loopback"
+)
+
+// Harness runs a Service on a loopback bus with a fake clock, messages and
+// ticks are dispatched synchronously so that a test can assert on what the
+// service published.
+type Harness struct {
+	Service *Service
+	Bus     *loopback.Bus
+	Pubsub  *loopback.Context
+	Clock   *FakeClock
+}
+
+// NewHarness connects the service to a fresh loopback bus, the service
+// should have registered its channels and handlers before this call.
+func NewHarness(m *Service, now time.Time) *Harness {
+	h := &Harness{}
+	h.Service = m
+	h.Bus = loopback.NewBus()
+	h.Pubsub = loopback.New(h.Bus, 0)
+	h.Clock = NewFakeClock(now)
+
+	m.Clock = h.Clock
+	m.Outbox.clock = h.Clock
+	m.Outbox.Attach(h.Pubsub)
+	m.Pubsub = &publisher{Transport: m.Outbox, m: m}
+	m.connect()
+	return h
+}
+
+// Inject publishes a message on the bus as if another service sent it and
+// dispatches everything the service received, it returns false when a
+// handler wants the service to quit.
+func (h *Harness) Inject(topic string, payload []byte) bool {
+	h.Bus.Publish(topic, payload)
+	return h.Drain()
+}
+
+// Tick advances the clock by the tick frequency and dispatches a tick, 'n'
+// times, the schedules of the service that are due run on every tick.
+func (h *Harness) Tick(n int) bool {
+	for i := 0; i < n; i++ {
+		h.Clock.Advance(h.Service.TickFrequency)
+		if !h.Service.receive(h.Pubsub.Tick) {
+			return false
+		}
+		if !h.Drain() {
+			return false
+		}
+	}
+	return true
+}
+
+// Drain dispatches all pending messages of the service and waits until the
+// worker pools have handled their messages.
+func (h *Harness) Drain() bool {
+	for {
+		select {
+		case msg := <-h.Service.ProcessMessages:
+			if !h.Service.process(msg) {
+				return false
+			}
+		case msg := <-h.Pubsub.InMsgs:
+			if !h.Service.receive(msg) {
+				return false
+			}
+		case <-h.Service.quit:
+			return false
+		default:
+			for _, pool := range h.Service.pools() {
+				pool.wait()
+			}
+			// The backlog is checked first, once it is empty nothing moves to
+			// InMsgs behind our back.
+			if len(h.Service.ProcessMessages) == 0 && h.Pubsub.Pending() == 0 && len(h.Pubsub.InMsgs) == 0 {
+				select {
+				case <-h.Service.quit:
+					return false
+				default:
+					return true
+				}
+			}
+		}
+	}
+}
+
+// Shutdown runs the shutdown of the service as Loop does when it ends, the
+// queued messages are handled, the hooks run and the offline status is published.
+func (h *Harness) Shutdown() {
+	h.Service.shutdown()
+}
+
+// Request sends a request to the service and returns its reply, both are
+// sealed with the keyring of the service.
+func (h *Harness) Request(topic string, payload []byte, timeout time.Duration) ([]byte, error) {
+	type result struct {
+		reply []byte
+		err   error
+	}
+	payload, err := h.Service.Keyring.Seal(topic, payload)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, err := h.Bus.Request(topic, "reply/harness/", payload, timeout)
+		if len(reply) > 0 {
+			if opened, openErr := h.Service.Keyring.OpenReply(topic, reply); openErr != nil {
+				reply, err = nil, openErr
+			} else {
+				reply = opened
+			}
+		}
+		done <- result{reply, err}
+	}()
+	for {
+		select {
+		case r := <-done:
+			return r.reply, r.err
+		case msg := <-h.Pubsub.InMsgs:
+			h.Service.receive(msg)
+		}
+	}
+}
+
+// Respond answers the requests the service sends on 'topic'
+func (h *Harness) Respond(topic string, responder func(request []byte) ([]byte, error)) {
+	h.Bus.Respond(topic, func(request []byte) ([]byte, error) {
+		request, err := h.Service.Keyring.Open(topic, request)
+		if err != nil {
+			return nil, err
+		}
+		_, request = UnwrapTrace(request)
+		reply, err := responder(request)
+		if err != nil {
+			return nil, err
+		}
+		return h.Service.Keyring.SealReply(topic, reply)
+	})
+}
+
+// unwrap opens a published message with the keyring of the service and
+// removes its trace envelope.
+func (h *Harness) unwrap(topic string, data []byte) (string, []byte) {
+	data, err := h.Service.Keyring.peek(topic, data)
+	if err != nil {
+		return "", nil
+	}
+	return UnwrapTrace(data)
+}
+
+// Published returns the payloads the service published on 'topic', without
+// their trace envelope.
+func (h *Harness) Published(topic string) [][]byte {
+	payloads := [][]byte{}
+	for _, msg := range h.Pubsub.Messages(topic) {
+		_, payload := h.unwrap(topic, msg.Data)
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+// Traces returns the trace ids of the messages the service published on 'topic'
+func (h *Harness) Traces(topic string) []string {
+	traces := []string{}
+	for _, msg := range h.Pubsub.Messages(topic) {
+		trace, _ := h.unwrap(topic, msg.Data)
+		traces = append(traces, trace)
+	}
+	return traces
+}
+
+// LastPublished returns the most recent payload the service published on 'topic'
+func (h *Harness) LastPublished(topic string) ([]byte, bool) {
+	payloads := h.Published(topic)
+	if len(payloads) == 0 {
+		return nil, false
+	}
+	return payloads[len(payloads)-1], true
+}
@@ -0,0 +1,100 @@
+package microservice
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHarness(t *testing.T) {
+	m := New("echo", time.Second)
+	m.RegisterAndSubscribe([]string{"state/echo/"}, []string{"state/sensor/*/"})
+
+	received := 0
+	m.RegisterHandler("state/sensor/sun/", func(m *Service, topic string, msg []byte) bool {
+		received++
+		m.Pubsub.Publish("state/echo/", msg)
+		return true
+	})
+
+	ticks := []time.Time{}
+	m.RegisterHandler("tick/", func(m *Service, topic string, msg []byte) bool {
+		ticks = append(ticks, m.Now())
+		return len(ticks) < 3
+	})
+
+	start := time.Date(2020, 6, 21, 12, 0, 0, 0, time.UTC)
+	h := NewHarness(m, start)
+
+	h.Inject("state/sensor/sun/", []byte("sunny"))
+	h.Inject("state/presence/", []byte("home"))
+	if received != 1 {
+		t.Errorf("expected 1 message to be handled, got %d", received)
+	}
+	payload, ok := h.LastPublished("state/echo/")
+	if !ok || string(payload) != "sunny" {
+		t.Errorf("expected 'sunny' to be published on state/echo/, got '%s'", string(payload))
+	}
+
+	if !h.Tick(2) {
+		t.Error("handler should not quit before the 3rd tick")
+	}
+	if h.Tick(1) {
+		t.Error("handler should quit at the 3rd tick")
+	}
+	if len(ticks) != 3 || !ticks[2].Equal(start.Add(3*time.Second)) {
+		t.Errorf("expected the fake clock to advance with every tick, got %v", ticks)
+	}
+}
+
+func TestHarnessRequest(t *testing.T) {
+	m := New("tv", time.Second)
+	m.RegisterAndSubscribe([]string{"config/get/"}, []string{})
+	m.RegisterResponder("tv/state/", func(m *Service, topic string, request []byte) ([]byte, error) {
+		if string(request) != "livingroom" {
+			return nil, fmt.Errorf("unknown tv %s", string(request))
+		}
+		return []byte("on"), nil
+	})
+
+	h := NewHarness(m, time.Now())
+
+	reply, err := h.Request("tv/state/", []byte("livingroom"), time.Second)
+	if err != nil || string(reply) != "on" {
+		t.Errorf("expected reply 'on', got '%s' (%v)", string(reply), err)
+	}
+	if _, err = h.Request("tv/state/", []byte("kitchen"), time.Second); err == nil || err.Error() != "unknown tv kitchen" {
+		t.Errorf("expected the error of the responder, got %v", err)
+	}
+
+	h.Respond("config/get/", func(request []byte) ([]byte, error) {
+		return []byte("{}"), nil
+	})
+	reply, err = m.Request("config/get/", []byte("tv"), time.Second)
+	if err != nil || string(reply) != "{}" {
+		t.Errorf("expected reply '{}', got '%s' (%v)", string(reply), err)
+	}
+}
+
+func TestHarnessPublishToOwnSubscription(t *testing.T) {
+	m := New("repeater", time.Second)
+	m.RegisterAndSubscribe([]string{"state/repeat/"}, []string{"state/repeat/", "state/start/"})
+
+	received := 0
+	m.RegisterHandler("state/start/", func(m *Service, topic string, msg []byte) bool {
+		for i := 0; i < 1000; i++ {
+			m.Pubsub.Publish("state/repeat/", []byte(fmt.Sprint(i)))
+		}
+		return true
+	})
+	m.RegisterHandler("state/repeat/", func(m *Service, topic string, msg []byte) bool {
+		received++
+		return true
+	})
+
+	h := NewHarness(m, time.Now())
+	h.Inject("state/start/", []byte("go"))
+	if received != 1000 {
+		t.Errorf("expected 1000 messages to be handled, got %d", received)
+	}
+}
@@ -0,0 +1,284 @@
+package microservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HTTPAddrEnv is the environment variable that enables the HTTP endpoint of a
+// service, e.g. GOHOME_HTTP=127.0.0.1:5101, the overseer sets it from the 'env'
+// of the process in overseer/config/process.d, every service has its own port.
+const HTTPAddrEnv = "GOHOME_HTTP"
+
+// MaxRecentErrors is the number of errors that /errors reports
+const MaxRecentErrors = 32
+
+// RecentError is an error that the service logged
+type RecentError struct {
+	Time    time.Time `json:"time"`
+	Context string    `json:"context"`
+	Error   string    `json:"error"`
+}
+
+// Stats are the counters and the state of a service as reported by the HTTP
+// endpoint, they are updated on the Loop and read by the HTTP server.
+type Stats struct {
+	lock           sync.Mutex
+	started        time.Time
+	connected      bool
+	ready          map[string]bool
+	configVersion  string
+	received       map[string]uint64
+	decodeFailures map[string]uint64
+	rateLimited    map[string]uint64
+	rejected       map[string]uint64
+	nonconforming  map[string]uint64
+	latency        map[string]*Latency
+	errors         []RecentError
+}
+
+func newStats(now time.Time) *Stats {
+	return &Stats{
+		started:        now,
+		ready:          make(map[string]bool),
+		received:       make(map[string]uint64),
+		decodeFailures: make(map[string]uint64),
+		rateLimited:    make(map[string]uint64),
+		rejected:       make(map[string]uint64),
+		nonconforming:  make(map[string]uint64),
+		latency:        make(map[string]*Latency),
+	}
+}
+
+func (s *Stats) setConnected(connected bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.connected = connected
+}
+
+func (s *Stats) receivedOn(topic string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.received[topic]++
+}
+
+func (s *Stats) decodeFailedOn(topic string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.decodeFailures[topic]++
+}
+
+func (s *Stats) limitedOn(topic string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rateLimited[topic]++
+}
+
+func (s *Stats) rejectedOn(topic string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rejected[topic]++
+}
+
+// nonconformingOn counts a publish on a topic that does not follow the
+// naming convention, it returns the number of publishes on that topic.
+func (s *Stats) nonconformingOn(topic string) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nonconforming[topic]++
+	return s.nonconforming[topic]
+}
+
+func (s *Stats) handled(topic string, duration time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l, exists := s.latency[topic]
+	if !exists {
+		l = &Latency{}
+		s.latency[topic] = l
+	}
+	l.Count++
+	l.Total += duration
+	if duration > l.Max {
+		l.Max = duration
+	}
+}
+
+func (s *Stats) recordError(now time.Time, context string, line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.errors) == MaxRecentErrors {
+		s.errors = s.errors[1:]
+	}
+	s.errors = append(s.errors, RecentError{Time: now, Context: context, Error: line})
+}
+
+// SetReady sets a readiness condition of the service, e.g. 'config' once the
+// configuration was received. The service is ready when it is connected and
+// all its conditions are true.
+func (m *Service) SetReady(condition string, ready bool) {
+	m.Stats.lock.Lock()
+	defer m.Stats.lock.Unlock()
+	m.Stats.ready[condition] = ready
+}
+
+// SetConfigVersion records the version of the configuration that the service
+// runs, see config.Version, it is reported by /healthz.
+func (m *Service) SetConfigVersion(version string) {
+	m.Stats.lock.Lock()
+	defer m.Stats.lock.Unlock()
+	m.Stats.configVersion = version
+}
+
+// ConfigVersion returns the version of the configuration that the service runs
+func (m *Service) ConfigVersion() string {
+	m.Stats.lock.Lock()
+	defer m.Stats.lock.Unlock()
+	return m.Stats.configVersion
+}
+
+// Ready returns true when the service is connected and all its conditions are
+// true, the conditions that are false are returned.
+func (m *Service) Ready() (bool, []string) {
+	m.Stats.lock.Lock()
+	defer m.Stats.lock.Unlock()
+	pending := []string{}
+	if !m.Stats.connected {
+		pending = append(pending, "broker")
+	}
+	for condition, ready := range m.Stats.ready {
+		if !ready {
+			pending = append(pending, condition)
+		}
+	}
+	sort.Strings(pending)
+	return len(pending) == 0, pending
+}
+
+// HTTPHandler returns the handler of the HTTP endpoint of the service:
+//
+//	/healthz        the service is running and its configuration version
+//	/readyz         the service is connected and has its configuration
+//	/handlers       the topics that have a handler
+//	/subscriptions  the subscribed and registered channels
+//	/errors         the most recent errors
+//	/stats          the message counters and the depth of the queues
+func (m *Service) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"service":        m.Name,
+			"status":         "ok",
+			"uptime":         m.Now().Sub(m.Stats.started).Round(time.Second).String(),
+			"config_version": m.ConfigVersion(),
+		})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready, pending := m.Ready()
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, map[string]interface{}{"ready": ready, "pending": pending})
+	})
+	mux.HandleFunc("/handlers", func(w http.ResponseWriter, r *http.Request) {
+		m.lock.RLock()
+		topics := make([]string, 0, len(m.Handlers))
+		for topic := range m.Handlers {
+			topics = append(topics, topic)
+		}
+		responders := make([]string, 0, len(m.Responders))
+		for topic := range m.Responders {
+			responders = append(responders, topic)
+		}
+		m.lock.RUnlock()
+		sort.Strings(topics)
+		sort.Strings(responders)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"handlers": topics, "responders": responders})
+	})
+	mux.HandleFunc("/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		m.lock.RLock()
+		subscribe := append([]string{}, m.PubsubSubscribe...)
+		register := append([]string{}, m.PubsubRegister...)
+		m.lock.RUnlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"subscribe": subscribe, "register": register})
+	})
+	mux.HandleFunc("/errors", func(w http.ResponseWriter, r *http.Request) {
+		m.Stats.lock.Lock()
+		errors := append([]RecentError{}, m.Stats.errors...)
+		m.Stats.lock.Unlock()
+		writeJSON(w, http.StatusOK, errors)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		m.Stats.lock.Lock()
+		stats := map[string]interface{}{
+			"received":        copyCounters(m.Stats.received),
+			"decode_failures": copyCounters(m.Stats.decodeFailures),
+			"rate_limited":    copyCounters(m.Stats.rateLimited),
+			"rejected":        copyCounters(m.Stats.rejected),
+			"nonconforming":   copyCounters(m.Stats.nonconforming),
+			"errors":          len(m.Stats.errors),
+		}
+		latency := make(map[string]Latency, len(m.Stats.latency))
+		for topic, l := range m.Stats.latency {
+			latency[topic] = *l
+		}
+		stats["latency"] = latency
+		m.Stats.lock.Unlock()
+		stats["outbox"] = m.Outbox.counters()
+		if dropped, ok := m.Outbox.incomingDropped(); ok {
+			stats["transport"] = map[string]uint64{"dropped": dropped}
+		}
+		pools := map[string]interface{}{}
+		for _, pool := range m.pools() {
+			pools[pool.Filter] = pool.counters()
+		}
+		stats["pools"] = pools
+		writeJSON(w, http.StatusOK, stats)
+	})
+	return mux
+}
+
+func copyCounters(counters map[string]uint64) map[string]uint64 {
+	c := make(map[string]uint64, len(counters))
+	for k, v := range counters {
+		c[k] = v
+	}
+	return c
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// startHTTP starts the HTTP endpoint when HTTPAddr is set
+func (m *Service) startHTTP() {
+	if m.HTTPAddr == "" || m.httpServer != nil {
+		return
+	}
+	m.httpServer = &http.Server{Addr: m.HTTPAddr, Handler: m.HTTPHandler()}
+	go func(server *http.Server) {
+		m.Logger.LogInfo(m.Name, "HTTP endpoint listening on "+server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			m.Logger.LogError(m.Name, err.Error())
+		}
+	}(m.httpServer)
+}
+
+func (m *Service) stopHTTP(ctx context.Context) {
+	if m.httpServer != nil {
+		m.httpServer.Shutdown(ctx)
+		m.httpServer = nil
+	}
+}
+
+func httpAddrFromEnv() string {
+	return os.Getenv(HTTPAddrEnv)
+}
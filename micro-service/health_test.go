@@ -0,0 +1,77 @@
+package microservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, m *Service, path string, v interface{}) int {
+	w := httptest.NewRecorder()
+	m.HTTPHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("%s returned invalid JSON: %v", path, err)
+	}
+	return w.Code
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	m := New("health", time.Second)
+	m.Subscribe("config/health/")
+	m.SetReady("config", false)
+	m.RegisterHandler("config/health/", func(m *Service, topic string, msg []byte) bool {
+		m.SetReady("config", true)
+		m.SetConfigVersion("0a1b2c3d4e5f")
+		return true
+	})
+
+	var ready struct {
+		Ready   bool     `json:"ready"`
+		Pending []string `json:"pending"`
+	}
+	if code := get(t, m, "/readyz", &ready); code != http.StatusServiceUnavailable || len(ready.Pending) != 2 {
+		t.Errorf("/readyz before connecting: %d %v", code, ready.Pending)
+	}
+
+	h := NewHarness(m, time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+	if code := get(t, m, "/readyz", &ready); code != http.StatusServiceUnavailable || len(ready.Pending) != 1 || ready.Pending[0] != "config" {
+		t.Errorf("/readyz without configuration: %d %v", code, ready.Pending)
+	}
+	h.Inject("config/health/", []byte("{}"))
+	if code := get(t, m, "/readyz", &ready); code != http.StatusOK || !ready.Ready {
+		t.Errorf("/readyz with configuration: %d %v", code, ready.Pending)
+	}
+
+	var health map[string]string
+	if code := get(t, m, "/healthz", &health); code != http.StatusOK || health["service"] != "health" || health["config_version"] != "0a1b2c3d4e5f" {
+		t.Errorf("/healthz: %d %v", code, health)
+	}
+
+	var handlers map[string][]string
+	get(t, m, "/handlers", &handlers)
+	if len(handlers["handlers"]) != 2 || handlers["handlers"][0] != "config.health" {
+		t.Errorf("/handlers: %v", handlers)
+	}
+
+	var subscriptions map[string][]string
+	get(t, m, "/subscriptions", &subscriptions)
+	if len(subscriptions["subscribe"]) != 1 || subscriptions["subscribe"][0] != "config/health/" {
+		t.Errorf("/subscriptions: %v", subscriptions)
+	}
+
+	m.Logger.LogError(m.Name, "something failed")
+	var errors []RecentError
+	if get(t, m, "/errors", &errors); len(errors) != 1 || errors[0].Error != "something failed" {
+		t.Errorf("/errors: %v", errors)
+	}
+
+	var stats struct {
+		Received map[string]uint64 `json:"received"`
+	}
+	get(t, m, "/stats", &stats)
+	if stats.Received["config/health/"] != 1 {
+		t.Errorf("/stats: %v", stats.Received)
+	}
+}
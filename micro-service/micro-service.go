@@ -1,37 +1,89 @@
 package microservice
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jurgen-kluft/go-home/config"
 	logpkg "github.com/jurgen-kluft/go-home/logging"
-	pubsub "github.com/jurgen-kluft/go-home/mqtt"
+	mqtt "github.com/jurgen-kluft/go-home/mqtt"
+	nats "github.com/jurgen-kluft/go-home/nats"
+	"github.com/jurgen-kluft/go-home/transport"
+	"github.com/jurgen-kluft/go-home/transport/loopback"
 )
 
 // Delegate is a handler that the user can register on a certain received topic
 type Delegate func(m *Service, topic string, message []byte) bool
 
+// Responder answers a request, the reply (or the error) is sent back to the requester
+type Responder func(m *Service, topic string, request []byte) ([]byte, error)
+
+// ShutdownHook is run when the service shuts down, e.g. to flush metrics
+type ShutdownHook func(m *Service)
+
 type Message struct {
 	Topic   string
 	Payload []byte
 }
 
-// Service is a convenience setup to implement a micro-service
+// Service is a convenience setup to implement a micro-service. The handlers
+// of a message get their own Service that shares the state of the service and
+// carries the trace of the message, a publish continues that trace.
 type Service struct {
+	*state
+	Pubsub transport.Transport
+	trace  string
+}
+
+type state struct {
 	Name            string
 	Logger          *logpkg.Logger
 	PubsubRegister  []string
 	PubsubSubscribe []string
-	Pubsub          *pubsub.Context
+	PubsubOptions   map[string]transport.Options
+	PubsubCfg       map[string]string
+	PubsubErr       error
+	Outbox          *Outbox
+	Reconnect       *Backoff
 	Handlers        map[string]Delegate
+	Responders      map[string]Responder
+	Codec           Codec
+	DecodeFailures  map[string]uint64
 	CatchHandler    Delegate
 	ProcessMessages chan *Message
 	TickFrequency   time.Duration
+	Clock           Clock
+	Schedules       []*Schedule
+	scheduleLock    sync.Mutex
+	ShutdownHooks   []ShutdownHook
+	ShutdownTimeout time.Duration
+	Pools           map[string]*WorkerPool
+	Middleware      []Middleware
+	Tracing         bool
+	Keyring         *Keyring
+	KeyringErr      error
+	TopicCheck      TopicCheck
+	TopicExempt     []string
+	Stats           *Stats
+	HTTPAddr        string
+	httpServer      *http.Server
+	random          *rand.Rand
+	quit            chan struct{}
+	lock            sync.RWMutex
 }
 
 func New(name string, tickFrequency time.Duration) *Service {
-	service := &Service{}
+	service := &Service{state: &state{}}
 
 	service.Name = name
 	service.Logger = logpkg.New(name)
@@ -40,37 +92,97 @@ func New(name string, tickFrequency time.Duration) *Service {
 
 	service.PubsubRegister = make([]string, 0, 10)
 	service.PubsubSubscribe = make([]string, 0, 10)
+	service.PubsubOptions = make(map[string]transport.Options)
+	// Connecting to another broker than the one asked for is worse than not
+	// running at all, Loop does not start while PubsubErr is set. A main that
+	// resolves the profile itself (e.g. from a flag) replaces both.
+	service.PubsubCfg, service.PubsubErr = config.ResolvePubSub(config.LayersFromEnv(os.Environ()))
+	if service.PubsubErr != nil {
+		service.Logger.LogError("pubsub", service.PubsubErr.Error())
+		service.PubsubCfg = maps.Clone(config.PubSubCfg)
+	}
 	service.Handlers = make(map[string]Delegate)
+	service.Responders = make(map[string]Responder)
+	service.Codec = JSONCodec
+	service.DecodeFailures = make(map[string]uint64)
+	service.PubsubRegister = append(service.PubsubRegister, DeadLetterTopic(name))
 
 	service.ProcessMessages = make(chan *Message, 128)
 	service.TickFrequency = tickFrequency
+	service.Clock = realClock{}
+	service.ShutdownTimeout = 5 * time.Second
+	service.Outbox = NewOutbox(1024, 5*time.Minute, service.Clock)
+	service.Reconnect = NewBackoff()
+	service.Pools = make(map[string]*WorkerPool)
+	service.Tracing = tracingFromEnv()
+	// Without its keyring a service would publish the protected topics in
+	// plaintext, Loop does not start while KeyringErr is set
+	service.Keyring, service.KeyringErr = NewKeyring(config.PubSubKeys)
+	if service.KeyringErr != nil {
+		service.Logger.LogError("pubsub", service.KeyringErr.Error())
+	}
+	service.TopicCheck = topicCheckFromEnv()
+	service.TopicExempt = append([]string{}, TopicExempt...)
+	service.quit = make(chan struct{}, 1)
+	service.Stats = newStats(time.Now())
+	service.HTTPAddr = httpAddrFromEnv()
+	service.Logger.OnError = func(context string, line string) {
+		service.Stats.recordError(service.Now(), context, line)
+	}
+	service.random = newRandom()
 	return service
 }
 
+// Now returns the current time of the service clock
+func (m *Service) Now() time.Time {
+	return m.Clock.Now()
+}
+
 func (m *Service) Register(r string) error {
-	if m.Pubsub == nil {
-		// Not connected yet, just add it to the list
-		m.PubsubRegister = append(m.PubsubRegister, r)
-	} else {
+	m.lock.Lock()
+	m.PubsubRegister = append(m.PubsubRegister, r)
+	m.lock.Unlock()
+	if m.Pubsub != nil {
 		// We are connected, also call Register on pubsub
-		m.PubsubRegister = append(m.PubsubRegister, r)
 		m.Pubsub.Register(r)
 	}
 	return nil
 }
 
+// Subscribe adds a subscription, the channel may contain the wildcards
+// '+' (single chapter) and '#' (all remaining chapters).
 func (m *Service) Subscribe(r string) error {
-	if m.Pubsub == nil {
-		// Not connected yet, just add it to the list
-		m.PubsubSubscribe = append(m.PubsubSubscribe, r)
-	} else {
+	if err := transport.ValidateFilter(r); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	m.PubsubSubscribe = append(m.PubsubSubscribe, r)
+	m.lock.Unlock()
+	if m.Pubsub != nil {
 		// We are connected, also call Subscribe on pubsub
-		m.PubsubSubscribe = append(m.PubsubSubscribe, r)
 		m.Pubsub.Subscribe(r)
 	}
 	return nil
 }
 
+// SetOptions sets the QoS and retain flag of a channel, e.g. retain the
+// last sun state so that a restarting service receives it immediately.
+func (m *Service) SetOptions(channel string, options transport.Options) error {
+	m.lock.Lock()
+	m.PubsubOptions[channel] = options
+	m.lock.Unlock()
+	if m.Pubsub != nil {
+		return m.Pubsub.SetOptions(channel, options)
+	}
+	return nil
+}
+
+func (m *Service) options(channel string) transport.Options {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.PubsubOptions[channel]
+}
+
 func (m *Service) RegisterAndSubscribe(register []string, subscribe []string) {
 	for _, r := range register {
 		m.Register(r)
@@ -81,6 +193,8 @@ func (m *Service) RegisterAndSubscribe(register []string, subscribe []string) {
 }
 
 func (m *Service) RegisterHandler(topic string, delegate Delegate) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.Handlers[topic] = delegate
 	natstopic := strings.Replace(topic, "/", ".", -1)
 	natstopic = strings.TrimSuffix(natstopic, ".")
@@ -88,103 +202,314 @@ func (m *Service) RegisterHandler(topic string, delegate Delegate) {
 }
 
 func matchTopic(etopic string, itopic string) bool {
-	ei := 0
-	ii := 0
-	cs := true
-	for ei < len(etopic) && ii < len(itopic) {
-		echar := etopic[ei]
-		ichar := itopic[ii]
-		if (echar == '/' || echar == '.') && (ichar == '/' || ichar == '.') {
-			cs = true
-			ei++
-			ii++
-		} else if cs && etopic[ei] == '*' { // chapter start ?
-			// consume chapter from itopic
-			ei++
-			for ii < len(itopic) && (itopic[ii] != '/' && itopic[ii] != '.') {
-				ii++
-			}
-			if ii == len(itopic) {
-				return false
-			}
-			cs = false
-		} else if echar != ichar {
-			return false
-		} else {
-			ei++
-			ii++
-			cs = false
+	return transport.MatchTopic(etopic, itopic)
+}
+
+// findMostSpecific returns the entry with the most specific topic that
+// matches 'itopic', the catch-all topic '*' is not considered.
+func findMostSpecific[T any](entries map[string]T, itopic string) (entry T, exists bool) {
+	if eentry, ok := entries[itopic]; ok {
+		return eentry, true
+	}
+	best := ""
+	for etopic, eentry := range entries {
+		if etopic == "*" || !matchTopic(etopic, itopic) {
+			continue
+		}
+		if !exists || transport.MoreSpecific(etopic, best) || (!transport.MoreSpecific(best, etopic) && etopic < best) {
+			best = etopic
+			entry = eentry
+			exists = true
 		}
 	}
-	return ei == len(etopic) && ii == len(itopic)
+	return entry, exists
 }
 
+// FindHandler returns the handler with the most specific topic that matches
+// 'itopic', the catch-all handler '*' is not considered.
 func (m *Service) FindHandler(itopic string) (delegate Delegate, exists bool) {
-	for etopic, edelegate := range m.Handlers {
-		if matchTopic(etopic, itopic) {
-			return edelegate, true
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return findMostSpecific(m.Handlers, itopic)
+}
+
+// RegisterResponder subscribes to 'topic' and answers the requests on it
+func (m *Service) RegisterResponder(topic string, responder Responder) error {
+	m.lock.Lock()
+	m.Responders[topic] = responder
+	m.lock.Unlock()
+	return m.Subscribe(topic)
+}
+
+// Request sends a request on the registered channel 'topic' and waits at most
+// 'timeout' for the reply. The reply does not pass through Loop, but a request
+// made from a handler blocks Loop, so a service can not answer its own requests.
+func (m *Service) Request(topic string, payload []byte, timeout time.Duration) ([]byte, error) {
+	if m.Pubsub == nil {
+		return nil, fmt.Errorf("request on %s failed, not connected", topic)
+	}
+	return m.Pubsub.Request(topic, payload, timeout)
+}
+
+// receive handles a message from the broker, requests go to their responder
+func (m *Service) receive(msg transport.Msg) bool {
+	if isTick(msg.Subject) {
+		if m.Outbox.Pending() > 0 {
+			m.flushOutbox()
+		}
+		m := m.traced(transport.NewCorrelationID())
+		if !m.runSchedules() {
+			return false
+		}
+		return m.Dispatch(msg.Subject, msg.Data)
+	}
+
+	data, err := m.Keyring.Open(msg.Subject, msg.Data)
+	if err != nil {
+		m.Stats.rejectedOn(msg.Subject)
+		m.Logger.LogError("pubsub", fmt.Sprintf("rejected message on %s: %s", msg.Subject, err.Error()))
+		return true
+	}
+	msg.Trace, msg.Data = UnwrapTrace(data)
+	m.Stats.receivedOn(msg.Subject)
+	if pool, exists := m.findPool(msg.Subject); exists {
+		pool.push(msg)
+		return true
+	}
+	return m.handle(msg)
+}
+
+// handle answers a request or dispatches the message to its handler, it runs
+// on the Loop or on the worker pool of the topic.
+func (m *Service) handle(msg transport.Msg) bool {
+	// Publishes made by the handler continue the trace of the message
+	if msg.Trace == "" {
+		msg.Trace = transport.NewCorrelationID()
+	}
+	m = m.traced(msg.Trace)
+
+	if msg.Reply != "" {
+		m.lock.RLock()
+		responder, exists := findMostSpecific(m.Responders, msg.Subject)
+		m.lock.RUnlock()
+		if exists {
+			m.respond(msg, responder)
+			return true
+		}
+	}
+	return m.Dispatch(msg.Subject, msg.Data)
+}
+
+// respond answers a request through the middleware of the service, a request
+// the middleware did not let through (e.g. a panic) is answered with an error.
+func (m *Service) respond(msg transport.Msg, responder Responder) {
+	replied := false
+	delegate := func(m *Service, topic string, request []byte) bool {
+		reply, err := responder(m, topic, request)
+		replied = true
+		if err := m.Pubsub.Reply(msg, reply, err); err != nil {
+			m.Logger.LogError("pubsub", err.Error())
 		}
+		return true
 	}
-	return nil, false
+	m.wrap(msg.Subject, delegate)(m, msg.Subject, msg.Data)
+	if !replied {
+		if err := m.Pubsub.Reply(msg, nil, fmt.Errorf("request on %s was not answered", msg.Subject)); err != nil {
+			m.Logger.LogError("pubsub", err.Error())
+		}
+	}
+}
+
+// NewTransport creates the pub/sub client for the broker selected by the
+// 'transport' entry of the configuration, 'mqtt' is the default.
+func NewTransport(cfg map[string]string, tickFrequency time.Duration) (transport.Transport, error) {
+	switch cfg["transport"] {
+	case "", "mqtt":
+		return mqtt.New(cfg, tickFrequency), nil
+	case "nats":
+		return nats.New(cfg, tickFrequency), nil
+	case "loopback":
+		return loopback.New(loopback.Default, tickFrequency), nil
+	}
+	return nil, fmt.Errorf("unknown pubsub transport '%s'", cfg["transport"])
+}
+
+// Dispatch routes a message received from the broker to its handler, it
+// returns false when the handler wants the service to quit.
+func (m *Service) Dispatch(topic string, payload []byte) bool {
+	delegate, exists := m.FindHandler(topic)
+	if !exists {
+		m.lock.RLock()
+		delegate, exists = m.Handlers["*"]
+		m.lock.RUnlock()
+	}
+	if exists {
+		return m.wrap(topic, delegate)(m, topic, payload)
+	}
+	return true
+}
+
+func (m *Service) process(msg *Message) bool {
+	m.Stats.receivedOn(msg.Topic)
+	m = m.traced(transport.NewCorrelationID())
+	delegate, exists := m.FindHandler(msg.Topic)
+	if exists {
+		return m.wrap(msg.Topic, delegate)(m, msg.Topic, msg.Payload)
+	}
+	return true
+}
+
+// flushOutbox publishes the messages that were queued while disconnected
+func (m *Service) flushOutbox() {
+	sent, err := m.Outbox.Flush()
+	if sent > 0 {
+		m.Logger.LogInfo("pubsub", fmt.Sprintf("published %d queued messages", sent))
+	}
+	if err != nil && !errors.Is(err, transport.ErrNotConnected) {
+		m.Logger.LogError("pubsub", err.Error())
+	}
+}
+
+// connect applies the channel options to the transport and connects it
+func (m *Service) connect() error {
+	for channel, options := range m.PubsubOptions {
+		if err := m.Pubsub.SetOptions(channel, options); err != nil {
+			return err
+		}
+	}
+	err := m.Pubsub.Connect(m.Name, m.PubsubRegister, m.PubsubSubscribe)
+	m.Stats.setConnected(err == nil)
+	return err
+}
+
+// OnShutdown registers a hook that runs when the service shuts down, hooks
+// run in reverse order of registration.
+func (m *Service) OnShutdown(hook ShutdownHook) {
+	m.ShutdownHooks = append(m.ShutdownHooks, hook)
+}
+
+// shutdown handles the messages that are still queued, also on the worker
+// pools, runs the shutdown hooks and disconnects, which publishes the offline status. It gives up when this
+// takes longer than ShutdownTimeout.
+func (m *Service) shutdown() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for drained := false; !drained; {
+			select {
+			case msg := <-m.ProcessMessages:
+				m.process(msg)
+			default:
+				drained = true
+			}
+		}
+		for _, pool := range m.pools() {
+			pool.close()
+		}
+		for i := len(m.ShutdownHooks) - 1; i >= 0; i-- {
+			m.ShutdownHooks[i](m)
+		}
+		if m.Pubsub != nil {
+			m.Pubsub.Close()
+		}
+		m.Stats.setConnected(false)
+	}()
+
+	select {
+	case <-done:
+		m.Logger.LogInfo(m.Name, "shut down")
+	case <-time.After(m.ShutdownTimeout):
+		m.Logger.LogError(m.Name, fmt.Sprintf("shutdown did not finish within %v", m.ShutdownTimeout))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m.stopHTTP(ctx)
 }
 
-func (m *Service) Loop() {
+// Loop connects to the broker and handles messages until a handler returns
+// false, the context is cancelled or the process receives SIGINT or SIGTERM.
+// It does not start when the broker could not be resolved or a key is bad,
+// see PubsubErr and KeyringErr.
+func (m *Service) Loop(ctx context.Context) {
+	if err := errors.Join(m.PubsubErr, m.KeyringErr); err != nil {
+		m.Logger.LogError(m.Name, "not starting, "+err.Error())
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	m.startHTTP()
+
 	quit := false
 	for !quit {
-		m.Pubsub = pubsub.New(config.PubSubCfg, m.TickFrequency)
-		err := m.Pubsub.Connect(m.Name, m.PubsubRegister, m.PubsubSubscribe)
+		client, err := NewTransport(m.PubsubCfg, m.TickFrequency)
+		if err != nil {
+			m.Logger.LogError(m.Name, err.Error())
+			return
+		}
+		m.Outbox.Attach(client)
+		m.Pubsub = &publisher{Transport: m.Outbox, m: m}
+		err = m.connect()
 		if err == nil {
 			m.Logger.LogInfo("pubsub", "connected")
+			m.Reconnect.Reset()
+			m.flushOutbox()
 
 			connected := true
 			for connected {
 				select {
+				case <-ctx.Done():
+					connected = false
+					quit = true
+
+				case <-m.quit:
+					connected = false
+					quit = true
+
 				case msg := <-m.ProcessMessages:
-					topic := msg.Topic
-					delegate, exists := m.FindHandler(topic)
-					if exists {
-						if !delegate(m, topic, msg.Payload) {
-							connected = false
-							quit = true
-						}
+					if !m.process(msg) {
+						connected = false
+						quit = true
 					}
 
-				case msg := <-m.Pubsub.InMsgs:
-					topic := m.Pubsub.Topic(msg)
-					delegate, exists := m.Handlers[topic]
-					if exists {
-						if !delegate(m, topic, m.Pubsub.Payload(msg)) {
-							connected = false
-							quit = true
-						}
-					} else {
-						delegate, exists := m.Handlers["*"]
-						if exists {
-							if !delegate(m, topic, m.Pubsub.Payload(msg)) {
-								connected = false
-								quit = true
-							}
-						}
-
-						if topic == "client/disconnected" {
-							m.Logger.LogInfo("pubsub", "disconnected")
-							connected = false
-						}
+				case msg := <-m.Pubsub.Incoming():
+					topic := msg.Subject
+					if !m.receive(msg) {
+						connected = false
+						quit = true
+					}
+					if strings.TrimSuffix(topic, "/") == "client/disconnected" {
+						m.Logger.LogInfo("pubsub", "disconnected")
+						m.Stats.setConnected(false)
+						connected = false
 					}
 				}
 			}
-			m.Pubsub.Close()
+			if !quit {
+				m.Pubsub.Close()
+			}
 		}
 
 		if err != nil {
 			m.Logger.LogError(m.Name, err.Error())
+			// The next attempt uses a new transport, the failed one may
+			// have started a client that has to be stopped.
+			m.Pubsub.Close()
 		}
 
 		if !quit {
-			m.Logger.LogInfo("pubsub", "Waiting 5 seconds before re-connecting..")
-			time.Sleep(5 * time.Second)
-		} else {
-			m.Logger.LogInfo("pubsub", "End.")
+			delay := m.Reconnect.Next()
+			m.Logger.LogInfo("pubsub", fmt.Sprintf("Waiting %v before re-connecting..", delay.Round(time.Millisecond)))
+			select {
+			case <-ctx.Done():
+				quit = true
+			case <-time.After(delay):
+			}
 		}
 	}
+
+	m.shutdown()
+	m.Logger.LogInfo("pubsub", "End.")
 }
@@ -1,7 +1,13 @@
 package microservice
 
 import (
+	"context"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport"
+	"github.com/jurgen-kluft/go-home/transport/loopback"
 )
 
 func TestMatchTopic(t *testing.T) {
@@ -24,3 +30,121 @@ func TestMatchTopic(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestMatchTopicWildcards(t *testing.T) {
+	// Matches
+	if matchTopic("sensor/+/+/+/motion/#", "sensor/1stfloor/kitchen/ceiling/motion/sensor-01/") == false {
+		t.Fail()
+	}
+	if matchTopic("sensor/#", "sensor") == false {
+		t.Fail()
+	}
+	if matchTopic("state/+/sun/", "state.sensor.sun.") == false {
+		t.Fail()
+	}
+
+	// Force failures
+	if matchTopic("sensor/+/+/+/motion/#", "sensor/1stfloor/kitchen/ceiling/humidity/sensor-01/") == true {
+		t.Fail()
+	}
+	if matchTopic("sensor/+/", "sensor/1stfloor/kitchen/") == true {
+		t.Fail()
+	}
+}
+
+func TestFindHandlerMostSpecific(t *testing.T) {
+	m := New("test", time.Second)
+	handled := ""
+	handler := func(name string) Delegate {
+		return func(m *Service, topic string, message []byte) bool {
+			handled = name
+			return true
+		}
+	}
+	m.RegisterHandler("*", handler("catch-all"))
+	m.RegisterHandler("sensor/#", handler("sensor"))
+	m.RegisterHandler("sensor/+/+/+/motion/#", handler("motion"))
+	m.RegisterHandler("sensor/1stfloor/kitchen/+/motion/#", handler("kitchen"))
+
+	m.Dispatch("sensor/1stfloor/kitchen/ceiling/motion/sensor-01/", nil)
+	if handled != "kitchen" {
+		t.Errorf("expected kitchen handler, got %s", handled)
+	}
+	m.Dispatch("sensor/2ndfloor/bedroom/ceiling/motion/sensor-02/", nil)
+	if handled != "motion" {
+		t.Errorf("expected motion handler, got %s", handled)
+	}
+	m.Dispatch("sensor/2ndfloor/bedroom/ceiling/humidity/sensor-03/", nil)
+	if handled != "sensor" {
+		t.Errorf("expected sensor handler, got %s", handled)
+	}
+	m.Dispatch("state/presence/", nil)
+	if handled != "catch-all" {
+		t.Errorf("expected catch-all handler, got %s", handled)
+	}
+
+	if m.Subscribe("sensor/#/motion/") == nil {
+		t.Error("expected '#' in the middle of a filter to be rejected")
+	}
+}
+
+func TestLoopShutdown(t *testing.T) {
+	m := New("shutdown", 0)
+	m.PubsubCfg = map[string]string{"transport": "loopback"}
+	m.Register("state/shutdown/")
+
+	order := []string{}
+	m.RegisterHandler("state/shutdown/", func(m *Service, topic string, message []byte) bool {
+		order = append(order, "message")
+		return true
+	})
+	m.OnShutdown(func(m *Service) { order = append(order, "first") })
+	m.OnShutdown(func(m *Service) { order = append(order, "second") })
+
+	// Messages that are still queued are handled before the hooks run
+	m.ProcessMessages <- &Message{Topic: "state/shutdown/", Payload: []byte("{}")}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		m.Loop(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * m.ShutdownTimeout):
+		t.Fatal("Loop did not return after the context was cancelled")
+	}
+
+	if got := strings.Join(order, ","); got != "message,second,first" {
+		t.Errorf("shutdown order %s, want message,second,first", got)
+	}
+	if s, _ := loopback.Default.Retained(transport.StatusTopic(m.Name)); string(s) != transport.StatusOffline {
+		t.Errorf("status after shutdown is '%s', want '%s'", s, transport.StatusOffline)
+	}
+}
+
+func TestUnknownPubSubProfile(t *testing.T) {
+	t.Setenv("GOHOME_PUBSUB", "nowhere")
+	m := New("profile", 0)
+	if m.PubsubErr == nil || len(m.PubsubCfg) == 0 {
+		t.Fatalf("expected the default broker and an error, got %v (%v)", m.PubsubCfg, m.PubsubErr)
+	}
+
+	started := false
+	m.OnShutdown(func(m *Service) { started = true })
+	done := make(chan struct{})
+	go func() {
+		m.Loop(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Loop should not start with an unknown pubsub profile")
+	}
+	if started {
+		t.Errorf("Loop connected to the default broker")
+	}
+}
@@ -0,0 +1,133 @@
+package microservice
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a handler, e.g. to log or time every message. Like the
+// middleware of the hollywood actors, the first middleware passed to Use is
+// the outermost one.
+type Middleware = func(Delegate) Delegate
+
+// Use adds middleware to all the handlers and responders of the service,
+// ticks do not pass through the middleware.
+func (m *Service) Use(middleware ...Middleware) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Middleware = append(m.Middleware, middleware...)
+}
+
+func applyMiddleware(delegate Delegate, middleware ...Middleware) Delegate {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		delegate = middleware[i](delegate)
+	}
+	return delegate
+}
+
+// wrap applies the middleware of the service to 'delegate'
+func (m *Service) wrap(topic string, delegate Delegate) Delegate {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if len(m.Middleware) == 0 || isTick(topic) {
+		return delegate
+	}
+	return applyMiddleware(delegate, m.Middleware...)
+}
+
+// Recover turns a panic in a handler into a logged error so that one bad
+// message does not take the service down.
+func Recover() Middleware {
+	return func(next Delegate) Delegate {
+		return func(m *Service, topic string, message []byte) (ok bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					m.Logger.LogError(m.Name, fmt.Sprintf("handler for %s panicked: %v\n%s", topic, r, debug.Stack()))
+					ok = true
+				}
+			}()
+			return next(m, topic, message)
+		}
+	}
+}
+
+// Latency is the time spent in the handler of a topic
+type Latency struct {
+	Count uint64        `json:"count"`
+	Total time.Duration `json:"total"`
+	Max   time.Duration `json:"max"`
+}
+
+// Timing measures the time spent in the handlers per topic, the latencies
+// are reported on /stats of the HTTP endpoint.
+func Timing() Middleware {
+	return func(next Delegate) Delegate {
+		return func(m *Service, topic string, message []byte) bool {
+			start := time.Now()
+			defer func() {
+				m.Stats.handled(topic, time.Since(start))
+			}()
+			return next(m, topic, message)
+		}
+	}
+}
+
+// Logging logs every message with its topic, payload size, duration and trace id
+func Logging() Middleware {
+	return func(next Delegate) Delegate {
+		return func(m *Service, topic string, message []byte) bool {
+			start := time.Now()
+			ok := next(m, topic, message)
+			m.Logger.LogInfoFields(m.Name, "handled message", map[string]interface{}{
+				"topic":    topic,
+				"size":     len(message),
+				"duration": time.Since(start).String(),
+				"trace":    m.TraceID(),
+			})
+			return ok
+		}
+	}
+}
+
+// RateLimit drops the messages on a topic that exceed 'rate' messages per
+// second, 'burst' messages may arrive at once. Every topic has its own limit.
+func RateLimit(rate float64, burst int) Middleware {
+	type bucket struct {
+		tokens float64
+		last   time.Time
+	}
+	var lock sync.Mutex
+	buckets := map[string]*bucket{}
+
+	allow := func(topic string, now time.Time) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		b, exists := buckets[topic]
+		if !exists {
+			b = &bucket{tokens: float64(burst), last: now}
+			buckets[topic] = b
+		}
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+		b.last = now
+		if b.tokens < 1 {
+			return false
+		}
+		b.tokens--
+		return true
+	}
+
+	return func(next Delegate) Delegate {
+		return func(m *Service, topic string, message []byte) bool {
+			if !allow(topic, m.Now()) {
+				m.Stats.limitedOn(topic)
+				return true
+			}
+			return next(m, topic, message)
+		}
+	}
+}
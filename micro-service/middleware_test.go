@@ -0,0 +1,111 @@
+package microservice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	m := New("middleware", time.Second)
+	m.Subscribe("state/")
+
+	order := ""
+	trace := func(name string) Middleware {
+		return func(next Delegate) Delegate {
+			return func(m *Service, topic string, message []byte) bool {
+				order += name + ">"
+				ok := next(m, topic, message)
+				order += "<" + name
+				return ok
+			}
+		}
+	}
+	m.Use(trace("a"), trace("b"))
+	m.RegisterHandler("state/", func(m *Service, topic string, message []byte) bool {
+		order += "handler"
+		return true
+	})
+	m.RegisterHandler("tick/", func(m *Service, topic string, message []byte) bool {
+		order += "tick"
+		return true
+	})
+
+	h := NewHarness(m, time.Now())
+	h.Inject("state/", []byte("{}"))
+	if order != "a>b>handler<b<a" {
+		t.Errorf("middleware ran as '%s'", order)
+	}
+	order = ""
+	h.Tick(1)
+	if order != "tick" {
+		t.Errorf("a tick should not pass through the middleware, got '%s'", order)
+	}
+}
+
+func TestRecoverAndTiming(t *testing.T) {
+	m := New("middleware", time.Second)
+	m.Subscribe("state/")
+	m.Use(Recover(), Timing())
+	m.RegisterHandler("state/", func(m *Service, topic string, message []byte) bool {
+		panic("bad message")
+	})
+
+	h := NewHarness(m, time.Now())
+	if !h.Inject("state/", []byte("{}")) {
+		t.Errorf("a recovered panic should not stop the service")
+	}
+	if len(m.Stats.errors) != 1 {
+		t.Errorf("the panic was not logged")
+	}
+	if l := m.Stats.latency["state/"]; l == nil || l.Count != 1 {
+		t.Errorf("the handler was not timed, %v", l)
+	}
+}
+
+func TestRecoverResponder(t *testing.T) {
+	m := New("middleware", time.Second)
+	m.Use(Recover(), Timing())
+	m.RegisterResponder("tv/state/", func(m *Service, topic string, request []byte) ([]byte, error) {
+		panic("bad request")
+	})
+
+	h := NewHarness(m, time.Now())
+	if _, err := h.Request("tv/state/", []byte("livingroom"), time.Second); err == nil || err == transport.ErrTimeout {
+		t.Errorf("a recovered panic should be answered with an error, got %v", err)
+	}
+	if len(m.Stats.errors) != 1 {
+		t.Errorf("the panic was not logged")
+	}
+	if l := m.Stats.latency["tv/state/"]; l == nil || l.Count != 1 {
+		t.Errorf("the responder was not timed, %v", l)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	m := New("middleware", time.Second)
+	m.Subscribe("sensor/+/")
+	m.Use(RateLimit(1, 2))
+	handled := map[string]int{}
+	m.RegisterHandler("sensor/+/", func(m *Service, topic string, message []byte) bool {
+		handled[topic]++
+		return true
+	})
+
+	h := NewHarness(m, time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+	for i := 0; i < 5; i++ {
+		h.Inject("sensor/a/", nil)
+	}
+	h.Inject("sensor/b/", nil)
+	if handled["sensor/a/"] != 2 || handled["sensor/b/"] != 1 {
+		t.Errorf("a burst of 2 per topic should pass, handled %v", handled)
+	}
+
+	h.Clock.Advance(time.Second)
+	h.Inject("sensor/a/", nil)
+	h.Inject("sensor/a/", nil)
+	if handled["sensor/a/"] != 3 || m.Stats.rateLimited["sensor/a/"] != 4 {
+		t.Errorf("after a second 1 more message should pass, handled %v, limited %v", handled, m.Stats.rateLimited)
+	}
+}
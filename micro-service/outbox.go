@@ -0,0 +1,171 @@
+package microservice
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+type outboxMsg struct {
+	channel string
+	payload []byte
+	expires time.Time
+}
+
+// Outbox wraps the transport of a service, messages that are published while
+// the connection with the broker is down are queued and published in order
+// once the service has reconnected. A queued message expires after MaxAge,
+// or after its ttl when it was published with PublishTTL, so that a stale
+// command (e.g. turn on the lights) is not replayed hours later.
+type Outbox struct {
+	transport.Transport
+	Capacity int
+	MaxAge   time.Duration
+	Dropped  uint64
+	Expired  uint64
+	clock    Clock
+	channels map[string]bool
+	queue    []outboxMsg
+	lock     sync.Mutex
+}
+
+// NewOutbox returns an Outbox that queues at most 'capacity' messages, when
+// it is full the oldest message is dropped.
+func NewOutbox(capacity int, maxAge time.Duration, clock Clock) *Outbox {
+	return &Outbox{Capacity: capacity, MaxAge: maxAge, clock: clock, channels: make(map[string]bool)}
+}
+
+// Connect connects the transport, the outbox remembers the channels that
+// can be published on so that it only queues messages the transport accepts.
+func (o *Outbox) Connect(name string, register, subscribe []string) error {
+	for _, channel := range append(register, subscribe...) {
+		o.accept(channel)
+	}
+	return o.Transport.Connect(name, register, subscribe)
+}
+
+func (o *Outbox) Register(channel string) error {
+	o.accept(channel)
+	return o.Transport.Register(channel)
+}
+
+func (o *Outbox) Subscribe(channel string) error {
+	o.accept(channel)
+	return o.Transport.Subscribe(channel)
+}
+
+// accept marks 'channel' as a channel that can be published on, like the
+// transports a subscription also registers the channel when it has no wildcards.
+func (o *Outbox) accept(channel string) {
+	if transport.HasWildcard(channel) {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.channels[channel] = true
+}
+
+// Attach sets the transport that the messages are published on
+func (o *Outbox) Attach(t transport.Transport) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.Transport = t
+}
+
+// counters returns the state of the outbox for the HTTP endpoint
+func (o *Outbox) counters() map[string]uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return map[string]uint64{"pending": uint64(len(o.queue)), "dropped": o.Dropped, "expired": o.Expired}
+}
+
+// incomingDropped returns the number of incoming messages that the transport
+// dropped because the service did not keep up, when the transport counts them.
+func (o *Outbox) incomingDropped() (uint64, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if t, ok := o.Transport.(interface{ Dropped() uint64 }); ok {
+		return t.Dropped(), true
+	}
+	return 0, false
+}
+
+// Pending returns the number of queued messages
+func (o *Outbox) Pending() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.queue)
+}
+
+func (o *Outbox) PublishStr(channel string, message string) error {
+	return o.publish(channel, []byte(message), o.MaxAge)
+}
+
+func (o *Outbox) Publish(channel string, message []byte) error {
+	return o.publish(channel, message, o.MaxAge)
+}
+
+// PublishTTL publishes the message, when it has to be queued it expires after 'ttl' seconds
+func (o *Outbox) PublishTTL(channel string, message []byte, ttl int) error {
+	maxAge := o.MaxAge
+	if ttl > 0 {
+		maxAge = time.Duration(ttl) * time.Second
+	}
+	return o.publish(channel, message, maxAge)
+}
+
+func (o *Outbox) publish(channel string, message []byte, maxAge time.Duration) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if !o.channels[channel] {
+		return fmt.Errorf("PubSub.Publish failed for channel %s", channel)
+	}
+
+	// Queue behind the messages that are waiting so that the order is kept
+	if len(o.queue) == 0 && o.Transport != nil {
+		err := o.Transport.PublishTTL(channel, message, int(maxAge/time.Second))
+		if !errors.Is(err, transport.ErrNotConnected) {
+			return err
+		}
+	}
+
+	if o.Capacity > 0 && len(o.queue) >= o.Capacity {
+		o.queue = o.queue[1:]
+		o.Dropped++
+	}
+	o.queue = append(o.queue, outboxMsg{channel: channel, payload: message, expires: o.clock.Now().Add(maxAge)})
+	return nil
+}
+
+// Flush publishes the queued messages in order, expired messages are dropped.
+// It stops at the first message that can not be sent because the connection
+// is down again, that message and the ones after it stay queued. Any other
+// error drops the message and is returned after the queue was flushed.
+func (o *Outbox) Flush() (sent int, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.Transport == nil {
+		return 0, nil
+	}
+
+	now := o.clock.Now()
+	for len(o.queue) > 0 {
+		msg := o.queue[0]
+		if !msg.expires.After(now) {
+			o.Expired++
+		} else if perr := o.Transport.PublishTTL(msg.channel, msg.payload, int(msg.expires.Sub(now)/time.Second)); errors.Is(perr, transport.ErrNotConnected) {
+			return sent, perr
+		} else if perr != nil {
+			err = perr
+		} else {
+			sent++
+		}
+		o.queue = o.queue[1:]
+	}
+	o.queue = nil
+	return sent, err
+}
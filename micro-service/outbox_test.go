@@ -0,0 +1,77 @@
+package microservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxReplaysInOrder(t *testing.T) {
+	m := New("outbox", time.Second)
+	m.Register("state/light/")
+	h := NewHarness(m, time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+
+	// The broker goes away
+	h.Pubsub.Close()
+	m.Pubsub.PublishStr("state/light/", "1")
+	m.Pubsub.PublishTTL("state/light/", []byte("2"), 60)
+	m.Pubsub.PublishStr("state/light/", "3")
+	if m.Outbox.Pending() != 3 {
+		t.Fatalf("expected 3 queued messages, got %d", m.Outbox.Pending())
+	}
+
+	// Message '2' expires before the broker is back
+	h.Clock.Advance(2 * time.Minute)
+	if err := m.connect(); err != nil {
+		t.Fatal(err)
+	}
+	m.Pubsub.PublishStr("state/light/", "4")
+	h.Tick(1)
+
+	published := h.Published("state/light/")
+	got := ""
+	for _, p := range published {
+		got += string(p)
+	}
+	if got != "134" {
+		t.Errorf("published '%s' after reconnecting, want '134'", got)
+	}
+	if m.Outbox.Pending() != 0 || m.Outbox.Expired != 1 {
+		t.Errorf("pending=%d expired=%d, want 0, 1", m.Outbox.Pending(), m.Outbox.Expired)
+	}
+}
+
+func TestOutboxCapacity(t *testing.T) {
+	m := New("outbox", time.Second)
+	m.Register("state/light/")
+	h := NewHarness(m, time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+	m.Outbox.Capacity = 2
+
+	h.Pubsub.Close()
+	for _, msg := range []string{"1", "2", "3"} {
+		m.Pubsub.PublishStr("state/light/", msg)
+	}
+	if m.Outbox.Pending() != 2 || m.Outbox.Dropped != 1 {
+		t.Errorf("pending=%d dropped=%d, want 2, 1", m.Outbox.Pending(), m.Outbox.Dropped)
+	}
+
+	// Publishing on a channel that was not registered is not queued
+	if err := m.Pubsub.PublishStr("state/unknown/", "1"); err == nil {
+		t.Errorf("expected an error for an unregistered channel")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := &Backoff{Min: time.Second, Max: 10 * time.Second, Factor: 2, Jitter: 0.2}
+	want := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, w := range want {
+		delay := b.Next()
+		w *= time.Second
+		if delay < w*8/10 || delay > w*12/10 || delay < b.Min || delay > b.Max {
+			t.Errorf("attempt %d: delay %v, want about %v", i, delay, w)
+		}
+	}
+	b.Reset()
+	if delay := b.Next(); delay > 1200*time.Millisecond {
+		t.Errorf("after a reset the delay is %v, want about 1s", delay)
+	}
+}
@@ -0,0 +1,198 @@
+package microservice
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// Overflow decides what happens with a message when the queue of a worker
+// pool is full.
+type Overflow int
+
+const (
+	// DropOldest drops the oldest queued message to make room, the default
+	DropOldest Overflow = iota
+	// DropNewest drops the message that just arrived
+	DropNewest
+	// Block waits for room in the queue, this blocks the Loop and in turn the
+	// broker client, so only use it for messages that must not get lost.
+	Block
+)
+
+// WorkerPool handles the messages of a topic filter on its own goroutines so
+// that a slow handler (e.g. a HTTP call) does not block the Loop. The handlers
+// of a pool run concurrently with the Loop and must guard the state they share.
+type WorkerPool struct {
+	Filter   string
+	Workers  int
+	Capacity int
+	Policy   Overflow
+	Dropped  uint64
+	MaxDepth int
+	handle   func(msg transport.Msg) bool
+	quit     func()
+	queue    []transport.Msg
+	active   int
+	closed   bool
+	lock     sync.Mutex
+	cond     *sync.Cond
+	wg       sync.WaitGroup
+}
+
+// SetConcurrency handles the messages that match 'topic' on 'workers'
+// goroutines, at most 'capacity' messages are queued and 'policy' decides
+// what happens when the queue is full.
+func (m *Service) SetConcurrency(topic string, workers int, capacity int, policy Overflow) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	pool := &WorkerPool{Filter: topic, Workers: workers, Capacity: capacity, Policy: policy}
+	pool.cond = sync.NewCond(&pool.lock)
+	pool.handle = m.handle
+	pool.quit = m.requestQuit
+	for i := 0; i < workers; i++ {
+		pool.wg.Add(1)
+		go pool.work()
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Pools[topic] = pool
+	natstopic := strings.Replace(topic, "/", ".", -1)
+	natstopic = strings.TrimSuffix(natstopic, ".")
+	m.Pools[natstopic] = pool
+	return pool
+}
+
+// findPool returns the worker pool of the most specific filter that matches 'topic'
+func (m *Service) findPool(topic string) (*WorkerPool, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if len(m.Pools) == 0 {
+		return nil, false
+	}
+	return findMostSpecific(m.Pools, topic)
+}
+
+// push queues a message, it returns false when the message was dropped
+func (p *WorkerPool) push(msg transport.Msg) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for len(p.queue) >= p.Capacity && !p.closed {
+		switch p.Policy {
+		case DropNewest:
+			p.Dropped++
+			return false
+		case DropOldest:
+			p.queue = p.queue[1:]
+			p.Dropped++
+		case Block:
+			p.cond.Wait()
+		}
+	}
+	if p.closed {
+		p.Dropped++
+		return false
+	}
+	p.queue = append(p.queue, msg)
+	if len(p.queue) > p.MaxDepth {
+		p.MaxDepth = len(p.queue)
+	}
+	p.cond.Broadcast()
+	return true
+}
+
+func (p *WorkerPool) work() {
+	defer p.wg.Done()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for {
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.queue) == 0 {
+			return
+		}
+		msg := p.queue[0]
+		p.queue = p.queue[1:]
+		p.active++
+		p.cond.Broadcast()
+
+		p.lock.Unlock()
+		ok := p.handle(msg)
+		p.lock.Lock()
+
+		p.active--
+		p.cond.Broadcast()
+		if !ok {
+			p.quit()
+		}
+	}
+}
+
+// Depth returns the number of queued messages
+func (p *WorkerPool) Depth() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.queue)
+}
+
+// wait blocks until the queue is empty and no handler is running
+func (p *WorkerPool) wait() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for len(p.queue) > 0 || p.active > 0 {
+		p.cond.Wait()
+	}
+}
+
+// close handles the queued messages and stops the workers
+func (p *WorkerPool) close() {
+	p.lock.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.lock.Unlock()
+	p.wg.Wait()
+}
+
+func (p *WorkerPool) counters() map[string]interface{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return map[string]interface{}{
+		"workers":   p.Workers,
+		"capacity":  p.Capacity,
+		"depth":     len(p.queue),
+		"max_depth": p.MaxDepth,
+		"active":    p.active,
+		"dropped":   p.Dropped,
+	}
+}
+
+// pools returns every worker pool once, a pool is registered under its
+// MQTT and its NATS topic.
+func (m *Service) pools() []*WorkerPool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	seen := map[*WorkerPool]bool{}
+	pools := []*WorkerPool{}
+	for _, pool := range m.Pools {
+		if !seen[pool] {
+			seen[pool] = true
+			pools = append(pools, pool)
+		}
+	}
+	return pools
+}
+
+// requestQuit asks the Loop to quit, a handler on a worker pool returned false
+func (m *Service) requestQuit() {
+	select {
+	case m.quit <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,104 @@
+package microservice
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+func TestWorkerPoolKeepsLoopResponsive(t *testing.T) {
+	m := New("pool", time.Second)
+	m.Subscribe("slow/")
+	m.Subscribe("fast/")
+
+	release := make(chan bool)
+	var lock sync.Mutex
+	handled := []string{}
+	m.SetConcurrency("slow/", 1, 4, Block)
+	m.RegisterHandler("slow/", func(m *Service, topic string, msg []byte) bool {
+		<-release
+		lock.Lock()
+		handled = append(handled, "slow")
+		lock.Unlock()
+		return true
+	})
+	m.RegisterHandler("fast/", func(m *Service, topic string, msg []byte) bool {
+		lock.Lock()
+		handled = append(handled, "fast")
+		lock.Unlock()
+		return true
+	})
+
+	h := NewHarness(m, time.Now())
+	m.receive(transport.Msg{Subject: "slow/"})
+	m.receive(transport.Msg{Subject: "fast/"})
+
+	lock.Lock()
+	if len(handled) != 1 || handled[0] != "fast" {
+		t.Errorf("the slow handler blocked the loop, handled %v", handled)
+	}
+	lock.Unlock()
+
+	close(release)
+	h.Shutdown()
+	if len(handled) != 2 {
+		t.Errorf("the slow message was not handled before the shutdown, handled %v", handled)
+	}
+}
+
+func TestWorkerPoolOverflow(t *testing.T) {
+	for _, test := range []struct {
+		policy Overflow
+		want   string
+	}{
+		{DropOldest, "034"},
+		{DropNewest, "012"},
+	} {
+		m := New("pool", time.Second)
+		m.Subscribe("sensor/+/")
+
+		release := make(chan bool)
+		got := ""
+		pool := m.SetConcurrency("sensor/+/", 1, 2, test.policy)
+		m.RegisterHandler("sensor/+/", func(m *Service, topic string, msg []byte) bool {
+			<-release
+			got += string(msg)
+			return true
+		})
+
+		// The first message is taken by the worker, the others queue up
+		h := NewHarness(m, time.Now())
+		m.receive(transport.Msg{Subject: "sensor/a/", Data: []byte("0")})
+		for pool.Depth() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		for i := 1; i <= 4; i++ {
+			m.receive(transport.Msg{Subject: "sensor/b/", Data: []byte(fmt.Sprint(i))})
+		}
+		if pool.Dropped != 2 || pool.MaxDepth != 2 {
+			t.Errorf("policy %d: dropped=%d max depth=%d, want 2, 2", test.policy, pool.Dropped, pool.MaxDepth)
+		}
+
+		close(release)
+		h.Drain()
+		if got != test.want {
+			t.Errorf("policy %d: handled '%s', want '%s'", test.policy, got, test.want)
+		}
+	}
+}
+
+func TestWorkerPoolQuit(t *testing.T) {
+	m := New("pool", time.Second)
+	m.Subscribe("quit/")
+	m.SetConcurrency("quit/", 2, 8, DropOldest)
+	m.RegisterHandler("quit/", func(m *Service, topic string, msg []byte) bool {
+		return false
+	})
+	h := NewHarness(m, time.Now())
+	if h.Inject("quit/", nil) {
+		t.Errorf("a handler on a worker pool returning false should stop the service")
+	}
+}
@@ -0,0 +1,79 @@
+package microservice
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// publisher wraps the transport of a service, the topic of a published message
+// is checked against the naming convention, the message is put in a
+// TraceEnvelope when Tracing is on and then sealed with the key of its topic.
+// Raw channels skip the trace envelope but are still sealed. Requests take
+// the same path, a reply is sealed with the key of the topic of its request.
+type publisher struct {
+	transport.Transport
+	m *Service
+}
+
+func (p *publisher) wrap(channel string, message []byte) ([]byte, error) {
+	if p.m.KeyringErr != nil {
+		return nil, p.m.KeyringErr
+	}
+	if err := p.m.checkTopic(channel); err != nil {
+		return nil, err
+	}
+	if p.m.Tracing && !p.m.options(channel).Raw {
+		trace := p.m.trace
+		if trace == "" {
+			trace = transport.NewCorrelationID()
+		}
+		message = WrapTrace(trace, message)
+	}
+	return p.m.Keyring.Seal(channel, message)
+}
+
+func (p *publisher) PublishStr(channel string, message string) error {
+	return p.Publish(channel, []byte(message))
+}
+
+func (p *publisher) Publish(channel string, message []byte) error {
+	data, err := p.wrap(channel, message)
+	if err != nil {
+		return err
+	}
+	return p.Transport.Publish(channel, data)
+}
+
+func (p *publisher) PublishTTL(channel string, message []byte, ttl int) error {
+	data, err := p.wrap(channel, message)
+	if err != nil {
+		return err
+	}
+	return p.Transport.PublishTTL(channel, data, ttl)
+}
+
+func (p *publisher) Request(channel string, message []byte, timeout time.Duration) ([]byte, error) {
+	data, err := p.wrap(channel, message)
+	if err != nil {
+		return nil, err
+	}
+	reply, requestErr := p.Transport.Request(channel, data, timeout)
+	if len(reply) == 0 {
+		return reply, requestErr
+	}
+	reply, err = p.m.Keyring.OpenReply(channel, reply)
+	if err != nil {
+		return nil, fmt.Errorf("reply to %s rejected: %w", channel, err)
+	}
+	return reply, requestErr
+}
+
+func (p *publisher) Reply(request transport.Msg, message []byte, err error) error {
+	data, sealErr := p.m.Keyring.SealReply(request.Subject, message)
+	if sealErr != nil {
+		return sealErr
+	}
+	return p.Transport.Reply(request, data, err)
+}
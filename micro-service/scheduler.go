@@ -0,0 +1,209 @@
+package microservice
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Job is a function that is run by a Schedule, it returns false when the
+// service should quit.
+type Job func(m *Service) bool
+
+// CatchUp decides what happens with the runs of a schedule that were missed,
+// e.g. because the host was suspended or a handler blocked the Loop.
+type CatchUp int
+
+const (
+	// SkipMissed runs a late schedule once and continues from the current time
+	SkipMissed CatchUp = iota
+	// RunMissed runs a late schedule once for every run that was missed
+	RunMissed
+)
+
+// MaxCatchUp limits the number of missed runs that RunMissed will replay
+const MaxCatchUp = 100
+
+// Schedule is a job that runs at an interval, at the times of a cron
+// expression or once after a delay. Schedules are checked on every tick, so
+// the resolution of a schedule is the tick frequency of the service.
+// The run times are owned by the Loop, a schedule can be created and stopped
+// from any goroutine (e.g. a handler on a worker pool).
+type Schedule struct {
+	// base is the run time without jitter, due is base plus the jitter of
+	// the run so that the jitter does not accumulate from run to run.
+	base    time.Time
+	due     time.Time
+	every   time.Duration
+	cron    *Cron
+	once    bool
+	jitter  time.Duration
+	catchUp CatchUp
+	job     Job
+	stopped atomic.Bool
+}
+
+// ScheduleOption configures a Schedule
+type ScheduleOption func(s *Schedule)
+
+// WithJitter delays every run by a random duration in [0, jitter) so that
+// services that start at the same time do not all poll at the same time.
+func WithJitter(jitter time.Duration) ScheduleOption {
+	return func(s *Schedule) {
+		s.jitter = jitter
+	}
+}
+
+// WithCatchUp sets the policy for missed runs, the default is SkipMissed
+func WithCatchUp(policy CatchUp) ScheduleOption {
+	return func(s *Schedule) {
+		s.catchUp = policy
+	}
+}
+
+// Immediately makes the first run happen on the first tick instead of
+// after the first interval.
+func Immediately() ScheduleOption {
+	return func(s *Schedule) {
+		s.base = time.Time{}
+	}
+}
+
+// Stop cancels the schedule, a job can stop its own schedule
+func (s *Schedule) Stop() {
+	s.stopped.Store(true)
+}
+
+// Next returns the time at which the schedule runs next, it is meant to be
+// called from the Loop (e.g. from a job or a handler that does not run on a
+// worker pool).
+func (s *Schedule) Next() time.Time {
+	return s.due
+}
+
+func (m *Service) schedule(s *Schedule, opts []ScheduleOption) *Schedule {
+	for _, opt := range opts {
+		opt(s)
+	}
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+	if !s.base.IsZero() {
+		s.due = s.base.Add(m.jitter(s))
+	}
+	m.Schedules = append(m.Schedules, s)
+	return s
+}
+
+// jitter returns the jitter of the next run, the caller holds scheduleLock
+func (m *Service) jitter(s *Schedule) time.Duration {
+	if s.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(m.random.Int63n(int64(s.jitter)))
+}
+
+// Every runs 'job' every 'interval', the first run is after one interval
+func (m *Service) Every(interval time.Duration, job Job, opts ...ScheduleOption) *Schedule {
+	s := &Schedule{every: interval, job: job, base: m.Now().Add(interval)}
+	return m.schedule(s, opts)
+}
+
+// At runs 'job' at the times of the cron expression 'expr', e.g. '0 6 * * *'
+func (m *Service) At(expr string, job Job, opts ...ScheduleOption) (*Schedule, error) {
+	cron, err := ParseCron(expr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Schedule{cron: cron, job: job, base: cron.Next(m.Now())}
+	if s.base.IsZero() {
+		return nil, fmt.Errorf("cron expression '%s' never matches", expr)
+	}
+	return m.schedule(s, opts), nil
+}
+
+// After runs 'job' once after 'delay'
+func (m *Service) After(delay time.Duration, job Job, opts ...ScheduleOption) *Schedule {
+	s := &Schedule{once: true, job: job, base: m.Now().Add(delay)}
+	return m.schedule(s, opts)
+}
+
+func (s *Schedule) following(t time.Time) time.Time {
+	if s.cron != nil {
+		return s.cron.Next(t)
+	}
+	return t.Add(s.every)
+}
+
+// advance moves the base of the schedule past 'now' and returns the number
+// of runs that are due, the caller adds the jitter to the new base.
+func (s *Schedule) advance(now time.Time) int {
+	if s.once {
+		s.stopped.Store(true)
+		return 1
+	}
+	if s.base.IsZero() {
+		s.base = now
+	}
+	runs := 0
+	for !s.base.After(now) && runs < MaxCatchUp {
+		runs++
+		s.base = s.following(s.base)
+		if s.base.IsZero() {
+			// The cron expression has no more matches
+			s.stopped.Store(true)
+			return runs
+		}
+	}
+	if s.catchUp == SkipMissed && runs > 1 {
+		runs = 1
+		if s.cron == nil {
+			s.base = s.following(now)
+		}
+	}
+	if !s.base.After(now) {
+		// More than MaxCatchUp runs behind, continue from now
+		s.base = s.following(now)
+	}
+	return runs
+}
+
+// runSchedules runs the jobs that are due, it returns false when a job
+// wants the service to quit.
+func (m *Service) runSchedules() bool {
+	now := m.Now()
+	m.scheduleLock.Lock()
+	current := m.Schedules
+	m.scheduleLock.Unlock()
+
+	active := make([]*Schedule, 0, len(current))
+	quit := false
+	for _, s := range current {
+		if !s.stopped.Load() && !quit && !s.due.After(now) {
+			runs := s.advance(now)
+			m.scheduleLock.Lock()
+			s.due = s.base.Add(m.jitter(s))
+			m.scheduleLock.Unlock()
+			for i := 0; i < runs && !quit; i++ {
+				quit = !s.job(m)
+			}
+		}
+		if !s.stopped.Load() {
+			active = append(active, s)
+		}
+	}
+	// Jobs and handlers may have added schedules while we were running them
+	m.scheduleLock.Lock()
+	m.Schedules = append(active, m.Schedules[len(current):]...)
+	m.scheduleLock.Unlock()
+	return !quit
+}
+
+func isTick(topic string) bool {
+	return strings.TrimSuffix(topic, "/") == "tick"
+}
+
+func newRandom() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
@@ -0,0 +1,138 @@
+package microservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	start := time.Date(2024, time.March, 1, 10, 7, 30, 0, time.UTC) // a Friday
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.March, 1, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.March, 1, 10, 15, 0, 0, time.UTC)},
+		{"0 6 * * *", time.Date(2024, time.March, 2, 6, 0, 0, 0, time.UTC)},
+		{"30 8 * * 1-5", time.Date(2024, time.March, 4, 8, 30, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 15 * 0", time.Date(2024, time.March, 3, 12, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.March, 1, 11, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		cron, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q) failed: %v", test.expr, err)
+			continue
+		}
+		if next := cron.Next(start); !next.Equal(test.next) {
+			t.Errorf("ParseCron(%q).Next = %v, want %v", test.expr, next, test.next)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) should fail", expr)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	m := New("scheduler", time.Second)
+	h := NewHarness(m, time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+
+	every, at, after := 0, 0, 0
+	m.Every(5*time.Second, func(m *Service) bool { every++; return true })
+	m.After(3*time.Second, func(m *Service) bool { after++; return true })
+	if _, err := m.At("1 10 * * *", func(m *Service) bool { at++; return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Tick(59)
+	if every != 11 || after != 1 || at != 0 {
+		t.Errorf("after 59 ticks: every=%d after=%d at=%d, want 11, 1, 0", every, after, at)
+	}
+	h.Tick(1)
+	if at != 1 {
+		t.Errorf("the cron schedule did not run at 10:01")
+	}
+	if len(m.Schedules) != 2 {
+		t.Errorf("the one-shot schedule was not removed, %d schedules", len(m.Schedules))
+	}
+}
+
+func TestSchedulerCatchUp(t *testing.T) {
+	m := New("scheduler", time.Second)
+	h := NewHarness(m, time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+
+	skipped, replayed := 0, 0
+	skip := m.Every(time.Minute, func(m *Service) bool { skipped++; return true })
+	m.Every(time.Minute, func(m *Service) bool { replayed++; return true }, WithCatchUp(RunMissed))
+
+	// The host was suspended for ten minutes
+	h.Clock.Advance(10 * time.Minute)
+	h.Tick(1)
+	if skipped != 1 || replayed != 10 {
+		t.Errorf("after a suspend: skipped=%d replayed=%d, want 1, 10", skipped, replayed)
+	}
+	if want := h.Clock.Now().Add(time.Minute); !skip.Next().Equal(want) {
+		t.Errorf("SkipMissed should continue from now, next run at %v, want %v", skip.Next(), want)
+	}
+}
+
+func TestSchedulerJitterAndStop(t *testing.T) {
+	m := New("scheduler", time.Second)
+	h := NewHarness(m, time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+
+	runs := 0
+	s := m.Every(10*time.Second, func(m *Service) bool { runs++; return true }, WithJitter(5*time.Second), Immediately())
+	h.Tick(1)
+	if runs != 1 {
+		t.Fatalf("Immediately should run on the first tick, runs=%d", runs)
+	}
+	if delay := s.Next().Sub(h.Clock.Now()); delay < 10*time.Second || delay >= 15*time.Second {
+		t.Errorf("next run in %v, want within [10s, 15s)", delay)
+	}
+	s.Stop()
+	h.Tick(30)
+	if runs != 1 || len(m.Schedules) != 0 {
+		t.Errorf("a stopped schedule ran, runs=%d schedules=%d", runs, len(m.Schedules))
+	}
+
+	m.Every(time.Second, func(m *Service) bool { return false })
+	if h.Tick(1) {
+		t.Errorf("a job returning false should stop the service")
+	}
+}
+
+func TestSchedulerJitterDoesNotDrift(t *testing.T) {
+	m := New("scheduler", time.Second)
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	h := NewHarness(m, start)
+
+	period, jitter := 10*time.Second, 5*time.Second
+	runs := []time.Time{}
+	m.Every(period, func(m *Service) bool { runs = append(runs, m.Now()); return true }, WithJitter(jitter))
+
+	// Every run stays within the jitter of its own period
+	h.Tick(1000 * 10)
+	if len(runs) < 999 || len(runs) > 1000 {
+		t.Fatalf("expected 1000 runs in 1000 periods, got %d", len(runs))
+	}
+	for i, run := range runs {
+		base := start.Add(time.Duration(i+1) * period)
+		if offset := run.Sub(base); offset < 0 || offset > jitter+m.TickFrequency {
+			t.Fatalf("run %d is %v after its period, want within the jitter of %v", i, offset, jitter)
+		}
+	}
+
+	// Missed runs are counted from the un-jittered times
+	replayed := 0
+	m.Every(period, func(m *Service) bool { replayed++; return true }, WithJitter(jitter), WithCatchUp(RunMissed))
+	h.Clock.Advance(100 * period)
+	h.Tick(1)
+	if replayed != 100 {
+		t.Errorf("after a suspend of 100 periods: replayed=%d, want 100", replayed)
+	}
+}
@@ -0,0 +1,274 @@
+package microservice
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+)
+
+// SecureEnvelope carries an encrypted and/or signed payload. The topic and the
+// time of sealing are part of the signature and of the encryption, so a
+// message can not be replayed on another topic. Every message has a random
+// nonce, a message that is older than the replay window or that was opened
+// before is rejected.
+type SecureEnvelope struct {
+	Nonce []byte `json:"nonce"`
+	Time  int64  `json:"time"`
+	Data  []byte `json:"sealed"`
+	MAC   []byte `json:"mac,omitempty"`
+}
+
+var securePrefix = []byte(`{"nonce":`)
+
+// ErrNotSealed is returned for a plaintext message on a protected topic
+var ErrNotSealed = errors.New("message is not sealed")
+
+// ErrReplayed is returned for a sealed message that is stale or was seen before
+var ErrReplayed = errors.New("message is replayed")
+
+// ReplayWindow is how far the time of a sealed message may be from the clock
+// of the receiver, the clocks of the hosts are expected to be in sync (NTP).
+const ReplayWindow = 2 * time.Minute
+
+// TopicKey holds the keys that protect the topics starting with Prefix
+type TopicKey struct {
+	Prefix string
+	aead   cipher.AEAD
+	sign   []byte
+}
+
+// Keyring holds the keys per topic prefix and the nonces of the messages it
+// opened within the replay window.
+type Keyring struct {
+	keys   []TopicKey
+	now    func() time.Time
+	lock   sync.Mutex
+	seen   map[string]int64
+	pruned int64
+}
+
+// NewKeyring creates a Keyring from the keys in the configuration
+func NewKeyring(keys map[string]config.PubSubKey) (*Keyring, error) {
+	k := &Keyring{now: time.Now, seen: map[string]int64{}}
+	for prefix, key := range keys {
+		if key.Encrypt == "" && key.Sign == "" {
+			return nil, fmt.Errorf("no keys for %s", prefix)
+		}
+		tk := TopicKey{Prefix: normalizeTopic(prefix)}
+		if key.Encrypt != "" {
+			secret, err := hex.DecodeString(key.Encrypt)
+			if err != nil {
+				return nil, fmt.Errorf("encryption key for %s: %s", prefix, err.Error())
+			}
+			block, err := aes.NewCipher(secret)
+			if err != nil {
+				return nil, fmt.Errorf("encryption key for %s: %s", prefix, err.Error())
+			}
+			if tk.aead, err = cipher.NewGCM(block); err != nil {
+				return nil, err
+			}
+		}
+		if key.Sign != "" {
+			secret, err := hex.DecodeString(key.Sign)
+			if err != nil {
+				return nil, fmt.Errorf("signing key for %s: %s", prefix, err.Error())
+			}
+			if len(secret) < 16 {
+				return nil, fmt.Errorf("signing key for %s should be at least 16 bytes", prefix)
+			}
+			tk.sign = secret
+		}
+		k.keys = append(k.keys, tk)
+	}
+	// The longest prefix comes first so that it wins
+	sort.Slice(k.keys, func(i, j int) bool { return len(k.keys[i].Prefix) > len(k.keys[j].Prefix) })
+	return k, nil
+}
+
+// normalizeTopic returns the MQTT form of a topic with a trailing '/', so
+// that 'state.presence' and 'state/presence/' use the same key.
+func normalizeTopic(topic string) string {
+	topic = strings.Replace(topic, ".", "/", -1)
+	if !strings.HasSuffix(topic, "/") {
+		topic += "/"
+	}
+	return topic
+}
+
+func (k *Keyring) find(topic string) (*TopicKey, string) {
+	if k == nil {
+		return nil, topic
+	}
+	topic = normalizeTopic(topic)
+	for i := range k.keys {
+		if strings.HasPrefix(topic, k.keys[i].Prefix) {
+			return &k.keys[i], topic
+		}
+	}
+	return nil, topic
+}
+
+// bound returns the topic and the time of sealing that a message is bound to
+func bound(topic string, sealed int64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(topic), uint64(sealed))
+}
+
+func (tk *TopicKey) mac(topic string, nonce []byte, sealed int64, data []byte) []byte {
+	h := hmac.New(sha256.New, tk.sign)
+	h.Write(bound(topic, sealed))
+	h.Write(nonce)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// Protects returns true when the messages on 'topic' are sealed, a handler
+// of such a topic only receives messages that carry its key.
+func (k *Keyring) Protects(topic string) bool {
+	tk, _ := k.find(topic)
+	return tk != nil
+}
+
+// Seal encrypts and/or signs the payload when 'topic' is protected
+func (k *Keyring) Seal(topic string, payload []byte) ([]byte, error) {
+	tk, topic := k.find(topic)
+	return tk.seal(topic, payload, k.time())
+}
+
+// SealReply seals the reply to a request on 'channel' with the keys of the
+// channel, a reply can not be passed off as a message on the channel.
+func (k *Keyring) SealReply(channel string, payload []byte) ([]byte, error) {
+	tk, topic := k.find(channel)
+	return tk.seal("reply/"+topic, payload, k.time())
+}
+
+// Open verifies and/or decrypts the payload when 'topic' is protected, a
+// message on a protected topic that is not sealed with its key, that is stale
+// or that was opened before is rejected.
+func (k *Keyring) Open(topic string, data []byte) ([]byte, error) {
+	tk, topic := k.find(topic)
+	return k.open(tk, topic, data)
+}
+
+// OpenReply opens the reply to a request on 'channel'
+func (k *Keyring) OpenReply(channel string, data []byte) ([]byte, error) {
+	tk, topic := k.find(channel)
+	return k.open(tk, "reply/"+topic, data)
+}
+
+func (k *Keyring) open(tk *TopicKey, topic string, data []byte) ([]byte, error) {
+	payload, e, err := tk.open(topic, data)
+	if err != nil || tk == nil {
+		return payload, err
+	}
+	if err := k.fresh(topic, e); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// peek opens a message like Open but does not remember it, so that a test can
+// look at a published message more than once.
+func (k *Keyring) peek(topic string, data []byte) ([]byte, error) {
+	tk, topic := k.find(topic)
+	payload, _, err := tk.open(topic, data)
+	return payload, err
+}
+
+func (k *Keyring) time() int64 {
+	if k == nil {
+		return 0
+	}
+	return k.now().UnixNano()
+}
+
+// fresh rejects a message that is outside of the replay window or whose nonce
+// was seen before, the nonces are forgotten once they are out of the window.
+func (k *Keyring) fresh(topic string, e SecureEnvelope) error {
+	now := k.time()
+	window := int64(ReplayWindow)
+	if e.Time < now-window || e.Time > now+window {
+		return ErrReplayed
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if now-k.pruned > window {
+		for id, sealed := range k.seen {
+			if sealed < now-window {
+				delete(k.seen, id)
+			}
+		}
+		k.pruned = now
+	}
+	id := topic + string(e.Nonce)
+	if _, exists := k.seen[id]; exists {
+		return ErrReplayed
+	}
+	k.seen[id] = e.Time
+	return nil
+}
+
+// seal protects 'payload' with the keys of 'tk' for 'topic' and the time
+// 'sealed', the topic and the time the payload is bound to.
+func (tk *TopicKey) seal(topic string, payload []byte, sealed int64) ([]byte, error) {
+	if tk == nil {
+		return payload, nil
+	}
+	e := SecureEnvelope{Time: sealed, Data: payload}
+	if tk.aead != nil {
+		e.Nonce = make([]byte, tk.aead.NonceSize())
+	} else {
+		e.Nonce = make([]byte, 16)
+	}
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	if tk.aead != nil {
+		e.Data = tk.aead.Seal(nil, e.Nonce, payload, bound(topic, sealed))
+	}
+	if tk.sign != nil {
+		e.MAC = tk.mac(topic, e.Nonce, sealed, e.Data)
+	}
+	return json.Marshal(e)
+}
+
+func (tk *TopicKey) open(topic string, data []byte) ([]byte, SecureEnvelope, error) {
+	var e SecureEnvelope
+	if tk == nil {
+		return data, e, nil
+	}
+	if !bytes.HasPrefix(data, securePrefix) {
+		return nil, e, ErrNotSealed
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, e, err
+	}
+	if len(e.Nonce) == 0 {
+		return nil, e, ErrNotSealed
+	}
+	if tk.sign != nil && !hmac.Equal(e.MAC, tk.mac(topic, e.Nonce, e.Time, e.Data)) {
+		return nil, e, errors.New("message signature is invalid")
+	}
+	if tk.aead != nil {
+		payload, err := tk.aead.Open(nil, e.Nonce, e.Data, bound(topic, e.Time))
+		if err != nil {
+			return nil, e, errors.New("message can not be decrypted")
+		}
+		return payload, e, nil
+	}
+	return e.Data, e, nil
+}
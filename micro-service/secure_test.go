@@ -0,0 +1,223 @@
+package microservice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+var testKeys = map[string]config.PubSubKey{
+	"state/presence/": {Encrypt: "000102030405060708090a0b0c0d0e0f", Sign: "101112131415161718191a1b1c1d1e1f"},
+	"state.sensor":    {Sign: "202122232425262728292a2b2c2d2e2f"},
+}
+
+func TestKeyring(t *testing.T) {
+	k, err := NewKeyring(testKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"name":"phone","state":"home"}`)
+
+	sealed, _ := k.Seal("state/presence/phone/", payload)
+	if bytes.Contains(sealed, []byte("phone")) {
+		t.Errorf("the payload was not encrypted, %s", sealed)
+	}
+	if opened, err := k.Open("state.presence.phone", sealed); err != nil || !bytes.Equal(opened, payload) {
+		t.Errorf("could not open an encrypted message, %v", err)
+	}
+
+	signed, _ := k.Seal("state/sensor/motion/", payload)
+	if opened, err := k.Open("state/sensor/motion/", signed); err != nil || !bytes.Equal(opened, payload) {
+		t.Errorf("could not open a signed message, %v", err)
+	}
+
+	if _, err := k.Open("state/presence/", payload); err != ErrNotSealed {
+		t.Errorf("a plaintext message on a protected topic should be rejected, %v", err)
+	}
+	if _, err := k.Open("state/sensor/door/", signed); err == nil {
+		t.Errorf("a message replayed on another topic should be rejected")
+	}
+	tampered := bytes.Replace(signed, []byte(`"mac":"`), []byte(`"mac":"A`), 1)
+	if _, err := k.Open("state/sensor/motion/", tampered); err == nil {
+		t.Errorf("a tampered message should be rejected")
+	}
+	other, _ := NewKeyring(map[string]config.PubSubKey{"state/presence/": {Encrypt: "0f0e0d0c0b0a09080706050403020100"}})
+	if _, err := other.Open("state/presence/", sealed); err == nil {
+		t.Errorf("a message sealed with another key should be rejected")
+	}
+
+	if opened, _ := k.Open("state/light/", payload); !bytes.Equal(opened, payload) {
+		t.Errorf("a message on an unprotected topic should pass as is")
+	}
+	if _, err := NewKeyring(map[string]config.PubSubKey{"state/": {Sign: "0102"}}); err == nil {
+		t.Errorf("a short signing key should be refused")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	k, _ := NewKeyring(testKeys)
+	now := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	k.now = func() time.Time { return now }
+
+	for _, topic := range []string{"state/presence/phone/", "state/sensor/lock/"} {
+		sealed, _ := k.Seal(topic, []byte("unlock"))
+		if _, err := k.Open(topic, sealed); err != nil {
+			t.Errorf("could not open a message on %s, %v", topic, err)
+		}
+		if _, err := k.Open(topic, sealed); err != ErrReplayed {
+			t.Errorf("a message replayed on %s should be rejected, %v", topic, err)
+		}
+	}
+
+	sealedAt := now
+	sealed, _ := k.Seal("state/sensor/lock/", []byte("unlock"))
+	now = now.Add(ReplayWindow + time.Second)
+	if _, err := k.Open("state/sensor/lock/", sealed); err != ErrReplayed {
+		t.Errorf("a stale message should be rejected, %v", err)
+	}
+	now = now.Add(-2 * (ReplayWindow + time.Second))
+	if _, err := k.Open("state/sensor/lock/", sealed); err != ErrReplayed {
+		t.Errorf("a message from the future should be rejected, %v", err)
+	}
+
+	// The time is part of the seal
+	retimed := bytes.Replace(sealed, []byte(fmt.Sprint(sealedAt.UnixNano())), []byte(fmt.Sprint(now.UnixNano())), 1)
+	if _, err := k.Open("state/sensor/lock/", retimed); err == nil || err == ErrReplayed {
+		t.Errorf("a message with another time should not verify, %v", err)
+	}
+}
+
+func TestSecureService(t *testing.T) {
+	m := New("secure", time.Second)
+	m.Tracing = true
+	m.Keyring, _ = NewKeyring(testKeys)
+	m.Subscribe("state/presence/")
+	m.Register("state/sensor/motion/")
+
+	handled := 0
+	m.RegisterHandler("state/presence/", func(m *Service, topic string, message []byte) bool {
+		handled++
+		m.Pubsub.PublishStr("state/sensor/motion/", "on")
+		return true
+	})
+
+	h := NewHarness(m, time.Now())
+	h.Inject("state/presence/", []byte(`{"state":"home"}`))
+	if handled != 0 || m.Stats.rejected["state/presence/"] != 1 {
+		t.Errorf("a plaintext message should be rejected, handled %d", handled)
+	}
+
+	sealed, _ := m.Keyring.Seal("state/presence/", WrapTrace("0312", []byte(`{"state":"home"}`)))
+	h.Inject("state/presence/", sealed)
+	if handled != 1 {
+		t.Errorf("a sealed message was not handled")
+	}
+	if msgs := h.Pubsub.Messages("state/sensor/motion/"); len(msgs) != 1 || !bytes.HasPrefix(msgs[0].Data, securePrefix) {
+		t.Errorf("the publish was not signed")
+	}
+	if traces := h.Traces("state/sensor/motion/"); len(traces) != 1 || traces[0] != "0312" {
+		t.Errorf("the trace was not propagated through the envelope, %v", traces)
+	}
+	if payload, _ := h.LastPublished("state/sensor/motion/"); string(payload) != "on" {
+		t.Errorf("published '%s', want 'on'", payload)
+	}
+
+	// A raw channel skips the trace envelope, not the seal
+	m.Register("state/presence/raw/")
+	m.SetOptions("state/presence/raw/", transport.Options{Raw: true})
+	m.Pubsub.PublishStr("state/presence/raw/", "home")
+	if msgs := h.Pubsub.Messages("state/presence/raw/"); len(msgs) != 1 || bytes.Contains(msgs[0].Data, []byte("home")) {
+		t.Errorf("a raw channel on a protected topic was not sealed")
+	}
+	if opened, err := m.Keyring.Open("state/presence/raw/", h.Pubsub.Messages("state/presence/raw/")[0].Data); err != nil || string(opened) != "home" {
+		t.Errorf("a raw channel should not get a trace envelope, got '%s' (%v)", opened, err)
+	}
+}
+
+func TestSecureRequest(t *testing.T) {
+	m := New("secure", time.Second)
+	m.Keyring, _ = NewKeyring(testKeys)
+	m.Register("state/presence/get/")
+	m.RegisterResponder("state/presence/phone/", func(m *Service, topic string, request []byte) ([]byte, error) {
+		if string(request) != "where" {
+			return nil, fmt.Errorf("unexpected request '%s'", request)
+		}
+		return []byte("home"), nil
+	})
+
+	h := NewHarness(m, time.Now())
+	reply, err := h.Request("state/presence/phone/", []byte("where"), time.Second)
+	if err != nil || string(reply) != "home" {
+		t.Errorf("expected reply 'home', got '%s' (%v)", reply, err)
+	}
+
+	var sealed []byte
+	h.Bus.Respond("state/presence/get/", func(request []byte) ([]byte, error) {
+		sealed = request
+		return []byte("home"), nil
+	})
+	if _, err := m.Request("state/presence/get/", []byte("phone"), time.Second); err == nil {
+		t.Errorf("a plaintext reply on a protected topic should be rejected")
+	}
+	if bytes.Contains(sealed, []byte("phone")) {
+		t.Errorf("the request was not encrypted, %s", sealed)
+	}
+
+	reply, _ = m.Keyring.SealReply("state/presence/phone/", []byte("home"))
+	if _, err := m.Keyring.Open("state/presence/phone/", reply); err == nil {
+		t.Errorf("a reply should not open as a message on the topic of its request")
+	}
+}
+
+func TestSecureDeadLetter(t *testing.T) {
+	m := New("secure", time.Second)
+	m.Keyring, _ = NewKeyring(testKeys)
+	m.Subscribe("state/presence/")
+	RegisterTypedHandler(m, "state/presence/", func(m *Service, topic string, value map[string]string) bool {
+		return true
+	})
+
+	h := NewHarness(m, time.Now())
+	sealed, _ := m.Keyring.Seal("state/presence/", []byte(`{"phone":`))
+	h.Inject("state/presence/", sealed)
+
+	msgs := h.Pubsub.Messages(DeadLetterTopic("secure"))
+	if len(msgs) != 1 {
+		t.Fatalf("expected a dead letter, got %d", len(msgs))
+	}
+	if bytes.Contains(msgs[0].Data, []byte("phone")) {
+		t.Errorf("the dead letter leaked the payload of a protected topic, %s", msgs[0].Data)
+	}
+}
+
+func TestBadKey(t *testing.T) {
+	keys := config.PubSubKeys
+	defer func() { config.PubSubKeys = keys }()
+	config.PubSubKeys = map[string]config.PubSubKey{"state/presence/": {Encrypt: "00010203"}}
+
+	m := New("secure", time.Second)
+	m.Register("state/presence/")
+	if m.KeyringErr == nil {
+		t.Fatal("a bad key should be an error")
+	}
+	h := NewHarness(m, time.Now())
+	if err := m.Pubsub.PublishStr("state/presence/", "home"); err == nil || len(h.Pubsub.Messages("state/presence/")) != 0 {
+		t.Errorf("a service with a bad key should not publish, %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.Loop(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Loop should not start with a bad key")
+	}
+}
@@ -0,0 +1,93 @@
+package microservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+)
+
+// TracingEnv is the environment variable that turns on Tracing for a
+// service, '1' or 'on'. Tracing is off by default, a consumer that does not
+// know the envelope (e.g. Node-RED) reads the payload as is.
+const TracingEnv = "GOHOME_TRACING"
+
+func tracingFromEnv() bool {
+	switch os.Getenv(TracingEnv) {
+	case "1", "on", "true":
+		return true
+	}
+	return false
+}
+
+// TraceEnvelope carries the trace id of a message, MQTT v3 has no user
+// properties so the payload travels inside the envelope. A trace ties the
+// messages together that follow from each other, e.g. a motion sensor state
+// that makes automation turn on a light. A JSON payload is embedded as is so
+// that the 'payload' of the envelope decodes as the original object, any
+// other payload (e.g. 'on') is base64 encoded in 'data'. Like the request
+// envelope it starts with the 'envelope' marker, a payload of another service
+// that happens to have a 'trace_id' is not unwrapped.
+type TraceEnvelope struct {
+	Convention string          `json:"envelope"`
+	TraceID    string          `json:"trace_id"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Data       []byte          `json:"data,omitempty"`
+}
+
+// TraceConvention marks a TraceEnvelope
+const TraceConvention = "gohome/trace"
+
+var tracePrefix = []byte(`{"envelope":"` + TraceConvention + `","trace_id":`)
+
+// WrapTrace puts 'payload' in a TraceEnvelope
+func WrapTrace(trace string, payload []byte) []byte {
+	id, err := json.Marshal(trace)
+	if err != nil {
+		return payload
+	}
+	if json.Valid(payload) {
+		// Marshal would compact the payload, it is embedded byte for byte
+		data := make([]byte, 0, len(tracePrefix)+len(id)+len(payload)+12)
+		data = append(append(data, tracePrefix...), id...)
+		data = append(append(data, `,"payload":`...), payload...)
+		return append(data, '}')
+	}
+	data, err := json.Marshal(TraceEnvelope{Convention: TraceConvention, TraceID: trace, Data: payload})
+	if err != nil {
+		return payload
+	}
+	return data
+}
+
+// UnwrapTrace returns the trace id and the payload of a message, a message
+// without a TraceEnvelope is returned as is with an empty trace id.
+func UnwrapTrace(data []byte) (trace string, payload []byte) {
+	if !bytes.HasPrefix(data, tracePrefix) {
+		return "", data
+	}
+	var e TraceEnvelope
+	if err := json.Unmarshal(data, &e); err != nil || e.Convention != TraceConvention {
+		return "", data
+	}
+	if len(e.Payload) > 0 {
+		return e.TraceID, e.Payload
+	}
+	return e.TraceID, e.Data
+}
+
+// traced returns the Service that the handlers of a message with 'trace' get,
+// it shares the state of 'm' and publishes continue the trace.
+func (m *Service) traced(trace string) *Service {
+	t := &Service{state: m.state, Pubsub: m.Pubsub, trace: trace}
+	if p, ok := m.Pubsub.(*publisher); ok {
+		t.Pubsub = &publisher{Transport: p.Transport, m: t}
+	}
+	return t
+}
+
+// TraceID returns the trace id of the message that is being handled, a handler
+// can add it to its log lines. Outside of a handler it is empty and every
+// publish starts a new trace.
+func (m *Service) TraceID() string {
+	return m.trace
+}
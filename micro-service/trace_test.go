@@ -0,0 +1,134 @@
+package microservice
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+func TestTracePropagation(t *testing.T) {
+	m := New("trace", time.Second)
+	m.Tracing = true
+	m.Subscribe("state/sensor/motion/")
+	m.Register("state/light/kitchen/")
+	m.Register("state/light/hallway/")
+	m.Register("homeassistant/light/")
+	m.SetOptions("homeassistant/light/", transport.Options{Raw: true})
+
+	seen := ""
+	m.RegisterHandler("state/sensor/motion/", func(m *Service, topic string, message []byte) bool {
+		seen = m.TraceID()
+		m.Pubsub.PublishStr("state/light/kitchen/", "on")
+		m.Pubsub.PublishStr("state/light/hallway/", "on")
+		m.Pubsub.PublishStr("homeassistant/light/", "on")
+		return true
+	})
+
+	h := NewHarness(m, time.Now())
+	h.Inject("state/sensor/motion/", WrapTrace("0312", []byte(`{"motion":true}`)))
+	if seen != "0312" {
+		t.Errorf("the handler saw trace '%s', want '0312'", seen)
+	}
+	if traces := h.Traces("state/light/kitchen/"); len(traces) != 1 || traces[0] != "0312" {
+		t.Errorf("the trace was not propagated, %v", traces)
+	}
+	if payload, _ := h.LastPublished("state/light/kitchen/"); string(payload) != "on" {
+		t.Errorf("published '%s', want 'on'", payload)
+	}
+	if msgs := h.Pubsub.Messages("homeassistant/light/"); string(msgs[0].Data) != "on" {
+		t.Errorf("a raw channel should not be wrapped, published '%s'", msgs[0].Data)
+	}
+
+	// A message without a trace starts a new one, shared by all its publishes
+	h.Inject("state/sensor/motion/", []byte(`{"motion":true}`))
+	kitchen := h.Traces("state/light/kitchen/")
+	hallway := h.Traces("state/light/hallway/")
+	if kitchen[1] == "" || kitchen[1] == "0312" || kitchen[1] != hallway[1] {
+		t.Errorf("expected a new trace shared by both publishes, got %s and %s", kitchen[1], hallway[1])
+	}
+}
+
+func TestConcurrentTraces(t *testing.T) {
+	m := New("trace", time.Second)
+	m.Tracing = true
+	m.Subscribe("state/sensor/+/")
+	m.Register("state/light/kitchen/")
+	m.Register("state/light/hallway/")
+	m.Register("state/light/attic/")
+
+	// Both handlers run at the same time before they publish
+	var running sync.WaitGroup
+	running.Add(2)
+	m.SetConcurrency("state/sensor/+/", 2, 4, Block)
+	m.RegisterHandler("state/sensor/+/", func(m *Service, topic string, message []byte) bool {
+		running.Done()
+		running.Wait()
+		m.Pubsub.PublishStr("state/light/"+string(message)+"/", "on")
+		return true
+	})
+
+	h := NewHarness(m, time.Now())
+	m.receive(transport.Msg{Subject: "state/sensor/kitchen/", Data: WrapTrace("kitchen", []byte("kitchen"))})
+	m.receive(transport.Msg{Subject: "state/sensor/hallway/", Data: WrapTrace("hallway", []byte("hallway"))})
+	running.Wait()
+	m.Pubsub.PublishStr("state/light/attic/", "on")
+	h.Shutdown()
+
+	for _, room := range []string{"kitchen", "hallway"} {
+		if traces := h.Traces("state/light/" + room + "/"); len(traces) != 1 || traces[0] != room {
+			t.Errorf("the publish of the %s handler has trace %v", room, traces)
+		}
+	}
+	if traces := h.Traces("state/light/attic/"); len(traces) != 1 || traces[0] == "kitchen" || traces[0] == "hallway" {
+		t.Errorf("a publish outside of a handler should start a new trace, got %v", traces)
+	}
+}
+
+func TestUnwrapTrace(t *testing.T) {
+	trace, payload := UnwrapTrace(WrapTrace("abc", []byte("aqi")))
+	if trace != "abc" || string(payload) != "aqi" {
+		t.Errorf("got '%s' '%s'", trace, payload)
+	}
+	trace, payload = UnwrapTrace([]byte(`{"name":"aqi"}`))
+	if trace != "" || string(payload) != `{"name":"aqi"}` {
+		t.Errorf("a message without an envelope should be returned as is")
+	}
+	foreign := []byte(`{"trace_id":"abc","payload":{"name":"aqi"}}`)
+	trace, payload = UnwrapTrace(foreign)
+	if trace != "" || string(payload) != string(foreign) {
+		t.Errorf("a payload without the envelope marker should be returned as is, got '%s'", payload)
+	}
+}
+
+func TestTracedJSONPayload(t *testing.T) {
+	payload := []byte(`{"motion": true, "room": "kitchen"}`)
+	data := WrapTrace("0312", payload)
+
+	// A consumer that knows the envelope reads the payload as the original object
+	var e struct {
+		Convention string                 `json:"envelope"`
+		TraceID    string                 `json:"trace_id"`
+		Payload    map[string]interface{} `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Convention != TraceConvention || e.TraceID != "0312" || e.Payload["motion"] != true || e.Payload["room"] != "kitchen" {
+		t.Errorf("the traced payload does not decode as the original object, %s", data)
+	}
+	if trace, unwrapped := UnwrapTrace(data); trace != "0312" || string(unwrapped) != string(payload) {
+		t.Errorf("got '%s' '%s', want the payload byte for byte", trace, unwrapped)
+	}
+
+	// Tracing is off by default, the payload is published as is
+	m := New("trace", time.Second)
+	m.Register("state/sensor/motion/")
+	h := NewHarness(m, time.Now())
+	m.Pubsub.Publish("state/sensor/motion/", payload)
+	if msgs := h.Pubsub.Messages("state/sensor/motion/"); len(msgs) != 1 || string(msgs[0].Data) != string(payload) {
+		t.Errorf("without tracing the payload should be published as is, got %v", msgs)
+	}
+}
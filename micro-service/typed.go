@@ -0,0 +1,105 @@
+package microservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Codec decodes a received payload into a value
+type Codec interface {
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// JSONCodec is the default codec of a service
+var JSONCodec Codec = jsonCodec{}
+
+// Validator is implemented by message types that can check their content
+type Validator interface {
+	Validate() error
+}
+
+// DeadLetter is published on the dead-letter topic of a service when a
+// received payload could not be decoded or did not validate. The payload is
+// left out when it was received on a protected topic.
+type DeadLetter struct {
+	Service string `json:"service"`
+	Topic   string `json:"topic"`
+	Error   string `json:"error"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// DeadLetterTopic returns the topic on which service 'name' publishes malformed messages
+func DeadLetterTopic(name string) string {
+	return "deadletter/" + name + "/"
+}
+
+// RegisterTypedHandler registers a handler that receives the payload decoded
+// into a 'T' using the codec of the service, see RegisterTypedHandlerWithCodec.
+func RegisterTypedHandler[T any](m *Service, topic string, handler func(m *Service, topic string, value T) bool) {
+	RegisterTypedHandlerWithCodec(m, topic, nil, handler)
+}
+
+// RegisterTypedHandlerWithCodec registers a handler that receives the payload
+// decoded into a 'T', when 'T' implements Validator the value is validated.
+// A payload that fails is counted and published on the dead-letter topic of
+// the service together with the error, the handler is not called.
+func RegisterTypedHandlerWithCodec[T any](m *Service, topic string, codec Codec, handler func(m *Service, topic string, value T) bool) {
+	m.RegisterHandler(topic, func(m *Service, topic string, msg []byte) bool {
+		c := codec
+		if c == nil {
+			c = m.Codec
+		}
+		value := new(T)
+		err := c.Unmarshal(msg, value)
+		if err == nil {
+			err = validate(value)
+		}
+		if err != nil {
+			m.deadLetter(topic, msg, err)
+			return true
+		}
+		return handler(m, topic, *value)
+	})
+}
+
+// validate calls Validate on the value, or on the pointer to the value
+func validate[T any](value *T) error {
+	if v, ok := interface{}(*value).(Validator); ok {
+		// e.g. a 'null' payload decoded into a pointer type
+		if rv := reflect.ValueOf(*value); rv.Kind() == reflect.Ptr && rv.IsNil() {
+			return fmt.Errorf("empty message")
+		}
+		return v.Validate()
+	}
+	if v, ok := interface{}(value).(Validator); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+func (m *Service) deadLetter(topic string, msg []byte, err error) {
+	m.lock.Lock()
+	m.DecodeFailures[topic]++
+	m.lock.Unlock()
+	m.Stats.decodeFailedOn(topic)
+	m.Logger.LogError(m.Name, fmt.Sprintf("malformed message on %s: %s", topic, err.Error()))
+
+	letter := DeadLetter{Service: m.Name, Topic: topic, Error: err.Error()}
+	if tk, _ := m.Keyring.find(topic); tk == nil {
+		letter.Payload = string(msg)
+	}
+	data, err := json.Marshal(letter)
+	if err == nil && m.Pubsub != nil {
+		err = m.Pubsub.Publish(DeadLetterTopic(m.Name), data)
+	}
+	if err != nil {
+		m.Logger.LogError("pubsub", err.Error())
+	}
+}
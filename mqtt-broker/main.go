@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jurgen-kluft/go-home/mqtt/broker"
+)
+
+var (
+	configFile = flag.String("config", "broker.config.json", "The JSON configuration file of the broker")
+	listen     = flag.String("listen", "", "The address to listen on, overrides the configuration")
+)
+
+func main() {
+	flag.Parse()
+
+	config, err := broker.LoadConfig(*configFile)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *listen != "" {
+		config.Listen = *listen
+	}
+
+	b, err := broker.New(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		b.Close()
+	}()
+
+	if err := b.ListenAndServe(); err != nil {
+		b.Logger.LogError("broker", err.Error())
+		os.Exit(1)
+	}
+}
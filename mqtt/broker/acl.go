@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"strings"
+
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// ACL lists the topic filters a service may publish on and subscribe to, a
+// filter may contain '{service}' which is replaced by the name of the service.
+type ACL struct {
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+}
+
+// access is the ACL of a connected client with '{service}' resolved, every
+// service may publish its status and receive its own replies. A service may
+// only publish a reply on the response topic of a request it received, see
+// client.expectReply.
+type access struct {
+	publish   []string
+	subscribe []string
+}
+
+func newAccess(acl *ACL, name string, clientID string) *access {
+	if acl == nil {
+		return nil
+	}
+	resolve := func(filters []string) []string {
+		resolved := make([]string, 0, len(filters)+2)
+		for _, f := range filters {
+			resolved = append(resolved, strings.Replace(f, "{service}", name, -1))
+		}
+		return resolved
+	}
+	a := &access{publish: resolve(acl.Publish), subscribe: resolve(acl.Subscribe)}
+	a.publish = append(a.publish, transport.StatusTopic(name))
+	a.subscribe = append(a.subscribe, "reply/"+clientID+"/+")
+	return a
+}
+
+// canPublish returns true when 'topic' matches one of the publish filters,
+// a client without an ACL may publish on any topic.
+func (a *access) canPublish(topic string) bool {
+	if a == nil {
+		return true
+	}
+	for _, f := range a.publish {
+		if matchFilter(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// canSubscribe returns true when every topic that 'filter' matches is
+// matched by one of the subscribe filters.
+func (a *access) canSubscribe(filter string) bool {
+	if a == nil {
+		return true
+	}
+	for _, f := range a.subscribe {
+		if covers(f, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// validFilter checks an MQTT topic filter, wildcards must occupy a whole
+// level and '#' must be the last level.
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" {
+			if i != len(levels)-1 {
+				return false
+			}
+		} else if level != "+" && strings.ContainsAny(level, "+#") {
+			return false
+		}
+	}
+	return true
+}
+
+// matchFilter returns true when 'topic' matches the MQTT filter, unlike
+// transport.MatchTopic only '/' separates the levels. Topics that start with
+// '$' are not matched by a wildcard in the first level.
+func matchFilter(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+	for i, level := range fl {
+		if level == "#" {
+			return true
+		}
+		if i >= len(tl) {
+			return false
+		}
+		if level != "+" && level != tl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
+
+// covers returns true when 'filter' matches every topic that 'requested' matches
+func covers(filter string, requested string) bool {
+	fl := strings.Split(filter, "/")
+	rl := strings.Split(requested, "/")
+	for i, level := range fl {
+		if level == "#" {
+			return true
+		}
+		if i >= len(rl) || rl[i] == "#" {
+			return false
+		}
+		if level == "+" {
+			continue
+		}
+		if level != rl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(rl)
+}
@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// BridgeConfig selects the topics that are forwarded to and from an external
+// broker. Broker has the same entries as the configuration of the mqtt
+// client (e.g. 'mqtt.broker.host', 'mqtt.tls.ca'). The In and Out filters
+// should not overlap, otherwise a message forwarded out comes back in.
+type BridgeConfig struct {
+	Broker map[string]string `json:"broker"`
+	Out    []string          `json:"out"`
+	In     []string          `json:"in"`
+}
+
+type bridge struct {
+	broker *Broker
+	config *BridgeConfig
+	client mqtt.Client
+}
+
+func newBridge(b *Broker, config *BridgeConfig) (*bridge, error) {
+	for _, filter := range append(append([]string{}, config.Out...), config.In...) {
+		if !validFilter(filter) {
+			return nil, fmt.Errorf("bridge filter %s is not valid", filter)
+		}
+	}
+	tlsConfig, err := transport.TLSConfig(config.Broker, "mqtt.", "bridge")
+	if err != nil {
+		return nil, err
+	}
+	scheme := config.Broker["mqtt.broker.scheme"]
+	if scheme == "" {
+		scheme = "tcp"
+	}
+	clientID := "bridge"
+	if prefix := config.Broker["mqtt.broker.clientId"]; prefix != "" {
+		clientID = prefix + "-bridge"
+	}
+
+	br := &bridge{broker: b, config: config}
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("%s://%s:%s", scheme, config.Broker["mqtt.broker.host"], config.Broker["mqtt.broker.port"]))
+	opts.SetClientID(clientID)
+	opts.SetUsername(config.Broker["mqtt.broker.username"])
+	opts.SetPassword(config.Broker["mqtt.broker.password"])
+	opts.SetTLSConfig(tlsConfig)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.OnConnect = func(client mqtt.Client) {
+		b.Logger.LogInfo("broker", "bridge connected")
+		for _, filter := range config.In {
+			if token := client.Subscribe(filter, 1, br.receive); token.Wait() && token.Error() != nil {
+				b.Logger.LogError("broker", fmt.Sprintf("bridge could not subscribe to %s: %s", filter, token.Error()))
+			}
+		}
+	}
+	opts.OnConnectionLost = func(client mqtt.Client, err error) {
+		b.Logger.LogError("broker", "bridge lost the connection: "+err.Error())
+	}
+	br.client = mqtt.NewClient(opts)
+	// With connect retry the client keeps trying in the background
+	br.client.Connect()
+	return br, nil
+}
+
+// receive publishes a message of the external broker on the embedded broker
+func (br *bridge) receive(client mqtt.Client, msg mqtt.Message) {
+	br.broker.route(Message{Topic: msg.Topic(), Payload: msg.Payload(), QoS: msg.Qos(), Retain: msg.Retained()}, true)
+}
+
+// forward publishes a message on the external broker when it matches an Out filter
+func (br *bridge) forward(msg Message) {
+	for _, filter := range br.config.Out {
+		if matchFilter(filter, msg.Topic) {
+			if br.client.IsConnected() {
+				br.client.Publish(msg.Topic, msg.QoS, msg.Retain, msg.Payload)
+			}
+			return
+		}
+	}
+}
+
+func (br *bridge) close() {
+	br.client.Disconnect(100)
+}
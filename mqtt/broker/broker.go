@@ -0,0 +1,354 @@
+// Package broker is an embedded MQTT 3.1.1 broker for a single-box deployment,
+// the services talk to it like to any other broker. Retained messages are
+// persisted, every service can be restricted by an ACL and selected topics can
+// be bridged to an external broker.
+//
+// QoS 2 publishes are accepted but delivered with QoS 1 and sessions are not
+// kept when a client disconnects.
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jurgen-kluft/go-home/logging"
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// Config is the configuration of the broker
+type Config struct {
+	// Listen is the address to accept connections on, e.g. ':1883'
+	Listen string `json:"listen"`
+	// TLSCert and TLSKey enable TLS, with TLSCA a client certificate signed
+	// by that CA is required and its common name is the name of the service.
+	TLSCert string `json:"tls_cert,omitempty"`
+	TLSKey  string `json:"tls_key,omitempty"`
+	TLSCA   string `json:"tls_ca,omitempty"`
+	// Retained is the file the retained messages are persisted in
+	Retained string `json:"retained,omitempty"`
+	// Users maps a username on a password, when empty anyone can connect.
+	// Every service has its own username, it is the name of the service
+	// that its ACL is looked up with.
+	Users map[string]string `json:"users,omitempty"`
+	// ClientPrefix is removed from a client id to get the name of the service,
+	// it is the 'mqtt.broker.clientId' of the services.
+	ClientPrefix string `json:"client_prefix,omitempty"`
+	// ACL maps the name of a service on its ACL, '*' applies to the services
+	// that are not listed. Without any ACL every client may do anything. The
+	// name is the common name of the client certificate or the username, the
+	// client id of an authenticated client must match it. Without users and
+	// client certificates the name comes from the client id, which any
+	// client can choose.
+	ACL map[string]*ACL `json:"acl,omitempty"`
+	// Bridge forwards selected topics to and from an external broker
+	Bridge *BridgeConfig `json:"bridge,omitempty"`
+}
+
+// LoadConfig reads the configuration of the broker from a JSON file
+func LoadConfig(path string) (Config, error) {
+	config := Config{Listen: ":1883"}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	return config, err
+}
+
+// Broker is an MQTT broker
+type Broker struct {
+	Config   Config
+	Logger   *logging.Logger
+	clients  map[string]*client
+	retained map[string]Message
+	listener net.Listener
+	bridge   *bridge
+	lock     sync.RWMutex
+	save     sync.Mutex
+	quit     chan struct{}
+}
+
+// New creates a broker and loads the persisted retained messages
+func New(config Config) (*Broker, error) {
+	b := &Broker{Config: config}
+	b.Logger = logging.New("mqtt-broker")
+	b.Logger.AddEntry("broker")
+	b.clients = make(map[string]*client)
+	b.retained = make(map[string]Message)
+	b.quit = make(chan struct{})
+	if config.Retained != "" {
+		data, err := os.ReadFile(config.Retained)
+		if err == nil {
+			err = json.Unmarshal(data, &b.retained)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("loading retained messages: %s", err.Error())
+		}
+	}
+	return b, nil
+}
+
+// ListenAndServe accepts connections on the configured address until Close is called
+func (b *Broker) ListenAndServe() error {
+	listener, err := net.Listen("tcp", b.Config.Listen)
+	if err != nil {
+		return err
+	}
+	if b.Config.TLSCert != "" {
+		config, err := b.tlsConfig()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, config)
+	}
+	return b.Serve(listener)
+}
+
+func (b *Broker) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(b.Config.TLSCert, b.Config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if b.Config.TLSCA != "" {
+		data, err := os.ReadFile(b.Config.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", b.Config.TLSCA)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// Serve accepts connections on 'listener' until Close is called
+func (b *Broker) Serve(listener net.Listener) error {
+	b.lock.Lock()
+	b.listener = listener
+	b.lock.Unlock()
+	select {
+	case <-b.quit:
+		listener.Close()
+		return nil
+	default:
+	}
+	if b.Config.Bridge != nil {
+		bridge, err := newBridge(b, b.Config.Bridge)
+		if err != nil {
+			return err
+		}
+		b.lock.Lock()
+		b.bridge = bridge
+		b.lock.Unlock()
+	}
+	b.Logger.LogInfo("broker", "listening on "+listener.Addr().String())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-b.quit:
+				return nil
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go b.serve(conn)
+	}
+}
+
+// Close stops accepting connections and disconnects all clients
+func (b *Broker) Close() {
+	b.lock.Lock()
+	select {
+	case <-b.quit:
+		b.lock.Unlock()
+		return
+	default:
+	}
+	close(b.quit)
+	listener, bridge := b.listener, b.bridge
+	clients := make([]*client, 0, len(b.clients))
+	for _, c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.lock.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+	if bridge != nil {
+		bridge.close()
+	}
+	for _, c := range clients {
+		c.conn.Close()
+	}
+}
+
+// serviceName returns the name of the service that connects with 'clientID'
+func (b *Broker) serviceName(clientID string) string {
+	if b.Config.ClientPrefix != "" {
+		return strings.TrimPrefix(clientID, b.Config.ClientPrefix+"-")
+	}
+	return clientID
+}
+
+// identify returns the name of the service a client is, its ACL is looked up
+// with it. An authenticated client, with a certificate or a username, is
+// the service of its credentials and its client id has to match.
+func (b *Broker) identify(conn net.Conn, username string, clientID string, generated bool) (string, error) {
+	identity := ""
+	if tc, ok := conn.(*tls.Conn); ok {
+		if peers := tc.ConnectionState().PeerCertificates; len(peers) > 0 {
+			identity = peers[0].Subject.CommonName
+		}
+	}
+	if identity == "" && len(b.Config.Users) > 0 {
+		identity = username
+	}
+	if identity == "" {
+		return b.serviceName(clientID), nil
+	}
+	if !generated && transport.Identity(b.serviceName(clientID)) != identity {
+		return "", fmt.Errorf("client id %s does not belong to %s", clientID, identity)
+	}
+	return identity, nil
+}
+
+// access returns the ACL of service 'name', nil when there are no ACLs
+func (b *Broker) access(name string, clientID string) *access {
+	if len(b.Config.ACL) == 0 {
+		return nil
+	}
+	acl, exists := b.Config.ACL[name]
+	if !exists {
+		acl, exists = b.Config.ACL["*"]
+	}
+	if !exists {
+		acl = &ACL{}
+	}
+	return newAccess(acl, name, clientID)
+}
+
+// attach registers a connected client, a client with the same id is disconnected
+func (b *Broker) attach(c *client) {
+	b.lock.Lock()
+	previous := b.clients[c.id]
+	b.clients[c.id] = c
+	b.lock.Unlock()
+	if previous != nil {
+		b.Logger.LogInfo("broker", "client "+c.id+" took over an existing session")
+		previous.takenOver()
+	}
+}
+
+func (b *Broker) detach(c *client) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.clients[c.id] == c {
+		delete(b.clients, c.id)
+	}
+}
+
+// Publish routes a message to the subscribers as if a client published it
+func (b *Broker) Publish(msg Message) {
+	b.route(msg, false)
+}
+
+// route delivers a message to the matching subscriptions, a message that came
+// in over the bridge is not forwarded to the bridge again.
+func (b *Broker) route(msg Message, fromBridge bool) {
+	if msg.Retain {
+		b.retain(msg)
+	}
+	b.lock.RLock()
+	clients := make([]*client, 0, len(b.clients))
+	for _, c := range b.clients {
+		clients = append(clients, c)
+	}
+	bridge := b.bridge
+	b.lock.RUnlock()
+
+	e, request := transport.OpenEnvelope(msg.Payload)
+	request = request && e.ResponseTopic != ""
+	for _, c := range clients {
+		if qos, ok := c.subscribed(msg.Topic); ok {
+			if request {
+				c.expectReply(e.ResponseTopic)
+			}
+			c.deliver(msg, qos, false)
+		}
+	}
+	if bridge != nil && !fromBridge {
+		bridge.forward(msg)
+	}
+}
+
+// retain stores or, for an empty payload, removes the retained message of a topic
+func (b *Broker) retain(msg Message) {
+	b.save.Lock()
+	defer b.save.Unlock()
+	b.lock.Lock()
+	if len(msg.Payload) == 0 {
+		if _, exists := b.retained[msg.Topic]; !exists {
+			b.lock.Unlock()
+			return
+		}
+		delete(b.retained, msg.Topic)
+	} else {
+		if r, exists := b.retained[msg.Topic]; exists && r.QoS == msg.QoS && string(r.Payload) == string(msg.Payload) {
+			b.lock.Unlock()
+			return
+		}
+		b.retained[msg.Topic] = Message{Topic: msg.Topic, Payload: msg.Payload, QoS: msg.QoS, Retain: true}
+	}
+	data, err := json.Marshal(b.retained)
+	b.lock.Unlock()
+	if err == nil {
+		err = b.persist(data)
+	}
+	if err != nil {
+		b.Logger.LogError("broker", "persisting retained messages: "+err.Error())
+	}
+}
+
+// persist writes the retained messages to a temporary file that replaces
+// the previous one, a crash never leaves a half written file behind.
+func (b *Broker) persist(data []byte) error {
+	if b.Config.Retained == "" {
+		return nil
+	}
+	tmp := b.Config.Retained + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.Config.Retained)
+}
+
+// Retained returns the retained messages that match 'filter'
+func (b *Broker) Retained(filter string) []Message {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	messages := []Message{}
+	for topic, msg := range b.retained {
+		if matchFilter(filter, topic) {
+			msg.Retain = true
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
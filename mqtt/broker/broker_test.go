@@ -0,0 +1,282 @@
+package broker
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func start(t *testing.T, config Config) (*Broker, string) {
+	b, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Serve(listener)
+	t.Cleanup(b.Close)
+	return b, listener.Addr().String()
+}
+
+func dial(t *testing.T, addr string, id string) mqtt.Client {
+	client, err := dialAs(t, addr, id, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// dialAs connects with a username and password
+func dialAs(t *testing.T, addr string, id string, username string, password string) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://" + addr)
+	opts.SetClientID(id)
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetAutoReconnect(false)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	t.Cleanup(func() { client.Disconnect(10) })
+	return client, nil
+}
+
+// subscribe returns the channel on which the messages of 'filter' arrive and
+// the return code the broker granted the subscription with.
+func subscribe(t *testing.T, client mqtt.Client, filter string) (chan mqtt.Message, byte) {
+	messages := make(chan mqtt.Message, 16)
+	token := client.Subscribe(filter, 1, func(c mqtt.Client, msg mqtt.Message) { messages <- msg })
+	token.Wait()
+	return messages, token.(*mqtt.SubscribeToken).Result()[filter]
+}
+
+func expect(t *testing.T, messages chan mqtt.Message, topic string, payload string) mqtt.Message {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		if msg.Topic() != topic || string(msg.Payload()) != payload {
+			t.Errorf("received %s '%s', want %s '%s'", msg.Topic(), msg.Payload(), topic, payload)
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Errorf("did not receive %s", topic)
+	}
+	return nil
+}
+
+func expectNothing(t *testing.T, messages chan mqtt.Message) {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		t.Errorf("unexpected message on %s", msg.Topic())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	_, addr := start(t, Config{})
+	sensor := dial(t, addr, "sensor")
+	automation := dial(t, addr, "automation")
+
+	messages, _ := subscribe(t, automation, "state/sensor/+/motion")
+	sensor.Publish("state/sensor/kitchen/motion", 1, false, "on").Wait()
+	sensor.Publish("state/sensor/kitchen/door", 0, false, "open").Wait()
+	sensor.Publish("state/sensor/hallway/motion", 0, false, "off").Wait()
+	expect(t, messages, "state/sensor/kitchen/motion", "on")
+	expect(t, messages, "state/sensor/hallway/motion", "off")
+	expectNothing(t, messages)
+
+	automation.Unsubscribe("state/sensor/+/motion").Wait()
+	sensor.Publish("state/sensor/kitchen/motion", 1, false, "on").Wait()
+	expectNothing(t, messages)
+}
+
+func TestRetainedPersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "retained.json")
+	b, addr := start(t, Config{Retained: file})
+	flux := dial(t, addr, "flux")
+	flux.Publish("state/light/flux", 1, true, `{"ct":0.5}`).Wait()
+	flux.Publish("state/light/gone", 1, true, "x").Wait()
+	flux.Publish("state/light/gone", 1, true, "").Wait()
+	b.Close()
+
+	_, addr = start(t, Config{Retained: file})
+	messages, _ := subscribe(t, dial(t, addr, "automation"), "state/light/#")
+	if msg := expect(t, messages, "state/light/flux", `{"ct":0.5}`); msg != nil && !msg.Retained() {
+		t.Errorf("the message should be delivered as retained")
+	}
+	expectNothing(t, messages)
+}
+
+func TestACL(t *testing.T) {
+	_, addr := start(t, Config{
+		ClientPrefix: "gohome",
+		ACL: map[string]*ACL{
+			"aqi": {Publish: []string{"state/{service}/#"}, Subscribe: []string{"config/{service}/#"}},
+			"*":   {Subscribe: []string{"#"}},
+		},
+	})
+	aqi := dial(t, addr, "gohome-aqi")
+	monitor := dial(t, addr, "gohome-monitor")
+
+	if _, code := subscribe(t, aqi, "config/aqi/#"); code != 1 {
+		t.Errorf("subscribing to its own config should be granted, got %d", code)
+	}
+	if _, code := subscribe(t, aqi, "state/#"); code != 0x80 {
+		t.Errorf("subscribing to another topic should be refused, got %d", code)
+	}
+
+	messages, _ := subscribe(t, monitor, "#")
+	aqi.Publish("state/light/kitchen", 1, false, "on").Wait()
+	aqi.Publish("state/aqi", 1, false, "42").Wait()
+	aqi.Publish("service/aqi/status", 1, false, "online").Wait()
+	expect(t, messages, "state/aqi", "42")
+	expect(t, messages, "service/aqi/status", "online")
+	expectNothing(t, messages)
+
+	monitor.Publish("state/aqi", 1, false, "0").Wait()
+	expectNothing(t, messages)
+}
+
+func TestACLSpoofing(t *testing.T) {
+	_, addr := start(t, Config{
+		ClientPrefix: "gohome",
+		Users:        map[string]string{"aqi": "aqi-secret", "monitor": "monitor-secret"},
+		ACL: map[string]*ACL{
+			"aqi": {Publish: []string{"state/{service}/#"}},
+			"*":   {Subscribe: []string{"#"}},
+		},
+	})
+
+	// The monitor can not pass itself off as aqi by choosing its client id
+	if _, err := dialAs(t, addr, "gohome-aqi", "monitor", "monitor-secret"); err == nil {
+		t.Errorf("a client id that does not match the username should be refused")
+	}
+
+	monitor, err := dialAs(t, addr, "gohome-monitor", "monitor", "monitor-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aqi, err := dialAs(t, addr, "gohome-aqi", "aqi", "aqi-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := subscribe(t, monitor, "#")
+	monitor.Publish("state/aqi", 1, false, "0").Wait()
+	aqi.Publish("state/aqi", 1, false, "42").Wait()
+	expect(t, messages, "state/aqi", "42")
+	expectNothing(t, messages)
+}
+
+func TestReplyRights(t *testing.T) {
+	_, addr := start(t, Config{
+		ClientPrefix: "gohome",
+		Users:        map[string]string{"flux": "flux-secret", "config": "config-secret", "aqi": "aqi-secret"},
+		ACL: map[string]*ACL{
+			"flux":   {Publish: []string{"config/get/"}},
+			"config": {Subscribe: []string{"config/#"}},
+			"*":      {},
+		},
+	})
+	flux, _ := dialAs(t, addr, "gohome-flux", "flux", "flux-secret")
+	config, _ := dialAs(t, addr, "gohome-config", "config", "config-secret")
+	aqi, _ := dialAs(t, addr, "gohome-aqi", "aqi", "aqi-secret")
+	if flux == nil || config == nil || aqi == nil {
+		t.Fatal("could not connect")
+	}
+	replies, _ := subscribe(t, flux, "reply/gohome-flux/+")
+	requests, _ := subscribe(t, config, "config/#")
+
+	// Nobody asked aqi for a reply
+	aqi.Publish("reply/gohome-flux/5d1c", 1, false, "spoofed").Wait()
+	expectNothing(t, replies)
+
+	// A request may not ask for a reply on the reply topic of another client
+	aqi.Publish("config/get/", 1, false, `{"envelope":"gohome/mqtt3.1.1","response_topic":"reply/gohome-flux/5d1c","correlation_data":"5d1c","payload":null}`).Wait()
+	expectNothing(t, requests)
+
+	request := `{"envelope":"gohome/mqtt3.1.1","response_topic":"reply/gohome-flux/5d1c","correlation_data":"5d1c","payload":null}`
+	flux.Publish("config/get/", 1, false, request).Wait()
+	expect(t, requests, "config/get/", request)
+	aqi.Publish("reply/gohome-flux/5d1c", 1, false, "spoofed").Wait()
+	config.Publish("reply/gohome-flux/5d1c", 1, false, "{}").Wait()
+	expect(t, replies, "reply/gohome-flux/5d1c", "{}")
+
+	// One reply per request
+	config.Publish("reply/gohome-flux/5d1c", 1, false, "again").Wait()
+	expectNothing(t, replies)
+}
+
+func TestWill(t *testing.T) {
+	_, addr := start(t, Config{})
+	messages, _ := subscribe(t, dial(t, addr, "automation"), "service/+/status")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// CONNECT with a will and a keep alive of 60 seconds
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, 0x02|0x04|0x08, 0, 60)
+	body = appendString(body, "gohome-shout")
+	body = appendString(body, "service/shout/status")
+	body = appendString(body, "offline")
+	conn.Write(encode(CONNECT, 0, body))
+	ack := make([]byte, 4)
+	if _, err := conn.Read(ack); err != nil || ack[3] != Accepted {
+		t.Fatalf("connect was not accepted, %v %v", ack, err)
+	}
+	conn.Close()
+	expect(t, messages, "service/shout/status", "offline")
+}
+
+func TestBridge(t *testing.T) {
+	_, remote := start(t, Config{})
+	host, port, _ := net.SplitHostPort(remote)
+	b, local := start(t, Config{Bridge: &BridgeConfig{
+		Broker: map[string]string{"mqtt.broker.host": host, "mqtt.broker.port": port, "mqtt.broker.clientId": "home"},
+		Out:    []string{"state/#"},
+		In:     []string{"command/#"},
+	}})
+	for i := 0; i < 100; i++ {
+		b.lock.RLock()
+		connected := b.bridge != nil && b.bridge.client.IsConnected()
+		b.lock.RUnlock()
+		if connected {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cloud := dial(t, remote, "cloud")
+	home := dial(t, local, "home")
+	outgoing, _ := subscribe(t, cloud, "state/#")
+	private, _ := subscribe(t, cloud, "private/#")
+	incoming, _ := subscribe(t, home, "command/#")
+
+	home.Publish("state/sensor/door", 1, false, "open").Wait()
+	home.Publish("private/camera", 1, false, "frame").Wait()
+	expect(t, outgoing, "state/sensor/door", "open")
+
+	cloud.Publish("command/light/kitchen", 1, false, "on").Wait()
+	expect(t, incoming, "command/light/kitchen", "on")
+	expectNothing(t, private)
+}
+
+func TestFilters(t *testing.T) {
+	if !matchFilter("sensor/#", "sensor") || !matchFilter("+/+", "a/b") || matchFilter("+/+", "a") || matchFilter("#", "$SYS/uptime") {
+		t.Errorf("matchFilter does not follow the MQTT rules")
+	}
+	if !covers("state/#", "state/+/kitchen") || covers("state/+", "state/#") || covers("state/aqi", "state/+") {
+		t.Errorf("covers does not follow the MQTT rules")
+	}
+	if validFilter("a/#/b") || validFilter("a/b+") || !validFilter("a/+/#") {
+		t.Errorf("validFilter does not follow the MQTT rules")
+	}
+}
@@ -0,0 +1,324 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// The number of packets that can wait to be written to a client, when a
+// client does not keep up the messages for it are dropped.
+const outgoingCapacity = 256
+
+// A client with an ACL may publish one reply on the response topic of a
+// request it received, until the grant expires.
+const replyGrant = 5 * time.Minute
+
+// client is the session of a connected client
+type client struct {
+	broker  *Broker
+	conn    net.Conn
+	id      string
+	name    string
+	access  *access
+	will    *Message
+	subs    map[string]byte
+	pending map[uint16]Message
+	replies map[string]time.Time
+	nextID  uint16
+	out     chan []byte
+	done    chan struct{}
+	once    sync.Once
+	lock    sync.Mutex
+}
+
+// serve runs the session of a connection until it is closed
+func (b *Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	p, err := readPacket(r)
+	if err != nil || p.kind != CONNECT {
+		return
+	}
+	cp, err := decodeConnect(p.body)
+	if err != nil {
+		return
+	}
+	if !(cp.protocol == "MQTT" && cp.level == 4) && !(cp.protocol == "MQIsdp" && cp.level == 3) {
+		conn.Write(encode(CONNACK, 0, []byte{0, RefusedProtocol}))
+		return
+	}
+	generated := cp.clientID == ""
+	if generated {
+		if !cp.clean {
+			conn.Write(encode(CONNACK, 0, []byte{0, RefusedIdentifier}))
+			return
+		}
+		cp.clientID = "auto-" + transport.NewCorrelationID()
+	}
+	if len(b.Config.Users) > 0 {
+		password, exists := b.Config.Users[cp.username]
+		if !exists || subtle.ConstantTimeCompare([]byte(password), []byte(cp.password)) != 1 {
+			b.Logger.LogError("broker", fmt.Sprintf("client %s refused, bad username or password", cp.clientID))
+			conn.Write(encode(CONNACK, 0, []byte{0, RefusedCredentials}))
+			return
+		}
+	}
+
+	name, err := b.identify(conn, cp.username, cp.clientID, generated)
+	if err != nil {
+		b.Logger.LogError("broker", fmt.Sprintf("client %s refused, %s", cp.clientID, err.Error()))
+		conn.Write(encode(CONNACK, 0, []byte{0, RefusedIdentifier}))
+		return
+	}
+
+	c := &client{broker: b, conn: conn, id: cp.clientID, will: cp.will}
+	c.name = name
+	c.access = b.access(c.name, c.id)
+	if c.will != nil && !c.access.canPublish(c.will.Topic) {
+		b.Logger.LogError("broker", fmt.Sprintf("client %s refused, not allowed to publish its will on %s", c.id, c.will.Topic))
+		conn.Write(encode(CONNACK, 0, []byte{0, RefusedUnauthorized}))
+		return
+	}
+	c.subs = make(map[string]byte)
+	c.pending = make(map[uint16]Message)
+	c.replies = make(map[string]time.Time)
+	c.out = make(chan []byte, outgoingCapacity)
+	c.done = make(chan struct{})
+
+	b.attach(c)
+	go c.write()
+	c.send(encode(CONNACK, 0, []byte{0, Accepted}))
+
+	clean := c.read(r, time.Duration(cp.keepAlive)*time.Second)
+	c.close()
+	b.detach(c)
+	c.lock.Lock()
+	will := c.will
+	c.lock.Unlock()
+	if !clean && will != nil {
+		b.route(*will, false)
+	}
+}
+
+// read handles the packets of the client, it returns true when the client
+// disconnected cleanly and its will should not be published.
+func (c *client) read(r *bufio.Reader, keepAlive time.Duration) bool {
+	for {
+		if keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+		p, err := readPacket(r)
+		if err != nil {
+			return false
+		}
+		switch p.kind {
+		case PUBLISH:
+			msg, id, err := decodePublish(p)
+			if err != nil {
+				return false
+			}
+			c.publish(msg, id)
+		case PUBREL:
+			d := &decoder{data: p.body}
+			id := d.uint16()
+			c.lock.Lock()
+			msg, exists := c.pending[id]
+			delete(c.pending, id)
+			c.lock.Unlock()
+			if exists {
+				c.broker.route(msg, false)
+			}
+			c.send(encode(PUBCOMP, 0, appendUint16(nil, id)))
+		case PUBACK:
+			// The broker does not resend, an acknowledgement needs no action
+		case SUBSCRIBE:
+			id, filters, qos, err := decodeSubscribe(p, true)
+			if err != nil {
+				return false
+			}
+			c.subscribe(id, filters, qos)
+		case UNSUBSCRIBE:
+			id, filters, _, err := decodeSubscribe(p, false)
+			if err != nil {
+				return false
+			}
+			c.lock.Lock()
+			for _, filter := range filters {
+				delete(c.subs, filter)
+			}
+			c.lock.Unlock()
+			c.send(encode(UNSUBACK, 0, appendUint16(nil, id)))
+		case PINGREQ:
+			c.send(encode(PINGRESP, 0, nil))
+		case DISCONNECT:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+func (c *client) publish(msg Message, id uint16) {
+	allowed := c.access.canPublish(msg.Topic) || c.replying(msg.Topic)
+	if e, ok := transport.OpenEnvelope(msg.Payload); ok && e.ResponseTopic != "" && c.access != nil {
+		// A request can only ask for a reply on the reply topic of the client
+		allowed = allowed && strings.HasPrefix(e.ResponseTopic, "reply/"+c.id+"/")
+	}
+	if !allowed {
+		c.broker.Logger.LogError("broker", fmt.Sprintf("client %s is not allowed to publish on %s", c.id, msg.Topic))
+	}
+	// MQTT 3.1.1 has no negative acknowledgement, a refused message is
+	// acknowledged and dropped.
+	switch msg.QoS {
+	case 1:
+		c.send(encode(PUBACK, 0, appendUint16(nil, id)))
+	case 2:
+		if allowed {
+			c.lock.Lock()
+			c.pending[id] = msg
+			c.lock.Unlock()
+		}
+		c.send(encode(PUBREC, 0, appendUint16(nil, id)))
+		return
+	}
+	if allowed {
+		c.broker.route(msg, false)
+	}
+}
+
+func (c *client) subscribe(id uint16, filters []string, qos []byte) {
+	granted := make([]byte, len(filters))
+	accepted := map[string]byte{}
+	c.lock.Lock()
+	for i, filter := range filters {
+		if !validFilter(filter) || qos[i] > 2 || !c.access.canSubscribe(filter) {
+			c.broker.Logger.LogError("broker", fmt.Sprintf("client %s is not allowed to subscribe to %s", c.id, filter))
+			granted[i] = 0x80
+			continue
+		}
+		c.subs[filter] = qos[i]
+		granted[i] = qos[i]
+		accepted[filter] = qos[i]
+	}
+	c.lock.Unlock()
+	c.send(encode(SUBACK, 0, append(appendUint16(nil, id), granted...)))
+
+	for filter, q := range accepted {
+		for _, msg := range c.broker.Retained(filter) {
+			c.deliver(msg, q, true)
+		}
+	}
+}
+
+// expectReply allows the client to publish one reply on 'topic', the response
+// topic of a request that is delivered to it.
+func (c *client) expectReply(topic string) {
+	if c.access == nil {
+		return
+	}
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for t, expires := range c.replies {
+		if now.After(expires) {
+			delete(c.replies, t)
+		}
+	}
+	c.replies[topic] = now.Add(replyGrant)
+}
+
+// replying returns true, once, when the client may publish a reply on 'topic'
+func (c *client) replying(topic string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expires, exists := c.replies[topic]
+	delete(c.replies, topic)
+	return exists && time.Now().Before(expires)
+}
+
+// subscribed returns the highest QoS of the subscriptions that match 'topic'
+func (c *client) subscribed(topic string) (byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	qos, found := byte(0), false
+	for filter, q := range c.subs {
+		if matchFilter(filter, topic) {
+			found = true
+			if q > qos {
+				qos = q
+			}
+		}
+	}
+	return qos, found
+}
+
+// deliver sends a message with the lowest QoS of the message and subscription
+func (c *client) deliver(msg Message, qos byte, retained bool) {
+	if msg.QoS < qos {
+		qos = msg.QoS
+	}
+	if qos > 1 {
+		qos = 1
+	}
+	msg.QoS = qos
+	msg.Retain = retained
+	c.lock.Lock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+	c.lock.Unlock()
+	c.send(encodePublish(msg, id))
+}
+
+func (c *client) send(data []byte) {
+	select {
+	case c.out <- data:
+	case <-c.done:
+	default:
+		c.broker.Logger.LogError("broker", fmt.Sprintf("client %s does not keep up, dropped a packet", c.id))
+	}
+}
+
+func (c *client) write() {
+	for {
+		select {
+		case data := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := c.conn.Write(data); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// takenOver disconnects a client whose id is used by a new connection, like
+// a clean disconnect its will is not published.
+func (c *client) takenOver() {
+	c.lock.Lock()
+	c.will = nil
+	c.lock.Unlock()
+	c.close()
+}
@@ -0,0 +1,228 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The MQTT 3.1.1 control packet types
+const (
+	CONNECT     = 1
+	CONNACK     = 2
+	PUBLISH     = 3
+	PUBACK      = 4
+	PUBREC      = 5
+	PUBREL      = 6
+	PUBCOMP     = 7
+	SUBSCRIBE   = 8
+	SUBACK      = 9
+	UNSUBSCRIBE = 10
+	UNSUBACK    = 11
+	PINGREQ     = 12
+	PINGRESP    = 13
+	DISCONNECT  = 14
+)
+
+// The return codes of a CONNACK
+const (
+	Accepted            = 0
+	RefusedProtocol     = 1
+	RefusedIdentifier   = 2
+	RefusedCredentials  = 4
+	RefusedUnauthorized = 5
+)
+
+// MaxPacketSize is the largest packet the broker accepts
+const MaxPacketSize = 1 << 20
+
+var errMalformed = errors.New("malformed packet")
+
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		if i == 4 {
+			return packet{}, errMalformed
+		}
+		length += int(b&127) * multiplier
+		multiplier *= 128
+		if b&128 == 0 {
+			break
+		}
+	}
+	if length > MaxPacketSize {
+		return packet{}, fmt.Errorf("packet of %d bytes is too large", length)
+	}
+	p := packet{kind: header >> 4, flags: header & 15, body: make([]byte, length)}
+	_, err = io.ReadFull(r, p.body)
+	return p, err
+}
+
+func encode(kind byte, flags byte, body []byte) []byte {
+	data := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 128
+		}
+		data = append(data, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(data, body...)
+}
+
+func appendUint16(b []byte, value uint16) []byte {
+	return append(b, byte(value>>8), byte(value))
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUint16(b, uint16(len(s))), s...)
+}
+
+// decoder reads the fields of a packet body, the first error sticks
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.data) < 1 {
+		d.err = errMalformed
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil || len(d.data) < 2 {
+		d.err = errMalformed
+		return 0
+	}
+	value := uint16(d.data[0])<<8 | uint16(d.data[1])
+	d.data = d.data[2:]
+	return value
+}
+
+func (d *decoder) bytes() []byte {
+	n := int(d.uint16())
+	if d.err != nil || len(d.data) < n {
+		d.err = errMalformed
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// Message is a published message
+type Message struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"-"`
+}
+
+type connect struct {
+	protocol  string
+	level     byte
+	clean     bool
+	keepAlive uint16
+	clientID  string
+	username  string
+	password  string
+	will      *Message
+}
+
+func decodeConnect(body []byte) (connect, error) {
+	d := &decoder{data: body}
+	c := connect{}
+	c.protocol = d.string()
+	c.level = d.byte()
+	flags := d.byte()
+	c.keepAlive = d.uint16()
+	c.clientID = d.string()
+	c.clean = flags&0x02 != 0
+	if flags&0x04 != 0 {
+		c.will = &Message{QoS: (flags >> 3) & 3, Retain: flags&0x20 != 0}
+		c.will.Topic = d.string()
+		c.will.Payload = d.bytes()
+	}
+	if flags&0x80 != 0 {
+		c.username = d.string()
+	}
+	if flags&0x40 != 0 {
+		c.password = d.string()
+	}
+	return c, d.err
+}
+
+func decodePublish(p packet) (Message, uint16, error) {
+	d := &decoder{data: p.body}
+	msg := Message{QoS: (p.flags >> 1) & 3, Retain: p.flags&1 != 0}
+	msg.Topic = d.string()
+	var id uint16
+	if msg.QoS > 0 {
+		id = d.uint16()
+	}
+	if d.err != nil || msg.QoS > 2 {
+		return msg, 0, errMalformed
+	}
+	msg.Payload = d.data
+	return msg, id, nil
+}
+
+func encodePublish(msg Message, id uint16) []byte {
+	flags := msg.QoS << 1
+	if msg.Retain {
+		flags |= 1
+	}
+	body := appendString(nil, msg.Topic)
+	if msg.QoS > 0 {
+		body = appendUint16(body, id)
+	}
+	return encode(PUBLISH, flags, append(body, msg.Payload...))
+}
+
+// decodeSubscribe returns the filters and their QoS of a SUBSCRIBE, or only
+// the filters of an UNSUBSCRIBE.
+func decodeSubscribe(p packet, withQoS bool) (uint16, []string, []byte, error) {
+	d := &decoder{data: p.body}
+	id := d.uint16()
+	filters := []string{}
+	qos := []byte{}
+	for d.err == nil && len(d.data) > 0 {
+		filters = append(filters, d.string())
+		if withQoS {
+			qos = append(qos, d.byte())
+		}
+	}
+	if d.err == nil && len(filters) == 0 {
+		d.err = errMalformed
+	}
+	return id, filters, qos, d.err
+}
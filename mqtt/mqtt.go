@@ -1,12 +1,19 @@
 package pubsub
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jurgen-kluft/go-home/transport"
 )
 
 type AtomInt int32
@@ -19,21 +26,37 @@ func (b *AtomInt) Get() int32 {
 	return atomic.LoadInt32((*int32)(b))
 }
 
-type Msg struct {
-	Subject string
-	Data    []byte
-}
-
 // Context contains the necessary information to run the MQTT client
 type Context struct {
 	Config        map[string]string
-	InMsgs        chan Msg
+	InMsgs        chan transport.Msg
 	SubToIndex    map[string]int
 	SubChannels   []string
+	PubChannels   []string
+	Options       map[string]transport.Options
+	Default       transport.Options
+	ClientOptions *mqtt.ClientOptions
+	StatusTopic   string
+	ClientID      string
+	ReplyFilter   string
+	Pending       map[string]chan transport.Envelope
+	PendingLock   sync.Mutex
 	Client        mqtt.Client
 	Connected     *AtomInt
 	TickFrequency time.Duration
-	Tick          Msg
+	Tick          transport.Msg
+	// DropNewest drops an incoming message when InMsgs is full, by default
+	// the oldest message in InMsgs is dropped to make room. The paho
+	// callbacks never block, a blocked callback stalls the whole client.
+	DropNewest bool
+	dropped    uint64
+	// done stops the ticker of the connection
+	done chan struct{}
+	// lock guards the channels, their options and ReplyFilter, handlers on
+	// worker pools publish and request while paho (re)subscribes.
+	lock sync.Mutex
+	// replyLock makes concurrent requests subscribe to the replies once
+	replyLock sync.Mutex
 }
 
 func New(config map[string]string, tickFrequency time.Duration) *Context {
@@ -41,60 +64,209 @@ func New(config map[string]string, tickFrequency time.Duration) *Context {
 	ctx.Config = config
 	ctx.SubToIndex = make(map[string]int)
 	ctx.SubChannels = make([]string, 0, 10)
+	ctx.PubChannels = make([]string, 0, 10)
+	ctx.Options = make(map[string]transport.Options)
+	ctx.Pending = make(map[string]chan transport.Envelope)
+	if qos, err := strconv.Atoi(config["mqtt.qos"]); err == nil && qos >= 0 && qos <= 2 {
+		ctx.Default.QoS = byte(qos)
+	}
+	// 'mqtt.overflow' is 'drop-oldest' (default) or 'drop-newest'
+	ctx.DropNewest = config["mqtt.overflow"] == "drop-newest"
 	ctx.Connected = new(AtomInt)
 	ctx.Connected.Set(-1)
 	ctx.TickFrequency = tickFrequency
-	ctx.Tick = Msg{Subject: "tick", Data: []byte("do your thing")}
+	ctx.Tick = transport.Msg{Subject: "tick", Data: []byte("do your thing")}
 
-	var broker = config["mqtt.broker.host"]
-	var port = config["mqtt.broker.port"]
+	// The scheme is 'tcp' (default), 'ssl' or 'tls' for MQTT over TLS and 'ws'
+	// or 'wss' for MQTT over (secure) websockets.
+	var scheme = config["mqtt.broker.scheme"]
+	if scheme == "" {
+		scheme = "tcp"
+	}
+	var broker = fmt.Sprintf("%s://%s:%s", scheme, config["mqtt.broker.host"], config["mqtt.broker.port"])
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", broker, port))
-	opts.SetClientID(config["mqtt.broker.clientId"])
-	opts.SetUsername(config["mqtt.broker.username"])
-	opts.SetPassword(config["mqtt.broker.password"])
-	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {})
+	opts.AddBroker(broker)
+	opts.SetDefaultPublishHandler(ctx.onMessage)
 
 	opts.OnConnect = func(client mqtt.Client) {
-		msg := Msg{Subject: "client/connected", Data: []byte(fmt.Sprintf("tcp://%s:%s", broker, port))}
-		if ctx.Connected.Get() == -1 {
-			// subscribe to all registered topics
-			for _, channel := range ctx.SubChannels {
-				subschannel := strings.Replace(channel, ".", "/", -1)
-				subschannel = strings.TrimSuffix(subschannel, "/")
-				subschannel = strings.TrimPrefix(subschannel, "/")
-				if err := ctx.Subscribe(subschannel); err != nil {
-					fmt.Printf("Error subscribing to %s: %v\n", subschannel, err)
-				}
+		msg := transport.Msg{Subject: "client/connected", Data: []byte(broker)}
+		// (re)subscribe to all subscribed topics
+		ctx.lock.Lock()
+		channels := append([]string{}, ctx.SubChannels...)
+		replyFilter := ctx.ReplyFilter
+		ctx.lock.Unlock()
+		for _, channel := range channels {
+			if token := client.Subscribe(channel, ctx.options(channel).QoS, ctx.onMessage); token.Wait() && token.Error() != nil {
+				fmt.Printf("Error subscribing to %s: %v\n", channel, token.Error())
 			}
 		}
+		if replyFilter != "" {
+			client.Subscribe(replyFilter, 1, ctx.onReply)
+		}
+		// Birth message, the counterpart of the last-will
+		client.Publish(ctx.StatusTopic, 1, true, []byte(transport.StatusOnline))
 		ctx.Connected.Set(1)
-		ctx.InMsgs <- msg
+		ctx.deliver(msg, false)
 	}
 
 	opts.OnConnectionLost = func(client mqtt.Client, err error) {
 		ctx.Connected.Set(0)
-		msg := Msg{Subject: "client/disconnected"}
-		ctx.InMsgs <- msg
+		msg := transport.Msg{Subject: "client/disconnected"}
+		ctx.deliver(msg, false)
 	}
 
-	ctx.Client = mqtt.NewClient(opts)
+	ctx.ClientOptions = opts
 
 	return ctx
 }
 
-func (ctx *Context) Topic(msg Msg) string {
+func (ctx *Context) onMessage(client mqtt.Client, msg mqtt.Message) {
+	// Our channels end with a '/', MQTT topics do not
+	in := transport.Msg{Subject: msg.Topic() + "/", Data: msg.Payload()}
+	if e, ok := transport.OpenEnvelope(msg.Payload()); ok && e.ResponseTopic != "" {
+		in.Data = e.Payload
+		in.Reply = e.ResponseTopic
+		in.Correlation = e.CorrelationData
+	}
+	ctx.deliver(in, ctx.DropNewest)
+}
+
+// deliver puts 'msg' in InMsgs without blocking, when InMsgs is full the
+// oldest message or, with 'dropNewest', 'msg' itself is dropped. The state of
+// the connection is never dropped, it makes room by dropping the oldest.
+func (ctx *Context) deliver(msg transport.Msg, dropNewest bool) {
+	for {
+		select {
+		case ctx.InMsgs <- msg:
+			return
+		default:
+		}
+		atomic.AddUint64(&ctx.dropped, 1)
+		if dropNewest {
+			return
+		}
+		select {
+		case <-ctx.InMsgs:
+		default:
+		}
+	}
+}
+
+// Dropped returns the number of incoming messages that were dropped because
+// InMsgs was full.
+func (ctx *Context) Dropped() uint64 {
+	return atomic.LoadUint64(&ctx.dropped)
+}
+
+// onReply receives the replies to our requests, they do not go through
+// InMsgs so that a request made from a handler can not block itself.
+func (ctx *Context) onReply(client mqtt.Client, msg mqtt.Message) {
+	e, ok := transport.OpenEnvelope(msg.Payload())
+	if !ok {
+		return
+	}
+	ctx.PendingLock.Lock()
+	reply, exists := ctx.Pending[e.CorrelationData]
+	delete(ctx.Pending, e.CorrelationData)
+	ctx.PendingLock.Unlock()
+	if exists {
+		reply <- e
+	}
+}
+
+// options returns the delivery options of an MQTT topic (filter)
+func (ctx *Context) options(topic string) transport.Options {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if o, exists := ctx.Options[topic]; exists {
+		return o
+	}
+	return ctx.Default
+}
+
+// SetOptions sets the QoS and retain flag used for publishing on and subscribing to 'channel'
+func (ctx *Context) SetOptions(channel string, options transport.Options) error {
+	if options.QoS > 2 {
+		return fmt.Errorf("PubSub.SetOptions failed for channel %s, QoS %d is not valid", channel, options.QoS)
+	}
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.Options[toFilter(channel)] = options
+	return nil
+}
+
+// topic returns the MQTT topic of a registered channel
+func (ctx *Context) topic(channel string) (string, bool) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	index, exists := ctx.SubToIndex[channel]
+	if !exists {
+		return "", false
+	}
+	return ctx.PubChannels[index], true
+}
+
+func (ctx *Context) Topic(msg transport.Msg) string {
 	return msg.Subject
 }
 
-func (ctx *Context) Payload(msg Msg) []byte {
+func (ctx *Context) Payload(msg transport.Msg) []byte {
 	return msg.Data
 }
 
+// credentials sets the username and password of 'service', the username and
+// 'mqtt.broker.password.file' may contain '{service}' so that every service
+// has its own credential, the broker ACL of a service is bound to it.
+func (ctx *Context) credentials(service string) error {
+	identity := transport.Identity(service)
+	ctx.ClientOptions.SetUsername(strings.Replace(ctx.Config["mqtt.broker.username"], "{service}", identity, -1))
+	password := ctx.Config["mqtt.broker.password"]
+	if file := ctx.Config["mqtt.broker.password.file"]; file != "" {
+		data, err := os.ReadFile(strings.Replace(file, "{service}", identity, -1))
+		if err != nil {
+			return fmt.Errorf("MQTT password: %s", err.Error())
+		}
+		password = strings.TrimSpace(string(data))
+	}
+	ctx.ClientOptions.SetPassword(password)
+	return nil
+}
+
+// Incoming returns the channel on which received messages are delivered
+func (ctx *Context) Incoming() <-chan transport.Msg {
+	return ctx.InMsgs
+}
+
 func (ctx *Context) Connect(username string, register, subscribe []string) error {
 	var err error
 
-	ctx.InMsgs = make(chan Msg, 128)
+	ctx.InMsgs = make(chan transport.Msg, 128)
+
+	// Every service needs its own session on the broker, the last-will
+	// will mark the service as offline when the connection is lost.
+	clientID := username
+	if prefix := ctx.Config["mqtt.broker.clientId"]; prefix != "" {
+		clientID = prefix + "-" + username
+	}
+	ctx.StatusTopic = transport.StatusTopic(username)
+	ctx.ClientID = clientID
+	ctx.ClientOptions.SetClientID(clientID)
+	ctx.ClientOptions.SetWill(ctx.StatusTopic, transport.StatusOffline, 1, true)
+	if err := ctx.credentials(username); err != nil {
+		return err
+	}
+
+	// Every service can present its own client certificate to the broker
+	tlsConfig, err := transport.TLSConfig(ctx.Config, "mqtt.", username)
+	if err != nil {
+		return err
+	}
+	if tlsConfig == nil && secureScheme(ctx.Config["mqtt.broker.scheme"]) {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	ctx.ClientOptions.SetTLSConfig(tlsConfig)
+	ctx.Client = mqtt.NewClient(ctx.ClientOptions)
+
 	for _, s := range subscribe {
 		err := ctx.Subscribe(s)
 		if err != nil {
@@ -102,62 +274,215 @@ func (ctx *Context) Connect(username string, register, subscribe []string) error
 		}
 	}
 
+	// The subscriptions are made in the OnConnect handler
+	token := ctx.Client.Connect()
+	if token.Wait() && token.Error() != nil {
+		err = token.Error()
+	}
+
 	if err == nil {
 		for _, r := range register {
 			ctx.Register(r)
 		}
 
-		go func() {
-			for ctx.Connected.Get() == 1 {
-				time.Sleep(time.Duration(1) * time.Second)
-				ctx.InMsgs <- ctx.Tick
-			}
-		}()
+		ctx.done = make(chan struct{})
+		go transport.Ticker(ctx.TickFrequency, ctx.Tick, ctx.InMsgs, ctx.done)
 	}
 
 	return err
 }
 
+func secureScheme(scheme string) bool {
+	switch scheme {
+	case "ssl", "tls", "mqtts", "wss":
+		return true
+	}
+	return false
+}
+
+// Close publishes the offline status and disconnects, it can be called more than once
 func (ctx *Context) Close() {
+	if ctx.done != nil {
+		close(ctx.done)
+		ctx.done = nil
+	}
+	if ctx.Client == nil {
+		return
+	}
+	if ctx.Connected.Get() == 1 {
+		// A clean disconnect does not trigger the last-will
+		token := ctx.Client.Publish(ctx.StatusTopic, 1, true, []byte(transport.StatusOffline))
+		token.WaitTimeout(time.Second)
+	}
 	ctx.Connected.Set(0)
 	ctx.Client.Disconnect(100)
 	ctx.Client = nil
-	time.Sleep(1)
 }
 
-func (ctx *Context) Register(channel string) error {
-	return nil
+func toTopic(channel string) string {
+	topic := strings.Replace(channel, ".", "/", -1)
+	topic = strings.TrimSuffix(topic, "/")
+	topic = strings.TrimPrefix(topic, "/")
+	return topic
 }
 
-func (ctx *Context) Subscribe(channel string) (err error) {
+// toFilter converts a channel into an MQTT topic filter, a '*' chapter becomes '+'
+func toFilter(channel string) string {
+	chapters := strings.Split(toTopic(channel), "/")
+	for i, chapter := range chapters {
+		if chapter == transport.SingleLevel2 {
+			chapters[i] = transport.SingleLevel
+		}
+	}
+	return strings.Join(chapters, "/")
+}
+
+func (ctx *Context) Register(channel string) error {
+	if transport.HasWildcard(channel) {
+		return fmt.Errorf("PubSub.Register failed, cannot publish on wildcard channel %s", channel)
+	}
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
 	_, exists := ctx.SubToIndex[channel]
 	if !exists {
-		sub := strings.Replace(channel, ".", "/", -1)
-		sub = strings.TrimSuffix(sub, "/")
-		sub = strings.TrimPrefix(sub, "/")
-		ctx.Client.Subscribe(sub, 0, nil)
-		index := len(ctx.SubChannels)
+		index := len(ctx.PubChannels)
 		ctx.SubToIndex[channel] = index
-		ctx.SubChannels = append(ctx.SubChannels, sub)
+		ctx.PubChannels = append(ctx.PubChannels, toTopic(channel))
+	}
+	return nil
+}
+
+func (ctx *Context) Subscribe(channel string) (err error) {
+	if err = transport.ValidateFilter(channel); err != nil {
 		return err
 	}
-	return fmt.Errorf("PubSub.Subscribe failed for channel %s", channel)
+	sub := toFilter(channel)
+	ctx.lock.Lock()
+	for _, s := range ctx.SubChannels {
+		if s == sub {
+			ctx.lock.Unlock()
+			return fmt.Errorf("PubSub.Subscribe failed for channel %s", channel)
+		}
+	}
+	ctx.SubChannels = append(ctx.SubChannels, sub)
+	ctx.lock.Unlock()
+	if ctx.Connected.Get() == 1 {
+		if token := ctx.Client.Subscribe(sub, ctx.options(sub).QoS, ctx.onMessage); token.Wait() && token.Error() != nil {
+			err = token.Error()
+		}
+	}
+	if !transport.HasWildcard(channel) {
+		ctx.Register(channel)
+	}
+	return err
 }
 
 func (ctx *Context) PublishStr(channel string, message string) error {
-	index, exists := ctx.SubToIndex[channel]
+	return ctx.Publish(channel, []byte(message))
+}
+
+func (ctx *Context) Publish(channel string, message []byte) error {
+	topic, exists := ctx.topic(channel)
+	if exists && ctx.Connected.Get() != 1 {
+		return fmt.Errorf("PubSub.Publish failed for channel %s: %w", channel, transport.ErrNotConnected)
+	}
 	if exists {
-		ctx.Client.Publish(ctx.SubChannels[index], 0, false, []byte(message))
+		o := ctx.options(topic)
+		ctx.Client.Publish(topic, o.QoS, o.Retain, message)
 		return nil
 	}
 	return fmt.Errorf("PubSub.Publish failed for channel %s", channel)
 }
 
-func (ctx *Context) Publish(channel string, message []byte) error {
-	index, exists := ctx.SubToIndex[channel]
-	if exists {
-		ctx.Client.Publish(ctx.SubChannels[index], 0, false, message)
+// PublishTTL publishes the message, MQTT v3 has no message expiry so the ttl is ignored
+func (ctx *Context) PublishTTL(channel string, message []byte, ttl int) error {
+	return ctx.Publish(channel, message)
+}
+
+// Request publishes 'message' on 'channel' and waits for the reply. MQTT v3.1.1
+// has no response-topic nor correlation-data so both travel in a
+// transport.Envelope, see mqtt/topics.md.
+func (ctx *Context) Request(channel string, message []byte, timeout time.Duration) ([]byte, error) {
+	topic, exists := ctx.topic(channel)
+	if !exists {
+		return nil, fmt.Errorf("PubSub.Request failed for channel %s", channel)
+	}
+	if ctx.Connected.Get() != 1 {
+		return nil, fmt.Errorf("PubSub.Request failed for channel %s, not connected", channel)
+	}
+	if err := ctx.subscribeReplies(); err != nil {
+		return nil, err
+	}
+
+	correlation := transport.NewCorrelationID()
+	reply := make(chan transport.Envelope, 1)
+	ctx.PendingLock.Lock()
+	ctx.Pending[correlation] = reply
+	ctx.PendingLock.Unlock()
+	defer func() {
+		ctx.PendingLock.Lock()
+		delete(ctx.Pending, correlation)
+		ctx.PendingLock.Unlock()
+	}()
+
+	request := transport.Envelope{Convention: transport.EnvelopeConvention, ResponseTopic: "reply/" + ctx.ClientID + "/" + correlation, CorrelationData: correlation, Payload: message}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	if token := ctx.Client.Publish(topic, 1, false, data); !token.WaitTimeout(timeout) {
+		return nil, transport.ErrTimeout
+	} else if token.Error() != nil {
+		return nil, fmt.Errorf("PubSub.Request failed for channel %s: %w", channel, token.Error())
+	}
+
+	select {
+	case e := <-reply:
+		if e.Error != "" {
+			return e.Payload, errors.New(e.Error)
+		}
+		return e.Payload, nil
+	case <-time.After(timeout):
+		return nil, transport.ErrTimeout
+	}
+}
+
+// subscribeReplies subscribes to the replies to our requests, once
+func (ctx *Context) subscribeReplies() error {
+	ctx.replyLock.Lock()
+	defer ctx.replyLock.Unlock()
+	ctx.lock.Lock()
+	subscribed := ctx.ReplyFilter != ""
+	ctx.lock.Unlock()
+	if subscribed {
 		return nil
 	}
-	return fmt.Errorf("PubSub.Publish failed for channel %s", channel)
+	filter := "reply/" + ctx.ClientID + "/+"
+	if token := ctx.Client.Subscribe(filter, 1, ctx.onReply); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	ctx.lock.Lock()
+	ctx.ReplyFilter = filter
+	ctx.lock.Unlock()
+	return nil
+}
+
+// Reply sends the reply (or the error) to a request that we received
+func (ctx *Context) Reply(request transport.Msg, message []byte, err error) error {
+	if request.Reply == "" {
+		return fmt.Errorf("PubSub.Reply failed, message on %s is not a request", request.Subject)
+	}
+	if ctx.Connected.Get() != 1 || ctx.Client == nil {
+		return fmt.Errorf("PubSub.Reply failed for %s: %w", request.Reply, transport.ErrNotConnected)
+	}
+	e := transport.Envelope{Convention: transport.EnvelopeConvention, CorrelationData: request.Correlation, Payload: message}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx.Client.Publish(request.Reply, 1, false, data)
+	return nil
 }
@@ -0,0 +1,268 @@
+package pubsub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport"
+	"github.com/jurgen-kluft/go-home/transport/tlstest"
+)
+
+// serveMQTT is a broker stand-in that accepts the connection and acknowledges
+// subscriptions and publishes, it does not route any messages.
+func serveMQTT(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, multiplier := 0, 1
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			length += int(b&127) * multiplier
+			multiplier *= 128
+			if b&128 == 0 {
+				break
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT
+			conn.Write([]byte{0x20, 2, 0, 0})
+		case 3: // PUBLISH
+			if (header>>1)&3 == 1 {
+				n := int(body[0])<<8 | int(body[1])
+				conn.Write([]byte{0x40, 2, body[2+n], body[3+n]})
+			}
+		case 8: // SUBSCRIBE
+			granted := []byte{}
+			for i := 2; i+2 <= len(body); {
+				i += 2 + (int(body[i])<<8 | int(body[i+1])) + 1
+				granted = append(granted, 0)
+			}
+			conn.Write(append([]byte{0x90, byte(2 + len(granted)), body[0], body[1]}, granted...))
+		case 12: // PINGREQ
+			conn.Write([]byte{0xd0, 0})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca, err := tlstest.NewCA("gohome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := ca.ServerConfig()
+	dir := t.TempDir()
+	caFile, _ := ca.WriteCA(dir)
+	ca.WriteClient(dir, "tv-bravia")
+
+	clients := make(chan string, 8)
+	listener, err := tlstest.Listen(func(conn net.Conn) {
+		tc, name, err := tlstest.Handshake(conn, server)
+		if err != nil {
+			return
+		}
+		clients <- name
+		serveMQTT(tc)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	connect := func(entries map[string]string) error {
+		cfg := map[string]string{
+			"mqtt.broker.scheme": "ssl",
+			"mqtt.broker.host":   "127.0.0.1",
+			"mqtt.broker.port":   port,
+			"mqtt.tls.ca":        caFile,
+			"mqtt.tls.cert":      filepath.Join(dir, "{service}.pem"),
+			"mqtt.tls.key":       filepath.Join(dir, "{service}.key"),
+		}
+		for k, v := range entries {
+			cfg[k] = v
+		}
+		ctx := New(cfg, time.Hour)
+		defer ctx.Close()
+		return ctx.Connect("tv/bravia", nil, []string{"state/tv/bravia/"})
+	}
+
+	if err := connect(map[string]string{"mqtt.tls.pin": transport.PublicKeyPin(ca.Cert)}); err != nil {
+		t.Fatalf("mutual TLS connect failed, %v", err)
+	}
+	if name := <-clients; name != "tv-bravia" {
+		t.Errorf("the broker saw client certificate '%s', want 'tv-bravia'", name)
+	}
+
+	other, _ := tlstest.NewCA("other")
+	otherFile, _ := other.WriteCA(t.TempDir())
+	if err := connect(map[string]string{"mqtt.tls.ca": otherFile}); err == nil {
+		t.Errorf("a broker certificate from another CA should be refused")
+	}
+	if err := connect(map[string]string{"mqtt.tls.pin": strings.Repeat("00", 32)}); err == nil {
+		t.Errorf("a broker that does not match the pinned key should be refused")
+	}
+	if err := connect(map[string]string{"mqtt.tls.cert": "", "mqtt.tls.key": ""}); err == nil {
+		t.Errorf("the broker should refuse a client without a certificate")
+	}
+	if err := connect(map[string]string{"mqtt.tls.key": ""}); err == nil || !strings.Contains(err.Error(), "needs both") {
+		t.Errorf("a certificate without a key should be an error, %v", err)
+	}
+}
+
+// message is an incoming MQTT message as paho hands it to a handler
+type message struct {
+	topic   string
+	payload []byte
+}
+
+func (m *message) Duplicate() bool   { return false }
+func (m *message) Qos() byte         { return 0 }
+func (m *message) Retained() bool    { return false }
+func (m *message) Topic() string     { return m.topic }
+func (m *message) MessageID() uint16 { return 0 }
+func (m *message) Payload() []byte   { return m.payload }
+func (m *message) Ack()              {}
+
+func TestRequestEnvelope(t *testing.T) {
+	ctx := New(map[string]string{}, time.Hour)
+	ctx.InMsgs = make(chan transport.Msg, 8)
+
+	// A JSON payload that looks like an MQTT v5 style envelope is not a request
+	lookalike := `{"response_topic":"state/tv/","correlation_data":"1","payload":"b24="}`
+	ctx.onMessage(nil, &message{topic: "state/sensor/tv", payload: []byte(lookalike)})
+	msg := <-ctx.InMsgs
+	if msg.Reply != "" || string(msg.Data) != lookalike {
+		t.Errorf("a normal JSON payload was taken for a request, reply '%s', data '%s'", msg.Reply, string(msg.Data))
+	}
+
+	request := `{"envelope":"` + transport.EnvelopeConvention + `","response_topic":"reply/tv/1","correlation_data":"1","payload":"b24="}`
+	ctx.onMessage(nil, &message{topic: "tv/state", payload: []byte(request)})
+	msg = <-ctx.InMsgs
+	if msg.Reply != "reply/tv/1" || msg.Correlation != "1" || string(msg.Data) != "on" {
+		t.Errorf("expected a request with reply topic reply/tv/1, got %+v", msg)
+	}
+
+	// An envelope with fields that are not part of the convention is not a request
+	extra := `{"envelope":"` + transport.EnvelopeConvention + `","response_topic":"reply/tv/1","correlation_data":"1","payload":"b24=","state":"on"}`
+	ctx.onMessage(nil, &message{topic: "tv/state", payload: []byte(extra)})
+	if msg = <-ctx.InMsgs; msg.Reply != "" || string(msg.Data) != extra {
+		t.Errorf("a payload with unknown fields was taken for a request, %+v", msg)
+	}
+
+	if err := ctx.Reply(transport.Msg{Subject: "tv/state/", Reply: "reply/tv/1", Correlation: "1"}, []byte("on"), nil); err == nil {
+		t.Error("a reply without a connection should fail")
+	}
+}
+
+func TestFullInMsgs(t *testing.T) {
+	ctx := New(map[string]string{}, time.Hour)
+	ctx.InMsgs = make(chan transport.Msg, 2)
+	for _, payload := range []string{"1", "2", "3", "4"} {
+		ctx.onMessage(nil, &message{topic: "state/sensor/sun", payload: []byte(payload)})
+	}
+	if ctx.Dropped() != 2 {
+		t.Errorf("expected 2 dropped messages, got %d", ctx.Dropped())
+	}
+	if a, b := <-ctx.InMsgs, <-ctx.InMsgs; string(a.Data) != "3" || string(b.Data) != "4" {
+		t.Errorf("drop-oldest should keep the newest messages, got %s and %s", string(a.Data), string(b.Data))
+	}
+
+	ctx = New(map[string]string{"mqtt.overflow": "drop-newest"}, time.Hour)
+	ctx.InMsgs = make(chan transport.Msg, 2)
+	for _, payload := range []string{"1", "2", "3"} {
+		ctx.onMessage(nil, &message{topic: "state/sensor/sun", payload: []byte(payload)})
+	}
+	// Losing the connection is never dropped, it makes room
+	ctx.ClientOptions.OnConnectionLost(nil, io.EOF)
+	if ctx.Dropped() != 2 {
+		t.Errorf("expected 2 dropped messages, got %d", ctx.Dropped())
+	}
+	if a, b := <-ctx.InMsgs, <-ctx.InMsgs; string(a.Data) != "2" || b.Subject != "client/disconnected" {
+		t.Errorf("drop-newest should keep the oldest messages and the disconnect, got %s and %s", string(a.Data), b.Subject)
+	}
+}
+
+func TestCredentialPerService(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tv-bravia.password"), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := New(map[string]string{
+		"mqtt.broker.username":      "{service}",
+		"mqtt.broker.password.file": filepath.Join(dir, "{service}.password"),
+	}, time.Hour)
+	if err := ctx.credentials("tv/bravia"); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.ClientOptions.Username != "tv-bravia" || ctx.ClientOptions.Password != "s3cret" {
+		t.Errorf("got credential %s:%s, want tv-bravia:s3cret", ctx.ClientOptions.Username, ctx.ClientOptions.Password)
+	}
+	if err := ctx.credentials("aqi"); err == nil {
+		t.Error("a missing password file should be an error")
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveMQTT(conn)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	ctx := New(map[string]string{"mqtt.broker.host": "127.0.0.1", "mqtt.broker.port": port}, time.Hour)
+	if err := ctx.Connect("tv", []string{"tv/state/"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Close()
+	for i := 0; ctx.Connected.Get() != 1 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Handlers on worker pools request while channels are registered, the
+	// stand-in broker does not route so every request times out.
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			ctx.Register(fmt.Sprintf("tv/%d/", i))
+			_, err := ctx.Request("tv/state/", []byte("livingroom"), 50*time.Millisecond)
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != transport.ErrTimeout {
+			t.Errorf("expected a timeout, got %v", err)
+		}
+	}
+	if ctx.ReplyFilter != "reply/tv/+" {
+		t.Errorf("expected the replies to be subscribed once, filter '%s'", ctx.ReplyFilter)
+	}
+}
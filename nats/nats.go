@@ -1,11 +1,13 @@
 package pubsub
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/jurgen-kluft/go-home/transport"
 	server "github.com/nats-io/nats.go"
 )
 
@@ -29,58 +31,81 @@ func (b *AtomBool) IsTrue() bool {
 // Context contains the necessary information to run the Nats client
 type Context struct {
 	Config        map[string]string
-	InMsgs        chan *server.Msg
+	InMsgs        chan transport.Msg
 	SubToIndex    map[string]int
 	Subscriptions []*server.Subscription
 	SubChannels   []string
 	Client        *server.Conn
 	Connected     *AtomBool
 	TickFrequency time.Duration
-	Tick          *server.Msg
+	Tick          transport.Msg
+	StatusSubject string
+	// done stops the ticker of the connection
+	done chan struct{}
 }
 
-func New(config map[string]string) *Context {
+func New(config map[string]string, tickFrequency time.Duration) *Context {
 	ctx := &Context{}
 	ctx.Config = config
 	ctx.SubToIndex = make(map[string]int)
 	ctx.Subscriptions = make([]*server.Subscription, 0, 10)
 	ctx.SubChannels = make([]string, 0, 10)
 	ctx.Connected = new(AtomBool)
-	ctx.TickFrequency = time.Duration(1) * time.Second
-	ctx.Tick = &server.Msg{Subject: "tick/", Data: nil}
+	ctx.TickFrequency = tickFrequency
+	ctx.Tick = transport.Msg{Subject: "tick/", Data: nil}
 	return ctx
 }
 
-func (ctx *Context) Topic(msg *server.Msg) string {
+func (ctx *Context) Topic(msg transport.Msg) string {
 	return msg.Subject
 }
 
-func (ctx *Context) Payload(msg *server.Msg) []byte {
+func (ctx *Context) Payload(msg transport.Msg) []byte {
 	return msg.Data
 }
 
+// Incoming returns the channel on which received messages are delivered
+func (ctx *Context) Incoming() <-chan transport.Msg {
+	return ctx.InMsgs
+}
+
 func (ctx *Context) Connect(username string, register, subscribe []string) error {
 	var err error
 
-	ctx.Client, err = server.Connect(ctx.Config["host"],
+	ctx.InMsgs = make(chan transport.Msg, 128)
+
+	// A 'tls://' host or any of the 'tls.' entries enables TLS, every service
+	// can present its own client certificate to the server.
+	tlsConfig, err := transport.TLSConfig(ctx.Config, "", username)
+	if err != nil {
+		return err
+	}
+	options := []server.Option{}
+	if tlsConfig != nil {
+		options = append(options, server.Secure(tlsConfig))
+	}
+
+	ctx.Client, err = server.Connect(ctx.Config["host"], append(options,
 		server.Name(username),
 		server.Token(ctx.Config["secret"]),
 		server.DisconnectErrHandler(func(nc *server.Conn, err error) {
 			ctx.Connected.Set(false)
-			msg := &server.Msg{Subject: "client/disconnected/"}
+			msg := transport.Msg{Subject: "client/disconnected/"}
 			ctx.InMsgs <- msg
 		}),
 		server.ReconnectHandler(func(nc *server.Conn) {
-			msg := &server.Msg{Subject: "client/reconnected/", Data: []byte(nc.ConnectedUrl())}
+			msg := transport.Msg{Subject: "client/reconnected/", Data: []byte(nc.ConnectedUrl())}
 			ctx.InMsgs <- msg
 		}),
 		server.ClosedHandler(func(nc *server.Conn) {
-			msg := &server.Msg{Subject: "client/closed/"}
+			msg := transport.Msg{Subject: "client/closed/"}
 			ctx.InMsgs <- msg
 		}),
-	)
+	)...)
+	if err != nil {
+		return err
+	}
 
-	ctx.InMsgs = make(chan *server.Msg, 128)
 	for _, s := range subscribe {
 		err := ctx.Subscribe(s)
 		if err != nil {
@@ -93,30 +118,63 @@ func (ctx *Context) Connect(username string, register, subscribe []string) error
 			ctx.Register(r)
 		}
 
+		// NATS has no last-will nor retained messages, the status is
+		// only published when the service connects and closes.
+		ctx.StatusSubject = toSubject(transport.StatusTopic(username))
+		ctx.Client.Publish(ctx.StatusSubject, []byte(transport.StatusOnline))
+
 		ctx.Connected.Set(true)
-		go func() {
-			for ctx.Connected.IsTrue() {
-				time.Sleep(ctx.TickFrequency)
-				ctx.InMsgs <- ctx.Tick
-			}
-		}()
+		ctx.done = make(chan struct{})
+		go transport.Ticker(ctx.TickFrequency, ctx.Tick, ctx.InMsgs, ctx.done)
 	}
 
 	return err
 }
 
+// Close publishes the offline status and disconnects, it can be called more than once
 func (ctx *Context) Close() {
+	if ctx.done != nil {
+		close(ctx.done)
+		ctx.done = nil
+	}
+	if ctx.Client == nil {
+		return
+	}
+	if ctx.Connected.IsTrue() {
+		ctx.Client.Publish(ctx.StatusSubject, []byte(transport.StatusOffline))
+		ctx.Client.Flush()
+	}
 	ctx.Connected.Set(false)
 	ctx.Client.Close()
 	ctx.Client = nil
-	time.Sleep(1)
+}
+
+// SetOptions is accepted for compatibility with the other transports, NATS
+// has no QoS levels nor retained messages so the options are ignored.
+func (ctx *Context) SetOptions(channel string, options transport.Options) error {
+	return nil
+}
+
+// toSubject converts a channel into a NATS subject, the single level
+// wildcard becomes '*' and the multi level wildcard '#' becomes '>'
+func toSubject(channel string) string {
+	subject := strings.Replace(channel, "/", ".", -1)
+	subject = strings.TrimSuffix(subject, ".")
+	chapters := strings.Split(subject, ".")
+	for i, chapter := range chapters {
+		if chapter == transport.SingleLevel {
+			chapters[i] = "*"
+		} else if chapter == transport.MultiLevel {
+			chapters[i] = ">"
+		}
+	}
+	return strings.Join(chapters, ".")
 }
 
 func (ctx *Context) Register(channel string) error {
 	_, exists := ctx.SubToIndex[channel]
 	if !exists {
-		subschannel := strings.Replace(channel, "/", ".", -1)
-		subschannel = strings.TrimSuffix(subschannel, ".")
+		subschannel := toSubject(channel)
 		index := len(ctx.SubChannels)
 		ctx.SubToIndex[channel] = index
 		ctx.Subscriptions = append(ctx.Subscriptions, nil)
@@ -126,11 +184,15 @@ func (ctx *Context) Register(channel string) error {
 }
 
 func (ctx *Context) Subscribe(channel string) (err error) {
+	if err = transport.ValidateFilter(channel); err != nil {
+		return err
+	}
 	_, exists := ctx.SubToIndex[channel]
 	if !exists {
-		subschannel := strings.Replace(channel, "/", ".", -1)
-		subschannel = strings.TrimSuffix(subschannel, ".")
-		subscription, err := ctx.Client.ChanSubscribe(subschannel, ctx.InMsgs)
+		subschannel := toSubject(channel)
+		subscription, err := ctx.Client.Subscribe(subschannel, func(msg *server.Msg) {
+			ctx.InMsgs <- transport.Msg{Subject: msg.Subject, Data: msg.Data, Reply: msg.Reply}
+		})
 		index := len(ctx.SubChannels)
 		ctx.SubToIndex[channel] = index
 		ctx.Subscriptions = append(ctx.Subscriptions, subscription)
@@ -142,7 +204,7 @@ func (ctx *Context) Subscribe(channel string) (err error) {
 
 func (ctx *Context) PublishStr(channel string, message string) error {
 	index, exists := ctx.SubToIndex[channel]
-	if exists {
+	if exists && !transport.HasWildcard(channel) {
 		ctx.Client.Publish(ctx.SubChannels[index], []byte(message))
 		return nil
 	}
@@ -151,7 +213,10 @@ func (ctx *Context) PublishStr(channel string, message string) error {
 
 func (ctx *Context) Publish(channel string, message []byte) error {
 	index, exists := ctx.SubToIndex[channel]
-	if exists {
+	if exists && !ctx.Connected.IsTrue() {
+		return fmt.Errorf("PubSub.Publish failed for channel %s: %w", channel, transport.ErrNotConnected)
+	}
+	if exists && !transport.HasWildcard(channel) {
 		ctx.Client.Publish(ctx.SubChannels[index], message)
 		return nil
 	}
@@ -160,7 +225,10 @@ func (ctx *Context) Publish(channel string, message []byte) error {
 
 func (ctx *Context) PublishTTLStr(channel string, message string, ttl int) error {
 	index, exists := ctx.SubToIndex[channel]
-	if exists {
+	if exists && !ctx.Connected.IsTrue() {
+		return fmt.Errorf("PubSub.PublishTTL failed for channel %s: %w", channel, transport.ErrNotConnected)
+	}
+	if exists && !transport.HasWildcard(channel) {
 		ctx.Client.Publish(ctx.SubChannels[index], []byte(message))
 		return nil
 	}
@@ -169,9 +237,46 @@ func (ctx *Context) PublishTTLStr(channel string, message string, ttl int) error
 
 func (ctx *Context) PublishTTL(channel string, message []byte, ttl int) error {
 	index, exists := ctx.SubToIndex[channel]
-	if exists {
+	if exists && !ctx.Connected.IsTrue() {
+		return fmt.Errorf("PubSub.PublishTTL failed for channel %s: %w", channel, transport.ErrNotConnected)
+	}
+	if exists && !transport.HasWildcard(channel) {
 		ctx.Client.Publish(ctx.SubChannels[index], message)
 		return nil
 	}
 	return fmt.Errorf("PubSub.PublishTTL failed for channel %s", channel)
 }
+
+// errorHeader carries the error of a failed request in the reply
+const errorHeader = "Go-Home-Error"
+
+// Request uses the NATS inbox mechanism to publish 'message' and wait for the reply
+func (ctx *Context) Request(channel string, message []byte, timeout time.Duration) ([]byte, error) {
+	index, exists := ctx.SubToIndex[channel]
+	if !exists || transport.HasWildcard(channel) {
+		return nil, fmt.Errorf("PubSub.Request failed for channel %s", channel)
+	}
+	reply, err := ctx.Client.RequestMsg(&server.Msg{Subject: ctx.SubChannels[index], Data: message}, timeout)
+	if err == server.ErrTimeout {
+		return nil, transport.ErrTimeout
+	} else if err != nil {
+		return nil, err
+	}
+	if e := reply.Header.Get(errorHeader); e != "" {
+		return reply.Data, errors.New(e)
+	}
+	return reply.Data, nil
+}
+
+// Reply sends the reply (or the error) to the inbox of a request that we received
+func (ctx *Context) Reply(request transport.Msg, message []byte, err error) error {
+	if request.Reply == "" {
+		return fmt.Errorf("PubSub.Reply failed, message on %s is not a request", request.Subject)
+	}
+	reply := server.NewMsg(request.Reply)
+	reply.Data = message
+	if err != nil {
+		reply.Header.Set(errorHeader, err.Error())
+	}
+	return ctx.Client.PublishMsg(reply)
+}
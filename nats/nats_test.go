@@ -0,0 +1,89 @@
+package pubsub
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport/tlstest"
+)
+
+// serveNATS is a server stand-in that requires TLS and answers pings, it does
+// not route any messages.
+func serveNATS(conn net.Conn, config *tls.Config, clients chan string) {
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"stand-in\",\"version\":\"2.10.0\",\"proto\":1,\"max_payload\":1048576,\"tls_required\":true}\r\n")
+	tc, name, err := tlstest.Handshake(conn, config)
+	if err != nil {
+		return
+	}
+	clients <- name
+	r := bufio.NewReader(tc)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			tc.Write([]byte("PONG\r\n"))
+		case strings.HasPrefix(line, "PUB"):
+			r.ReadString('\n')
+		}
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca, err := tlstest.NewCA("gohome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := ca.ServerConfig()
+	dir := t.TempDir()
+	caFile, _ := ca.WriteCA(dir)
+	ca.WriteClient(dir, "aqi")
+
+	clients := make(chan string, 8)
+	listener, err := tlstest.Listen(func(conn net.Conn) {
+		serveNATS(conn, server, clients)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	connect := func(entries map[string]string) error {
+		cfg := map[string]string{
+			"host":     "tls://" + listener.Addr().String(),
+			"tls.ca":   caFile,
+			"tls.cert": filepath.Join(dir, "{service}.pem"),
+			"tls.key":  filepath.Join(dir, "{service}.key"),
+		}
+		for k, v := range entries {
+			cfg[k] = v
+		}
+		ctx := New(cfg, time.Hour)
+		defer ctx.Close()
+		return ctx.Connect("aqi", nil, []string{"config/aqi/"})
+	}
+
+	if err := connect(nil); err != nil {
+		t.Fatalf("mutual TLS connect failed, %v", err)
+	}
+	if name := <-clients; name != "aqi" {
+		t.Errorf("the server saw client certificate '%s', want 'aqi'", name)
+	}
+
+	other, _ := tlstest.NewCA("other")
+	otherFile, _ := other.WriteCA(t.TempDir())
+	if err := connect(map[string]string{"tls.ca": otherFile}); err == nil {
+		t.Errorf("a server certificate from another CA should be refused")
+	}
+	if err := connect(map[string]string{"tls.cert": "", "tls.key": ""}); err == nil {
+		t.Errorf("the server should refuse a client without a certificate")
+	}
+}
@@ -105,12 +105,13 @@ func (p *process) start() error {
 		p.cmd.Stderr = ef
 	}
 
-	// Set the environment for the command.
-	var env = make([]string, 0)
-	for k, v := range p.Env {
-		env = append(env, fmt.Sprintf("%s=%q", k, v))
-	}
-	if len(env) > 0 {
+	// Set the environment for the command, the entries of the process
+	// (e.g. GOHOME_HTTP) are added to the environment of the overseer.
+	if len(p.Env) > 0 {
+		env := os.Environ()
+		for k, v := range p.Env {
+			env = append(env, k+"="+v)
+		}
 		p.cmd.Env = env
 	}
 
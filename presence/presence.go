@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/jurgen-kluft/go-home/config"
 	"github.com/jurgen-kluft/go-home/metrics"
 	microservice "github.com/jurgen-kluft/go-home/micro-service"
-	pubsub "github.com/jurgen-kluft/go-home/nats"
+	"github.com/jurgen-kluft/go-home/transport"
 )
 
 // AWAY    is a state that happens when   NOT_SEEN > N seconds
@@ -202,7 +203,7 @@ func (p *Presence) presence(now time.Time) (updated bool, result error) {
 	return false, result
 }
 
-func (p *Presence) publish(now time.Time, client *pubsub.Context) {
+func (p *Presence) publish(now time.Time, client transport.Transport) {
 	sensor := config.NewSensorState("state.presence", "presence")
 	sensor.Time = now
 	for _, m := range p.members {
@@ -253,5 +254,5 @@ func main() {
 		return true
 	})
 
-	micro.Loop()
+	micro.Loop(context.Background())
 }
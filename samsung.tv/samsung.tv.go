@@ -4,6 +4,7 @@ package main
 // - Samsung TV: Turn On/Off
 
 import (
+	"context"
 	"github.com/jurgen-kluft/go-home/config"
 	microservice "github.com/jurgen-kluft/go-home/micro-service"
 	"github.com/saljam/samote"
@@ -123,6 +124,6 @@ func main() {
 		return true
 	})
 
-	m.Loop()
+	m.Loop(context.Background())
 
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/jurgen-kluft/go-home/config"
@@ -122,6 +123,8 @@ func main() {
 		return true
 	})
 
+	// Posting to Slack is slow, do not let it hold up the other messages
+	m.SetConcurrency("shout/message/", 1, 64, microservice.DropOldest)
 	m.RegisterHandler("shout/message/", func(m *microservice.Service, topic string, msg []byte) bool {
 		// Is this a message to send over slack ?
 		if c.client != nil {
@@ -142,5 +145,5 @@ func main() {
 		return true
 	})
 
-	m.Loop()
+	m.Loop(context.Background())
 }
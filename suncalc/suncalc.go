@@ -3,11 +3,13 @@ package main
 // sun calculations are based on http://aa.quae.nl/en/reken/zonpositie.html formulas
 
 import (
+	"context"
 	"math"
 	"time"
 
 	"github.com/jurgen-kluft/go-home/config"
 	microservice "github.com/jurgen-kluft/go-home/micro-service"
+	"github.com/jurgen-kluft/go-home/transport"
 )
 
 const (
@@ -429,41 +431,49 @@ func main() {
 	register := []string{"state/sensor/sun/", "config/request/"}
 	subscribe := []string{"config/suncalc/"}
 
-	tickCount := 0
-
-	m := microservice.New("suncalc")
+	m := microservice.New("suncalc", time.Second)
 	m.RegisterAndSubscribe(register, subscribe)
 
+	// Retain the sun state so that a (re)starting service receives it immediately
+	m.SetOptions("state/sensor/sun/", transport.Options{QoS: 1, Retain: true})
+
+	publish := func(m *microservice.Service) bool {
+		if suncalc.config != nil {
+			jsonbytes, err := suncalc.buildJSONMessage()
+			if err == nil {
+				m.Pubsub.Publish("state/sensor/sun/", jsonbytes)
+			} else {
+				m.Logger.LogError(m.Name, err.Error())
+			}
+		}
+		return true
+	}
+
+	m.SetReady("config", false)
 	m.RegisterHandler("config/suncalc/", func(m *microservice.Service, topic string, msg []byte) bool {
 		m.Logger.LogInfo(m.Name, "received configuration")
 		err := suncalc.initialize(msg)
 		if err != nil {
 			m.Logger.LogError(m.Name, err.Error())
 		} else {
-			tickCount = 0
+			m.SetReady("config", true)
+			m.SetConfigVersion(config.Version(msg))
+			m.After(0, publish)
 		}
 		return true
 	})
 
-	m.RegisterHandler("tick/", func(m *microservice.Service, topic string, msg []byte) bool {
-		if tickCount%30 == 0 { // every 30 seconds
-			if suncalc.config == nil {
-				m.Pubsub.PublishStr("config/request/", m.Name)
-			}
-		}
-		if tickCount%300 == 0 { // every 5 minutes
-			if suncalc.config != nil {
-				jsonbytes, err := suncalc.buildJSONMessage()
-				if err == nil {
-					m.Pubsub.Publish("state/sensor/sun/", jsonbytes)
-				} else {
-					m.Logger.LogError(m.Name, err.Error())
-				}
-			}
+	m.Every(30*time.Second, func(m *microservice.Service) bool {
+		if suncalc.config == nil {
+			m.Pubsub.PublishStr("config/request/", m.Name)
 		}
-		tickCount++
 		return true
-	})
+	}, microservice.Immediately())
+
+	// Every 5 minutes on the clock
+	if _, err := m.At("*/5 * * * *", publish); err != nil {
+		m.Logger.LogError(m.Name, err.Error())
+	}
 
-	m.Loop()
+	m.Loop(context.Background())
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+	microservice "github.com/jurgen-kluft/go-home/micro-service"
+	"github.com/jurgen-kluft/go-home/topic"
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// bridge republishes the messages of legacy topics under the topic naming
+// convention, so that a service can move to the convention while the
+// services that use its messages still receive them on the legacy topic.
+type bridge struct {
+	migration  *topic.Migration
+	subscribed map[string]bool
+	registered map[string]bool
+}
+
+func (b *bridge) configure(m *microservice.Service, cfg *config.TopicBridgeConfig) error {
+	migration, err := topic.NewMigration(cfg)
+	if err != nil {
+		return err
+	}
+	b.migration = migration
+	for _, legacy := range migration.Legacy() {
+		if !b.subscribed[legacy] {
+			b.subscribed[legacy] = true
+			m.Subscribe(legacy)
+			m.RegisterHandler(legacy, b.republish)
+		}
+	}
+	return nil
+}
+
+func (b *bridge) republish(m *microservice.Service, legacy string, payload []byte) bool {
+	if b.migration == nil {
+		return true
+	}
+	for _, msg := range b.migration.Translate(legacy, payload) {
+		channel := msg.Topic.Channel()
+		if !b.registered[channel] {
+			b.registered[channel] = true
+			// The republished messages are for consumers of the convention
+			// that are not micro-services, they go out without trace envelope.
+			m.SetOptions(channel, transport.Options{Raw: true})
+			m.Register(channel)
+		}
+		if err := m.Pubsub.Publish(channel, msg.Payload); err != nil {
+			m.Logger.LogError(m.Name, err.Error())
+		}
+	}
+	return true
+}
+
+func setup(m *microservice.Service) *bridge {
+	register := []string{"config/topic-bridge/", "config/request/"}
+	subscribe := []string{"config/topic-bridge/"}
+
+	b := &bridge{subscribed: map[string]bool{}, registered: map[string]bool{}}
+	m.RegisterAndSubscribe(register, subscribe)
+
+	m.SetReady("config", false)
+	m.RegisterHandler("config/topic-bridge/", func(m *microservice.Service, topic string, msg []byte) bool {
+		cfg, err := config.TopicBridgeConfigFromJSON(msg)
+		if err == nil {
+			err = b.configure(m, cfg)
+		}
+		if err != nil {
+			m.Logger.LogError(m.Name, "received bad configuration, "+err.Error())
+			return true
+		}
+		m.Logger.LogInfo(m.Name, fmt.Sprintf("received configuration with %d rules", len(cfg.Rules)))
+		m.SetReady("config", true)
+		m.SetConfigVersion(config.Version(msg))
+		return true
+	})
+
+	m.Every(30*time.Second, func(m *microservice.Service) bool {
+		if b.migration == nil {
+			m.Pubsub.PublishStr("config/request/", m.Name)
+		}
+		return true
+	}, microservice.Immediately())
+
+	return b
+}
+
+func main() {
+	m := microservice.New("topic-bridge", time.Second)
+	setup(m)
+	m.Loop(context.Background())
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	microservice "github.com/jurgen-kluft/go-home/micro-service"
+)
+
+func TestRepublishRaw(t *testing.T) {
+	m := microservice.New("topic-bridge", time.Second)
+	m.Tracing = true
+	setup(m)
+	h := microservice.NewHarness(m, time.Now())
+
+	h.Inject("config/topic-bridge/", []byte(`{"rules":[{"legacy":"shout/message/","device_type":"notification","location":"home","room":"all","zone":"main","device":"shout","field":"message"}]}`))
+	h.Inject("shout/message/", []byte("the front door is open"))
+
+	msgs := h.Pubsub.Messages("notification/home/all/main/message/shout/")
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 republished message, got %d", len(msgs))
+	}
+	if want := `{"message":"the front door is open"}`; string(msgs[0].Data) != want {
+		t.Errorf("republished '%s', want exactly '%s'", msgs[0].Data, want)
+	}
+}
@@ -0,0 +1,144 @@
+package topic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jurgen-kluft/go-home/config"
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// Message is a message republished under the naming convention
+type Message struct {
+	Topic   Topic
+	Payload []byte
+}
+
+// Migration republishes the messages of legacy topics under the naming
+// convention, so that the services can move to the convention one by one.
+type Migration struct {
+	Rules []config.TopicRule
+}
+
+// NewMigration checks the rules of the configuration
+func NewMigration(cfg *config.TopicBridgeConfig) (*Migration, error) {
+	for _, rule := range cfg.Rules {
+		if err := transport.ValidateFilter(rule.Legacy); err != nil {
+			return nil, err
+		}
+		t := ruleTopic(rule, "category", "device")
+		if err := t.Validate(); err != nil {
+			return nil, fmt.Errorf("rule for %s: %s", rule.Legacy, err.Error())
+		}
+	}
+	return &Migration{Rules: cfg.Rules}, nil
+}
+
+// Legacy returns the legacy topic filters of the rules
+func (m *Migration) Legacy() []string {
+	filters := []string{}
+	seen := map[string]bool{}
+	for _, rule := range m.Rules {
+		if !seen[rule.Legacy] {
+			seen[rule.Legacy] = true
+			filters = append(filters, rule.Legacy)
+		}
+	}
+	return filters
+}
+
+// Translate returns the messages that republish a legacy message, a
+// SensorState is split in one partial update per category.
+func (m *Migration) Translate(legacy string, payload []byte) []Message {
+	state := &config.SensorState{}
+	if bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+		if err := json.Unmarshal(payload, state); err != nil {
+			state = &config.SensorState{}
+		}
+	}
+
+	for _, rule := range m.Rules {
+		if !transport.MatchTopic(strings.TrimRight(rule.Legacy, "/."), strings.TrimRight(legacy, "/.")) {
+			continue
+		}
+		if state.Name == "" {
+			if rule.Field == "" || rule.Sensor != "" {
+				continue
+			}
+			return []Message{partial(ruleTopic(rule, rule.Field, legacy), map[string]interface{}{rule.Field: raw(payload)})}
+		}
+		if rule.Sensor != "" && rule.Sensor != state.Name {
+			continue
+		}
+		return translateState(rule, state)
+	}
+	return nil
+}
+
+// ruleTopic returns the topic of a rule, 'category' and 'device' are used
+// when the rule leaves them empty.
+func ruleTopic(rule config.TopicRule, category string, device string) Topic {
+	if rule.Category != "" {
+		category = rule.Category
+	}
+	if rule.Device != "" {
+		device = rule.Device
+	}
+	return Topic{
+		DeviceType: Name(rule.DeviceType),
+		Location:   Name(rule.Location),
+		Room:       Name(rule.Room),
+		Zone:       Name(rule.Zone),
+		Category:   Name(category),
+		Device:     Name(device),
+	}
+}
+
+func translateState(rule config.TopicRule, state *config.SensorState) []Message {
+	updates := map[Topic]map[string]interface{}{}
+	add := func(name string, value interface{}) {
+		t := ruleTopic(rule, name, state.Name)
+		if updates[t] == nil {
+			updates[t] = map[string]interface{}{}
+		}
+		updates[t][name] = value
+	}
+	for _, a := range state.BoolAttrs {
+		add(a.Name, a.Value)
+	}
+	for _, a := range state.IntAttrs {
+		add(a.Name, a.Value)
+	}
+	for _, a := range state.FloatAttrs {
+		add(a.Name, a.Value)
+	}
+	for _, a := range state.StringAttrs {
+		add(a.Name, a.Value)
+	}
+	for _, a := range state.TimeWndAttrs {
+		add(a.Name, map[string]interface{}{"begin": a.Begin, "end": a.End})
+	}
+
+	messages := make([]Message, 0, len(updates))
+	for t, fields := range updates {
+		messages = append(messages, partial(t, fields))
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Topic.String() < messages[j].Topic.String() })
+	return messages
+}
+
+func partial(t Topic, fields map[string]interface{}) Message {
+	payload, _ := Update(fields)
+	return Message{Topic: t, Payload: payload}
+}
+
+// raw returns a payload that is JSON as is, otherwise as a string
+func raw(payload []byte) interface{} {
+	if json.Valid(payload) {
+		return json.RawMessage(payload)
+	}
+	return string(payload)
+}
@@ -0,0 +1,125 @@
+// Package topic implements the topic naming convention of mqtt/topics.md,
+// 'device-type/location/room/zone/category/device-name', with a JSON payload
+// that only holds the fields that changed.
+package topic
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// Levels is the number of levels of a topic
+const Levels = 6
+
+// Topic is a topic that follows the naming convention, e.g.
+// 'sensor/1stfloor/kitchen/ceiling/temperature/sensor-01'
+type Topic struct {
+	DeviceType string `json:"device_type"`
+	Location   string `json:"location"`
+	Room       string `json:"room"`
+	Zone       string `json:"zone"`
+	Category   string `json:"category"`
+	Device     string `json:"device"`
+}
+
+// Build returns the topic of a device, every level is converted with Name so
+// that e.g. 'Living Room' becomes 'living-room'.
+func Build(deviceType, location, room, zone, category, device string) (Topic, error) {
+	t := Topic{
+		DeviceType: Name(deviceType),
+		Location:   Name(location),
+		Room:       Name(room),
+		Zone:       Name(zone),
+		Category:   Name(category),
+		Device:     Name(device),
+	}
+	return t, t.Validate()
+}
+
+// Parse splits a topic into its levels, both '/' and '.' are accepted as
+// separators and a trailing separator (a service channel) is ignored.
+func Parse(topic string) (Topic, error) {
+	levels := strings.FieldsFunc(topic, func(r rune) bool { return r == '/' || r == '.' })
+	if len(levels) != Levels {
+		return Topic{}, fmt.Errorf("topic %s has %d levels, the convention is device-type/location/room/zone/category/device-name", topic, len(levels))
+	}
+	t := Topic{levels[0], levels[1], levels[2], levels[3], levels[4], levels[5]}
+	return t, t.Validate()
+}
+
+// Validate checks a topic against the naming convention
+func Validate(topic string) error {
+	_, err := Parse(topic)
+	return err
+}
+
+func (t Topic) levels() []string {
+	return []string{t.DeviceType, t.Location, t.Room, t.Zone, t.Category, t.Device}
+}
+
+var levelNames = []string{"device-type", "location", "room", "zone", "category", "device-name"}
+
+// Validate checks that every level is set and only holds lowercase letters,
+// digits, '-' and '_'.
+func (t Topic) Validate() error {
+	for i, level := range t.levels() {
+		if level == "" {
+			return fmt.Errorf("topic %s has no %s", t, levelNames[i])
+		}
+		for _, r := range level {
+			if !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '-' && r != '_' {
+				return fmt.Errorf("topic %s: %s '%s' may only hold a-z, 0-9, '-' and '_'", t, levelNames[i], level)
+			}
+		}
+	}
+	return nil
+}
+
+// String returns the MQTT topic
+func (t Topic) String() string {
+	return strings.Join(t.levels(), "/")
+}
+
+// Channel returns the topic as the channel of a service, which ends with a '/'
+func (t Topic) Channel() string {
+	return t.String() + "/"
+}
+
+// Filter returns a topic filter where every empty level is a '+', e.g. all
+// motion sensors: Topic{DeviceType: "sensor", Category: "motion"}.Filter()
+func (t Topic) Filter() string {
+	levels := t.levels()
+	for i, level := range levels {
+		if level == "" {
+			levels[i] = transport.SingleLevel
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+// Name converts a name into a topic level, 'Kitchen Motion' becomes
+// 'kitchen-motion' and 'pm2.5' becomes 'pm2-5'.
+func Name(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			dash = false
+			b.WriteRune(r)
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// Update returns the JSON payload of a partial update, e.g. {"temperature": 22.5}
+func Update(fields map[string]interface{}) ([]byte, error) {
+	return json.Marshal(fields)
+}
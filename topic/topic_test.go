@@ -0,0 +1,76 @@
+package topic
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jurgen-kluft/go-home/config"
+)
+
+func TestBuildAndParse(t *testing.T) {
+	built, err := Build("Sensor", "1st Floor", "Kitchen", "Ceiling", "Temperature", "Sensor 01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if built.String() != "sensor/1st-floor/kitchen/ceiling/temperature/sensor-01" {
+		t.Errorf("built %s", built)
+	}
+	parsed, err := Parse("sensor.1st-floor.kitchen.ceiling.temperature.sensor-01")
+	if err != nil || parsed != built {
+		t.Errorf("parsed %v, %v", parsed, err)
+	}
+	if _, err := Parse(built.Channel()); err != nil {
+		t.Errorf("a channel with a trailing '/' should parse, %v", err)
+	}
+
+	for _, bad := range []string{"state/sensor/aqi/", "sensor/1stfloor/kitchen/ceiling/Temperature/sensor-01", "sensor/+/kitchen/ceiling/motion/sensor-02"} {
+		if err := Validate(bad); err == nil {
+			t.Errorf("%s should not be valid", bad)
+		}
+	}
+	if f := (Topic{DeviceType: "sensor", Category: "motion"}).Filter(); f != "sensor/+/+/+/motion/+" {
+		t.Errorf("filter %s", f)
+	}
+	if Name("  PM2.5 ") != "pm2-5" || Name("Living Room") != "living-room" {
+		t.Errorf("Name does not convert to a topic level")
+	}
+}
+
+func TestMigration(t *testing.T) {
+	cfg := &config.TopicBridgeConfig{Rules: []config.TopicRule{
+		{Legacy: "state/sensor/aqi/", DeviceType: "sensor", Location: "outside", Room: "garden", Zone: "main", Device: "aqi"},
+		{Legacy: "shout/message/", DeviceType: "notification", Location: "home", Room: "all", Zone: "main", Device: "shout", Field: "message"},
+	}}
+	m, err := NewMigration(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := config.NewSensorState("sensor.weather.aqi", "airquality")
+	state.AddFloatAttr("pm2.5", 54)
+	state.AddStringAttr("caution", "none")
+	data, _ := state.ToJSON()
+	messages := m.Translate("state.sensor.aqi", data)
+	if len(messages) != 2 {
+		t.Fatalf("expected a message per attribute, got %d", len(messages))
+	}
+	if messages[0].Topic.String() != "sensor/outside/garden/main/caution/aqi" || string(messages[0].Payload) != `{"caution":"none"}` {
+		t.Errorf("got %s %s", messages[0].Topic, messages[0].Payload)
+	}
+	if messages[1].Topic.String() != "sensor/outside/garden/main/pm2-5/aqi" || string(messages[1].Payload) != `{"pm2.5":54}` {
+		t.Errorf("got %s %s", messages[1].Topic, messages[1].Payload)
+	}
+
+	messages = m.Translate("shout/message/", []byte("the front door is open"))
+	if len(messages) != 1 || messages[0].Topic.String() != "notification/home/all/main/message/shout" || string(messages[0].Payload) != `{"message":"the front door is open"}` {
+		t.Errorf("got %v", messages)
+	}
+	if messages := m.Translate("state/presence/", data); len(messages) != 0 {
+		t.Errorf("a topic without a rule should not be republished")
+	}
+
+	cfg.Rules = append(cfg.Rules, config.TopicRule{Legacy: "state/#/x", DeviceType: "sensor"})
+	if _, err := NewMigration(cfg); err == nil || !strings.Contains(err.Error(), "'#'") {
+		t.Errorf("a bad rule should be refused, %v", err)
+	}
+}
@@ -0,0 +1,447 @@
+package loopback
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// Bus is an in-process broker, every Context connected to the same Bus
+// receives the messages published on the topics it subscribed to.
+type Bus struct {
+	lock     sync.Mutex
+	contexts []*Context
+	retained map[string][]byte
+	pending  map[string]chan transport.Envelope
+
+	// Responders answer requests on the bus itself, tests use them to stand
+	// in for the services that a service under test sends requests to.
+	Responders map[string]func(request []byte) ([]byte, error)
+}
+
+// Default is the bus used when the 'loopback' transport is selected from config
+var Default = NewBus()
+
+func NewBus() *Bus {
+	bus := &Bus{}
+	bus.contexts = make([]*Context, 0, 4)
+	bus.retained = make(map[string][]byte)
+	bus.pending = make(map[string]chan transport.Envelope)
+	bus.Responders = make(map[string]func(request []byte) ([]byte, error))
+	return bus
+}
+
+func (bus *Bus) attach(ctx *Context) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.contexts = append(bus.contexts, ctx)
+}
+
+func (bus *Bus) detach(ctx *Context) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	for i, c := range bus.contexts {
+		if c == ctx {
+			bus.contexts = append(bus.contexts[:i], bus.contexts[i+1:]...)
+			break
+		}
+	}
+}
+
+// Retain stores the message as the retained message of 'topic', an empty
+// message removes the retained message, like an MQTT broker does.
+func (bus *Bus) Retain(topic string, message []byte) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if len(message) == 0 {
+		delete(bus.retained, topic)
+	} else {
+		bus.retained[topic] = message
+	}
+}
+
+// Retained returns the retained message of 'topic'
+func (bus *Bus) Retained(topic string) ([]byte, bool) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	message, exists := bus.retained[topic]
+	return message, exists
+}
+
+// replay delivers the retained messages matching 'filter' to the context
+func (bus *Bus) replay(ctx *Context, filter string) {
+	bus.lock.Lock()
+	msgs := make([]transport.Msg, 0, 4)
+	for topic, message := range bus.retained {
+		if transport.MatchTopic(filter, topic) {
+			msgs = append(msgs, transport.Msg{Subject: topic, Data: message})
+		}
+	}
+	bus.lock.Unlock()
+
+	for _, msg := range msgs {
+		ctx.enqueue(msg)
+	}
+}
+
+// Publish delivers the message to every connected context that has a
+// matching subscription.
+func (bus *Bus) Publish(topic string, message []byte) {
+	bus.deliver(transport.Msg{Subject: topic, Data: message})
+}
+
+func (bus *Bus) deliver(msg transport.Msg) {
+	bus.lock.Lock()
+	contexts := make([]*Context, len(bus.contexts))
+	copy(contexts, bus.contexts)
+	bus.lock.Unlock()
+
+	for _, ctx := range contexts {
+		ctx.deliver(msg)
+	}
+}
+
+// Respond registers a responder on the bus for requests on 'channel'
+func (bus *Bus) Respond(channel string, responder func(request []byte) ([]byte, error)) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.Responders[channel] = responder
+}
+
+func (bus *Bus) responder(channel string) (func(request []byte) ([]byte, error), bool) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	for filter, responder := range bus.Responders {
+		if filter == channel || transport.MatchTopic(filter, channel) {
+			return responder, true
+		}
+	}
+	return nil, false
+}
+
+// Request delivers a request to the subscribers of 'channel' and waits for the reply
+func (bus *Bus) Request(channel string, replyTo string, message []byte, timeout time.Duration) ([]byte, error) {
+	if responder, exists := bus.responder(channel); exists {
+		return responder(message)
+	}
+
+	correlation := transport.NewCorrelationID()
+	reply := make(chan transport.Envelope, 1)
+	bus.lock.Lock()
+	bus.pending[correlation] = reply
+	bus.lock.Unlock()
+	defer func() {
+		bus.lock.Lock()
+		delete(bus.pending, correlation)
+		bus.lock.Unlock()
+	}()
+
+	bus.deliver(transport.Msg{Subject: channel, Data: message, Reply: replyTo + correlation + "/", Correlation: correlation})
+
+	select {
+	case e := <-reply:
+		if e.Error != "" {
+			return e.Payload, errors.New(e.Error)
+		}
+		return e.Payload, nil
+	case <-time.After(timeout):
+		return nil, transport.ErrTimeout
+	}
+}
+
+func (bus *Bus) reply(e transport.Envelope) {
+	bus.lock.Lock()
+	reply, exists := bus.pending[e.CorrelationData]
+	delete(bus.pending, e.CorrelationData)
+	bus.lock.Unlock()
+	if exists {
+		reply <- e
+	}
+}
+
+// Context is a Transport on top of a Bus
+type Context struct {
+	Bus           *Bus
+	InMsgs        chan transport.Msg
+	Registered    map[string]bool
+	Options       map[string]transport.Options
+	Name          string
+	StatusTopic   string
+	SubChannels   []string
+	Published     []transport.Msg
+	Connected     bool
+	TickFrequency time.Duration
+	Tick          transport.Msg
+	// Overflows counts the messages that found InMsgs full, they wait in the
+	// backlog of the context instead of blocking the publisher.
+	Overflows uint64
+	backlog   []transport.Msg
+	pumping   bool
+	lock      sync.Mutex
+	done      chan bool
+}
+
+// New returns a loopback Context, a tickFrequency of 0 disables the tick messages
+func New(bus *Bus, tickFrequency time.Duration) *Context {
+	ctx := &Context{}
+	ctx.Bus = bus
+	ctx.InMsgs = make(chan transport.Msg, 128)
+	ctx.Registered = make(map[string]bool)
+	ctx.Options = make(map[string]transport.Options)
+	ctx.SubChannels = make([]string, 0, 10)
+	ctx.Published = make([]transport.Msg, 0, 16)
+	ctx.TickFrequency = tickFrequency
+	ctx.Tick = transport.Msg{Subject: "tick/", Data: []byte("do your thing")}
+	return ctx
+}
+
+func (ctx *Context) Connect(username string, register, subscribe []string) error {
+	for _, s := range subscribe {
+		if err := ctx.Subscribe(s); err != nil {
+			return err
+		}
+	}
+	for _, r := range register {
+		ctx.Register(r)
+	}
+
+	ctx.lock.Lock()
+	ctx.Connected = true
+	ctx.Name = username
+	ctx.StatusTopic = transport.StatusTopic(username)
+	ctx.done = make(chan bool)
+	subscriptions := append([]string{}, ctx.SubChannels...)
+	ctx.lock.Unlock()
+
+	ctx.Bus.attach(ctx)
+	for _, sub := range subscriptions {
+		ctx.Bus.replay(ctx, sub)
+	}
+
+	ctx.Bus.Retain(ctx.StatusTopic, []byte(transport.StatusOnline))
+	ctx.Bus.Publish(ctx.StatusTopic, []byte(transport.StatusOnline))
+
+	if ctx.TickFrequency > 0 {
+		go func(done chan bool) {
+			ticker := time.NewTicker(ctx.TickFrequency)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					ctx.InMsgs <- ctx.Tick
+				}
+			}
+		}(ctx.done)
+	}
+	return nil
+}
+
+func (ctx *Context) Close() {
+	ctx.Bus.detach(ctx)
+	ctx.lock.Lock()
+	connected := ctx.Connected
+	statusTopic := ctx.StatusTopic
+	ctx.Connected = false
+	ctx.backlog = nil
+	if ctx.done != nil {
+		close(ctx.done)
+		ctx.done = nil
+	}
+	ctx.lock.Unlock()
+	if connected {
+		ctx.Bus.Retain(statusTopic, []byte(transport.StatusOffline))
+		ctx.Bus.Publish(statusTopic, []byte(transport.StatusOffline))
+	}
+}
+
+// Incoming returns the channel on which received messages are delivered
+func (ctx *Context) Incoming() <-chan transport.Msg {
+	return ctx.InMsgs
+}
+
+// SetOptions sets the delivery options of 'channel', the loopback bus
+// honours the retain flag, QoS is meaningless in-process.
+func (ctx *Context) SetOptions(channel string, options transport.Options) error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.Options[channel] = options
+	return nil
+}
+
+func (ctx *Context) Register(channel string) error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.Registered[channel] = true
+	return nil
+}
+
+func (ctx *Context) Subscribe(channel string) error {
+	if err := transport.ValidateFilter(channel); err != nil {
+		return err
+	}
+	ctx.lock.Lock()
+	for _, sub := range ctx.SubChannels {
+		if sub == channel {
+			ctx.lock.Unlock()
+			return fmt.Errorf("PubSub.Subscribe failed for channel %s", channel)
+		}
+	}
+	ctx.SubChannels = append(ctx.SubChannels, channel)
+	if !transport.HasWildcard(channel) {
+		ctx.Registered[channel] = true
+	}
+	connected := ctx.Connected
+	ctx.lock.Unlock()
+
+	// Like a broker, deliver the retained messages to a new subscription
+	if connected {
+		ctx.Bus.replay(ctx, channel)
+	}
+	return nil
+}
+
+func (ctx *Context) subscribed(topic string) bool {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	for _, sub := range ctx.SubChannels {
+		if sub == topic || transport.MatchTopic(sub, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ctx *Context) deliver(msg transport.Msg) {
+	if ctx.subscribed(msg.Subject) {
+		ctx.enqueue(msg)
+	}
+}
+
+// enqueue never blocks the publisher, a handler that publishes to its own
+// subscription would otherwise deadlock the bus once InMsgs is full. The
+// messages that do not fit wait in the backlog, in order, until a goroutine
+// has moved them to InMsgs.
+func (ctx *Context) enqueue(msg transport.Msg) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if len(ctx.backlog) == 0 {
+		select {
+		case ctx.InMsgs <- msg:
+			return
+		default:
+		}
+	}
+	ctx.backlog = append(ctx.backlog, msg)
+	ctx.Overflows++
+	if !ctx.pumping && ctx.done != nil {
+		ctx.pumping = true
+		go ctx.pump(ctx.done)
+	}
+}
+
+func (ctx *Context) pump(done chan bool) {
+	for {
+		ctx.lock.Lock()
+		if len(ctx.backlog) == 0 || ctx.done != done {
+			ctx.pumping = false
+			ctx.lock.Unlock()
+			return
+		}
+		msg := ctx.backlog[0]
+		ctx.lock.Unlock()
+
+		select {
+		case ctx.InMsgs <- msg:
+		case <-done:
+		}
+
+		ctx.lock.Lock()
+		if ctx.done == done && len(ctx.backlog) > 0 {
+			ctx.backlog = ctx.backlog[1:]
+		}
+		ctx.lock.Unlock()
+	}
+}
+
+// Pending returns the number of messages in the backlog, they have not been
+// moved to InMsgs yet.
+func (ctx *Context) Pending() int {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return len(ctx.backlog)
+}
+
+func (ctx *Context) PublishStr(channel string, message string) error {
+	return ctx.Publish(channel, []byte(message))
+}
+
+func (ctx *Context) Publish(channel string, message []byte) error {
+	ctx.lock.Lock()
+	registered := ctx.Registered[channel] && !transport.HasWildcard(channel)
+	retain := ctx.Options[channel].Retain
+	connected := ctx.Connected
+	if registered && connected {
+		ctx.Published = append(ctx.Published, transport.Msg{Subject: channel, Data: message})
+	}
+	ctx.lock.Unlock()
+
+	if !registered {
+		return fmt.Errorf("PubSub.Publish failed for channel %s", channel)
+	}
+	if !connected {
+		return fmt.Errorf("PubSub.Publish failed for channel %s: %w", channel, transport.ErrNotConnected)
+	}
+	if retain {
+		ctx.Bus.Retain(channel, message)
+	}
+	ctx.Bus.Publish(channel, message)
+	return nil
+}
+
+// PublishTTL publishes the message, the loopback bus does not expire messages
+func (ctx *Context) PublishTTL(channel string, message []byte, ttl int) error {
+	return ctx.Publish(channel, message)
+}
+
+// Messages returns the messages that this context published on 'topic',
+// an empty topic returns all published messages.
+func (ctx *Context) Messages(topic string) []transport.Msg {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	msgs := make([]transport.Msg, 0, len(ctx.Published))
+	for _, msg := range ctx.Published {
+		if topic == "" || msg.Subject == topic {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// Request publishes 'message' on 'channel' and waits for the reply
+func (ctx *Context) Request(channel string, message []byte, timeout time.Duration) ([]byte, error) {
+	ctx.lock.Lock()
+	registered := ctx.Registered[channel] && !transport.HasWildcard(channel)
+	ctx.lock.Unlock()
+	if !registered {
+		return nil, fmt.Errorf("PubSub.Request failed for channel %s", channel)
+	}
+	return ctx.Bus.Request(channel, "reply/"+ctx.Name+"/", message, timeout)
+}
+
+// Reply sends the reply (or the error) to a request that we received
+func (ctx *Context) Reply(request transport.Msg, message []byte, err error) error {
+	if request.Reply == "" {
+		return fmt.Errorf("PubSub.Reply failed, message on %s is not a request", request.Subject)
+	}
+	e := transport.Envelope{Convention: transport.EnvelopeConvention, CorrelationData: request.Correlation, Payload: message}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	ctx.Bus.reply(e)
+	return nil
+}
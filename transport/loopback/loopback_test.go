@@ -0,0 +1,67 @@
+package loopback
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+func TestRetainedMessages(t *testing.T) {
+	bus := NewBus()
+
+	suncalc := New(bus, 0)
+	suncalc.SetOptions("state/sensor/sun/", transport.Options{QoS: 1, Retain: true})
+	suncalc.Connect("suncalc", []string{"state/sensor/sun/"}, []string{})
+	suncalc.Publish("state/sensor/sun/", []byte("sunrise"))
+
+	// A service that connects later receives the retained sun state
+	flux := New(bus, 0)
+	flux.Connect("flux", []string{}, []string{"state/sensor/+/"})
+	select {
+	case msg := <-flux.Incoming():
+		if msg.Subject != "state/sensor/sun/" || string(msg.Data) != "sunrise" {
+			t.Errorf("unexpected retained message %s: %s", msg.Subject, string(msg.Data))
+		}
+	default:
+		t.Error("expected the retained sun state to be delivered")
+	}
+
+	status, _ := bus.Retained(transport.StatusTopic("suncalc"))
+	if string(status) != transport.StatusOnline {
+		t.Errorf("expected suncalc to be online, got '%s'", string(status))
+	}
+	suncalc.Close()
+	status, _ = bus.Retained(transport.StatusTopic("suncalc"))
+	if string(status) != transport.StatusOffline {
+		t.Errorf("expected suncalc to be offline, got '%s'", string(status))
+	}
+}
+
+func TestDeliverDoesNotBlock(t *testing.T) {
+	bus := NewBus()
+
+	ctx := New(bus, 0)
+	ctx.Connect("counter", []string{"state/count/"}, []string{"state/count/"})
+
+	// Publishing more than InMsgs holds to an unread subscriber must not block
+	n := cap(ctx.InMsgs) * 2
+	for i := 0; i < n; i++ {
+		ctx.Publish("state/count/", []byte(fmt.Sprint(i)))
+	}
+	if ctx.Overflows == 0 {
+		t.Error("expected the overflow to be counted")
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-ctx.Incoming():
+			if string(msg.Data) != fmt.Sprint(i) {
+				t.Fatalf("expected message %d, got %s", i, string(msg.Data))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d was not delivered", i)
+		}
+	}
+	ctx.Close()
+}
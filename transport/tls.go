@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The TLS entries of a pub/sub configuration, the MQTT client prefixes them
+// with 'mqtt.' (e.g. 'mqtt.tls.ca'). A file path may contain '{service}' which
+// is replaced by the name of the service, so that every service can present
+// its own client certificate.
+const (
+	// TLSCA is the PEM file with the CA(s) the broker certificate must be
+	// signed by, the system roots are not trusted when it is set.
+	TLSCA = "tls.ca"
+	// TLSCert and TLSKey are the PEM files of the client certificate
+	TLSCert = "tls.cert"
+	TLSKey  = "tls.key"
+	// TLSPin is a comma separated list of hex SHA-256 hashes of public keys
+	// (SPKI), one of the certificates of the broker chain must match.
+	TLSPin = "tls.pin"
+	// TLSServerName overrides the name the broker certificate is checked against
+	TLSServerName = "tls.servername"
+)
+
+// Identity returns the name of 'service' as it appears in the credentials of
+// the service, the common name of its certificate or its username, '/' is
+// replaced by '-' (e.g. 'tv/bravia' becomes 'tv-bravia').
+func Identity(service string) string {
+	return strings.Replace(strings.Trim(service, "/"), "/", "-", -1)
+}
+
+// TLSConfig returns the TLS configuration for 'service' from the entries in
+// 'cfg' that start with 'prefix', nil is returned when there are no entries.
+func TLSConfig(cfg map[string]string, prefix string, service string) (*tls.Config, error) {
+	entry := func(key string) string {
+		value := cfg[prefix+key]
+		return strings.Replace(value, "{service}", Identity(service), -1)
+	}
+	ca, cert, key, pin, servername := entry(TLSCA), entry(TLSCert), entry(TLSKey), entry(TLSPin), entry(TLSServerName)
+	if ca == "" && cert == "" && key == "" && pin == "" && servername == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{ServerName: servername, MinVersion: tls.VersionTLS12}
+	if ca != "" {
+		data, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("TLS CA: %s", err.Error())
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("TLS CA: no certificates in %s", ca)
+		}
+	}
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("TLS client certificate needs both a certificate and a key")
+		}
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("TLS client certificate: %s", err.Error())
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if pin != "" {
+		pins := map[string]bool{}
+		for _, p := range strings.Split(pin, ",") {
+			pins[strings.ToLower(strings.TrimSpace(p))] = true
+		}
+		config.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, c := range chain {
+					if pins[PublicKeyPin(c)] {
+						return nil
+					}
+				}
+			}
+			return errors.New("TLS broker certificate does not match a pinned key")
+		}
+	}
+	return config, nil
+}
+
+// PublicKeyPin returns the hex SHA-256 hash of the public key of 'cert', the
+// value to use for the 'tls.pin' entry.
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,165 @@
+// Package tlstest creates the certificates to test the TLS connections of the
+// pub/sub clients against a broker stand-in.
+package tlstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CA is a certificate authority that issues broker and client certificates
+type CA struct {
+	Cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+// NewCA creates a self-signed certificate authority
+func NewCA(name string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	ca := &CA{Cert: cert, key: key, pool: x509.NewCertPool()}
+	ca.pool.AddCert(cert)
+	return ca, nil
+}
+
+// Issue creates a certificate for 'name' signed by the CA, a server
+// certificate is valid for 'localhost' and 127.0.0.1.
+func (ca *CA) Issue(name string, server bool) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// ServerConfig returns the TLS configuration of a broker that requires a
+// client certificate signed by the CA.
+func (ca *CA) ServerConfig() (*tls.Config, error) {
+	cert, err := ca.Issue("broker", true)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// WriteCA writes the CA certificate as a PEM file in 'dir'
+func (ca *CA) WriteCA(dir string) (string, error) {
+	path := filepath.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+	return path, os.WriteFile(path, data, 0600)
+}
+
+// WriteClient issues a client certificate for 'name' and writes it and its
+// key as '<name>.pem' and '<name>.key' in 'dir'.
+func (ca *CA) WriteClient(dir string, name string) (certFile string, keyFile string, err error) {
+	cert, err := ca.Issue(name, false)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return "", "", err
+	}
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+".key")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		return "", "", err
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	return certFile, keyFile, err
+}
+
+// Handshake upgrades 'conn' to TLS as the broker, it returns the common name
+// of the client certificate.
+func Handshake(conn net.Conn, config *tls.Config) (*tls.Conn, string, error) {
+	tc := tls.Server(conn, config)
+	if err := tc.Handshake(); err != nil {
+		return nil, "", err
+	}
+	name := ""
+	if peers := tc.ConnectionState().PeerCertificates; len(peers) > 0 {
+		name = peers[0].Subject.CommonName
+	}
+	return tc, name, nil
+}
+
+// Listen accepts connections on a random local port and calls 'serve' for
+// every connection, the broker stand-in decides when to start TLS.
+func Listen(serve func(conn net.Conn)) (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return listener, nil
+}
@@ -0,0 +1,237 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Msg is a message received from the broker, the Subject is the topic
+// as the broker reported it (e.g. 'state/sensor/sun' or 'state.sensor.sun').
+// When the message is a request, Reply holds the topic to send the reply to.
+// Trace is the trace id of the chain of messages this message is part of.
+type Msg struct {
+	Subject     string
+	Data        []byte
+	Reply       string
+	Correlation string
+	Trace       string
+}
+
+// EnvelopeConvention marks a payload as a request or reply Envelope, a
+// payload without it is never taken for one.
+const EnvelopeConvention = "gohome/mqtt3.1.1"
+
+// Envelope is the go-home convention for request/reply on MQTT v3.1.1, which
+// has no response-topic nor correlation-data properties (MQTT v5 has). The
+// request or reply travels as JSON that starts with the EnvelopeConvention
+// marker, the other field names follow the MQTT v5 properties.
+type Envelope struct {
+	Convention      string `json:"envelope"`
+	ResponseTopic   string `json:"response_topic,omitempty"`
+	CorrelationData string `json:"correlation_data"`
+	Error           string `json:"error,omitempty"`
+	Payload         []byte `json:"payload"`
+}
+
+// A request is wrapped in an envelope that always starts with the convention
+var envelopePrefix = []byte(`{"envelope":"` + EnvelopeConvention + `",`)
+
+// OpenEnvelope returns the envelope of a request or reply, a payload that is
+// not exactly an envelope (e.g. a JSON object that happens to have a
+// 'response_topic') is not one.
+func OpenEnvelope(payload []byte) (Envelope, bool) {
+	e := Envelope{}
+	if !bytes.HasPrefix(payload, envelopePrefix) {
+		return e, false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&e); err != nil || decoder.More() {
+		return e, false
+	}
+	if e.Convention != EnvelopeConvention || e.CorrelationData == "" {
+		return e, false
+	}
+	return e, true
+}
+
+// ErrTimeout is returned when no reply was received in time
+var ErrTimeout = errors.New("request timed out")
+
+// ErrNotConnected is returned when publishing while the connection with the
+// broker is down, the message was not sent and can be published again later.
+var ErrNotConnected = errors.New("not connected")
+
+// NewCorrelationID returns a random id to match a reply with its request
+func NewCorrelationID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// Options are the delivery options of a channel, they are used when
+// publishing on the channel as well as when subscribing to it. A Raw channel
+// is published without a trace envelope, for topics that are read by other
+// software (e.g. Home Assistant). It is still sealed when its topic is protected.
+type Options struct {
+	QoS    byte
+	Retain bool
+	Raw    bool
+}
+
+// The status of every service is published (retained) on its status topic,
+// the broker publishes 'offline' as the last-will when a service dies.
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// StatusTopic returns the topic on which the status of service 'name' is published
+func StatusTopic(name string) string {
+	return "service/" + name + "/status"
+}
+
+// Transport is the interface that a pub/sub client (mqtt, nats) implements
+// so that a micro-service can run on any of the supported brokers.
+type Transport interface {
+	Connect(name string, register, subscribe []string) error
+	SetOptions(channel string, options Options) error
+	Register(channel string) error
+	Subscribe(channel string) error
+	Publish(channel string, message []byte) error
+	PublishStr(channel string, message string) error
+	PublishTTL(channel string, message []byte, ttl int) error
+	Request(channel string, message []byte, timeout time.Duration) ([]byte, error)
+	Reply(request Msg, message []byte, err error) error
+	Incoming() <-chan Msg
+	Close()
+}
+
+// Wildcards used in topic filters, '+' (or '*') matches exactly one chapter
+// and '#' matches all remaining chapters, it can only be the last chapter.
+const (
+	SingleLevel  = "+"
+	SingleLevel2 = "*"
+	MultiLevel   = "#"
+)
+
+// splitLevels splits a topic into its chapters, both '/' and '.' are accepted
+// as chapter separators so that MQTT and NATS style topics can be compared.
+func splitLevels(topic string) []string {
+	chapters := make([]string, 0, 8)
+	start := 0
+	for i := 0; i < len(topic); i++ {
+		if topic[i] == '/' || topic[i] == '.' {
+			chapters = append(chapters, topic[start:i])
+			start = i + 1
+		}
+	}
+	return append(chapters, topic[start:])
+}
+
+func isSingleLevel(chapter string) bool {
+	return chapter == SingleLevel || chapter == SingleLevel2
+}
+
+// HasWildcard returns true when the topic contains a wildcard chapter
+func HasWildcard(topic string) bool {
+	for _, chapter := range splitLevels(topic) {
+		if isSingleLevel(chapter) || chapter == MultiLevel {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateFilter checks that the wildcards in a topic filter are used as
+// whole chapters and that '#' only appears as the last chapter.
+func ValidateFilter(filter string) error {
+	chapters := splitLevels(filter)
+	for i, chapter := range chapters {
+		if chapter == MultiLevel {
+			// Our channels end with a '/', so 'a/#/' is the same as 'a/#'
+			last := i == len(chapters)-1 || (i == len(chapters)-2 && chapters[i+1] == "")
+			if !last {
+				return fmt.Errorf("topic filter %s: '#' must be the last chapter", filter)
+			}
+		} else if !isSingleLevel(chapter) && strings.ContainsAny(chapter, "+#") {
+			return fmt.Errorf("topic filter %s: a wildcard must occupy a whole chapter", filter)
+		}
+	}
+	return nil
+}
+
+// MatchTopic returns true when 'topic' matches the filter 'pattern', see
+// the wildcards above, both '/' and '.' are accepted as chapter separators.
+func MatchTopic(pattern string, topic string) bool {
+	ep := splitLevels(pattern)
+	it := splitLevels(topic)
+	for i, chapter := range ep {
+		if chapter == MultiLevel {
+			// '#' also matches the parent, 'sensor/#' matches 'sensor'
+			return true
+		}
+		if i >= len(it) {
+			return false
+		}
+		if isSingleLevel(chapter) {
+			continue
+		}
+		if chapter != it[i] {
+			return false
+		}
+	}
+	return len(ep) == len(it)
+}
+
+// MoreSpecific returns true when filter 'a' is more specific than filter 'b',
+// chapters are compared from left to right where a literal chapter wins from
+// a single level wildcard and a single level wildcard wins from '#'.
+func MoreSpecific(a string, b string) bool {
+	rank := func(chapter string) int {
+		if chapter == MultiLevel {
+			return 0
+		} else if isSingleLevel(chapter) {
+			return 1
+		}
+		return 2
+	}
+	ac := splitLevels(a)
+	bc := splitLevels(b)
+	for i := 0; i < len(ac) && i < len(bc); i++ {
+		ra := rank(ac[i])
+		rb := rank(bc[i])
+		if ra != rb {
+			return ra > rb
+		}
+	}
+	return len(ac) > len(bc)
+}
+
+// Ticker sends 'tick' on 'out' every 'frequency' until 'done' is closed, a
+// transport runs one per connection so that the ticker of a connection that
+// was closed does not stay blocked on a send that nobody receives.
+func Ticker(frequency time.Duration, tick Msg, out chan<- Msg, done <-chan struct{}) {
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		select {
+		case out <- tick:
+		case <-done:
+			return
+		}
+	}
+}
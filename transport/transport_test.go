@@ -0,0 +1,28 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTickerStops(t *testing.T) {
+	out := make(chan Msg)
+	done := make(chan struct{})
+	stopped := make(chan bool)
+	go func() {
+		Ticker(time.Millisecond, Msg{Subject: "tick/"}, out, done)
+		stopped <- true
+	}()
+
+	if msg := <-out; msg.Subject != "tick/" {
+		t.Errorf("unexpected tick %s", msg.Subject)
+	}
+	// Nobody receives the ticks anymore, closing done still stops the ticker
+	time.Sleep(5 * time.Millisecond)
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("the ticker did not stop")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -190,39 +191,38 @@ func main() {
 	register := []string{"config/weather/", "config/request/", "state/sensor/weather/"}
 	subscribe := []string{"config/weather/"}
 
-	m := microservice.New("weather")
+	m := microservice.New("weather", time.Second)
 	m.RegisterAndSubscribe(register, subscribe)
 
+	m.SetReady("config", false)
 	m.RegisterHandler("config/weather/", func(m *microservice.Service, topic string, msg []byte) bool {
 		m.Logger.LogInfo(m.Name, "received configuration")
 		weatherConfig, err := config.WeatherConfigFromJSON(msg)
 		if err == nil {
 			c.initialize(weatherConfig)
+			m.SetReady("config", true)
+			m.SetConfigVersion(config.Version(msg))
 		} else {
 			m.Logger.LogError(m.Name, err.Error())
 		}
 		return true
 	})
 
-	tickCount := 0
-	m.RegisterHandler("tick/", func(m *microservice.Service, topic string, msg []byte) bool {
-		if tickCount%5 == 0 {
-			if c.darksky != nil {
-				jsonbytes, err := c.process(m.Name)
-				if err == nil {
-					if jsonbytes != nil {
-						m.Pubsub.Publish("state/sensor/weather/", jsonbytes)
-					}
-				} else {
-					m.Logger.LogError(m.Name, err.Error())
+	m.Every(5*time.Second, func(m *microservice.Service) bool {
+		if c.darksky != nil {
+			jsonbytes, err := c.process(m.Name)
+			if err == nil {
+				if jsonbytes != nil {
+					m.Pubsub.Publish("state/sensor/weather/", jsonbytes)
 				}
 			} else {
-				m.Pubsub.PublishStr("config/request/", m.Name)
+				m.Logger.LogError(m.Name, err.Error())
 			}
+		} else {
+			m.Pubsub.PublishStr("config/request/", m.Name)
 		}
-		tickCount++
 		return true
-	})
+	}, microservice.Immediately())
 
-	m.Loop()
+	m.Loop(context.Background())
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/jurgen-kluft/go-home/config"
 	microservice "github.com/jurgen-kluft/go-home/micro-service"
 )
@@ -70,5 +71,5 @@ func main() {
 		return true
 	})
 
-	m.Loop()
+	m.Loop(context.Background())
 }
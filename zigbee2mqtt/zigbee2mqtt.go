@@ -0,0 +1,223 @@
+package main
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+	microservice "github.com/jurgen-kluft/go-home/micro-service"
+	"github.com/jurgen-kluft/go-home/transport"
+)
+
+// The actions of Zigbee2MQTT switches and what we call them
+var actions = map[string]string{
+	"single":       config.SwitchSingleClick,
+	"double":       config.SwitchDoubleClick,
+	"triple":       config.SwitchTrippleClick,
+	"tripple":      config.SwitchTrippleClick,
+	"long":         config.SwitchLongPress,
+	"hold":         config.SwitchLongPress,
+	"release":      config.SwitchLongRelease,
+	"long_release": config.SwitchLongRelease,
+}
+
+// The numeric fields of a Zigbee2MQTT payload that become float attributes
+var measurements = []string{"temperature", "humidity", "pressure", "illuminance", "battery"}
+
+// The commands of our devices and the Zigbee2MQTT state they set
+var commands = map[string]string{
+	"on":     "ON",
+	"off":    "OFF",
+	"toggle": "TOGGLE",
+}
+
+type context struct {
+	service  *microservice.Service
+	config   *config.Zigbee2MQTTConfig
+	byName   map[string]config.Zigbee2MQTTDevice
+	byTopic  map[string]config.Zigbee2MQTTDevice
+	channels map[string]bool
+}
+
+func (c *context) baseTopic() string {
+	if c.config.BaseTopic == "" {
+		return "zigbee2mqtt"
+	}
+	return c.config.BaseTopic
+}
+
+func (c *context) setChannel(device config.Zigbee2MQTTDevice) string {
+	return c.baseTopic() + "/" + device.FriendlyName + "/set/"
+}
+
+// configure indexes the devices and registers the channels of the
+// configuration, a channel of a previous configuration is kept.
+func (c *context) configure(m *microservice.Service, cfg *config.Zigbee2MQTTConfig) {
+	c.config = cfg
+	c.byName = map[string]config.Zigbee2MQTTDevice{}
+	c.byTopic = map[string]config.Zigbee2MQTTDevice{}
+	for _, device := range cfg.Devices {
+		c.byName[device.Name] = device
+		c.byTopic[c.baseTopic()+"/"+device.FriendlyName] = device
+
+		// Zigbee2MQTT expects its own payload, not our trace envelope
+		if channel := c.setChannel(device); !c.channels[channel] {
+			c.channels[channel] = true
+			m.Register(channel)
+			m.SetOptions(channel, transport.Options{Raw: true})
+		}
+	}
+	if !c.channels[cfg.SensorsOut] {
+		c.channels[cfg.SensorsOut] = true
+		m.Register(cfg.SensorsOut)
+	}
+	if devices := c.baseTopic() + "/#"; !c.channels[devices] {
+		c.channels[devices] = true
+		m.Subscribe(devices)
+		m.RegisterHandler(devices, c.handleDevice)
+	}
+	for _, channel := range cfg.Commands {
+		if !c.channels[channel] {
+			c.channels[channel] = true
+			m.Subscribe(channel)
+			microservice.RegisterTypedHandler(m, channel, c.handleCommand)
+		}
+	}
+}
+
+// sensorState converts the payload of a Zigbee2MQTT device into a SensorState,
+// it returns nil when the payload holds nothing we know.
+func (c *context) sensorState(device config.Zigbee2MQTTDevice, payload []byte) *config.SensorState {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil
+	}
+
+	state := config.NewSensorState(device.Name, device.Type)
+	state.Time = c.service.Now()
+	if occupancy, ok := fields["occupancy"].(bool); ok {
+		state.AddStringAttr("motion", onOff(occupancy))
+	}
+	if contact, ok := fields["contact"].(bool); ok {
+		// A contact sensor reports contact when the door is closed
+		if contact {
+			state.AddStringAttr("state", "close")
+		} else {
+			state.AddStringAttr("state", "open")
+		}
+	}
+	if action, ok := fields["action"].(string); ok && action != "" {
+		if click, exists := actions[action]; exists {
+			action = click
+		}
+		state.AddStringAttr("click", action)
+	}
+	for _, name := range measurements {
+		if value, ok := fields[name].(float64); ok {
+			state.AddFloatAttr(name, value)
+		}
+	}
+	if power, ok := fields["state"].(string); ok && device.Type == "light" {
+		state.AddStringAttr("power", strings.ToLower(power))
+	}
+
+	if len(state.BoolAttrs)+len(state.FloatAttrs)+len(state.StringAttrs) == 0 {
+		return nil
+	}
+	return state
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// handleDevice publishes the SensorState of a message of Zigbee2MQTT, the
+// messages of the bridge and the messages that we send are ignored.
+func (c *context) handleDevice(m *microservice.Service, topic string, msg []byte) bool {
+	if c.config == nil {
+		return true
+	}
+	device, exists := c.byTopic[strings.TrimSuffix(topic, "/")]
+	if !exists {
+		return true
+	}
+	state := c.sensorState(device, msg)
+	if state == nil {
+		return true
+	}
+	data, err := state.ToJSON()
+	if err == nil {
+		err = m.Pubsub.Publish(c.config.SensorsOut, data)
+	}
+	if err != nil {
+		m.Logger.LogError(m.Name, err.Error())
+	}
+	return true
+}
+
+// handleCommand translates the power command of one of our devices, e.g.
+// {"name": "Kitchen", "stringattrs": [{"name": "power", "value": "on"}]},
+// into a Zigbee2MQTT set command.
+func (c *context) handleCommand(m *microservice.Service, topic string, state *config.SensorState) bool {
+	if c.config == nil {
+		return true
+	}
+	device, exists := c.byName[state.Name]
+	if !exists {
+		return true
+	}
+	value, exists := commands[strings.ToLower(state.GetValueAttr("power", ""))]
+	if !exists {
+		m.Logger.LogError(m.Name, fmt.Sprintf("unknown command for %s", state.Name))
+		return true
+	}
+	data, _ := json.Marshal(map[string]string{"state": value})
+	if err := m.Pubsub.Publish(c.setChannel(device), data); err != nil {
+		m.Logger.LogError(m.Name, err.Error())
+	}
+	return true
+}
+
+func setup(m *microservice.Service) *context {
+	register := []string{"config/request/"}
+	subscribe := []string{"config/zigbee2mqtt/"}
+	m.RegisterAndSubscribe(register, subscribe)
+
+	c := &context{service: m, channels: map[string]bool{}}
+
+	m.SetReady("config", false)
+	m.RegisterHandler("config/zigbee2mqtt/", func(m *microservice.Service, topic string, msg []byte) bool {
+		cfg, err := config.Zigbee2MQTTConfigFromJSON(msg)
+		if err != nil {
+			m.Logger.LogError(m.Name, err.Error())
+			return true
+		}
+		m.Logger.LogInfo(m.Name, "received configuration")
+		c.configure(m, cfg)
+		m.SetReady("config", true)
+		m.SetConfigVersion(config.Version(msg))
+		return true
+	})
+
+	m.Every(30*time.Second, func(m *microservice.Service) bool {
+		if c.config == nil {
+			m.Logger.LogInfo(m.Name, "requesting configuration")
+			m.Pubsub.PublishStr("config/request/", m.Name)
+		}
+		return true
+	}, microservice.Immediately())
+
+	return c
+}
+
+func main() {
+	m := microservice.New("zigbee2mqtt", time.Second)
+	setup(m)
+	m.Loop(gocontext.Background())
+}
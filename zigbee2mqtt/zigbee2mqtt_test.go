@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jurgen-kluft/go-home/config"
+	microservice "github.com/jurgen-kluft/go-home/micro-service"
+)
+
+func TestZigbee2MQTTSensorStates(t *testing.T) {
+	m := microservice.New("zigbee2mqtt", time.Second)
+	setup(m)
+	h := microservice.NewHarness(m, time.Now())
+	h.Inject("config/zigbee2mqtt/", []byte(testZigbee2MQTTConfig))
+
+	tests := []struct {
+		device  string
+		payload string
+		attr    string
+		value   string
+	}{
+		{"kitchen_motion", `{"occupancy": true, "battery": 97}`, "motion", "on"},
+		{"front_door", `{"contact": false}`, "state", "open"},
+		{"front_door", `{"contact": true}`, "state", "close"},
+		{"bedroom_switch", `{"action": "double"}`, "click", config.SwitchDoubleClick},
+	}
+	for _, test := range tests {
+		h.Inject("zigbee2mqtt/"+test.device, []byte(test.payload))
+		payload, ok := h.LastPublished("state/sensor/conbee/")
+		if !ok {
+			t.Fatalf("expected a sensor state for %s", test.payload)
+		}
+		state, err := config.SensorStateFromJSON(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Type != "switch" || state.GetValueAttr(test.attr, "") != test.value {
+			t.Errorf("%s: expected %s '%s', got %s", test.payload, test.attr, test.value, string(payload))
+		}
+	}
+
+	h.Inject("zigbee2mqtt/climate", []byte(`{"temperature": 21.5, "humidity": 40}`))
+	payload, _ := h.LastPublished("state/sensor/conbee/")
+	state, _ := config.SensorStateFromJSON(payload)
+	if state.Name != "Livingroom Climate" || len(state.FloatAttrs) != 2 || state.FloatAttrs[0].Value != 21.5 {
+		t.Errorf("unexpected climate state %s", string(payload))
+	}
+
+	// Messages of unknown devices, of the bridge and without content are ignored
+	published := len(h.Published("state/sensor/conbee/"))
+	h.Inject("zigbee2mqtt/unknown", []byte(`{"occupancy": true}`))
+	h.Inject("zigbee2mqtt/bridge/state", []byte(`online`))
+	h.Inject("zigbee2mqtt/bedroom_switch", []byte(`{"action": ""}`))
+	if n := len(h.Published("state/sensor/conbee/")); n != published {
+		t.Errorf("expected no new sensor states, got %d", n-published)
+	}
+}
+
+func TestZigbee2MQTTCommands(t *testing.T) {
+	m := microservice.New("zigbee2mqtt", time.Second)
+	setup(m)
+	h := microservice.NewHarness(m, time.Now())
+	h.Inject("config/zigbee2mqtt/", []byte(testZigbee2MQTTConfig))
+
+	h.Inject("state/light/automation/", []byte(`{"name": "Kitchen", "stringattrs": [{"name": "power", "value": "on"}]}`))
+	payload, ok := h.LastPublished("zigbee2mqtt/kitchen_light/set/")
+	if !ok || string(payload) != `{"state":"ON"}` {
+		t.Errorf("expected the kitchen light to be turned on, got '%s'", string(payload))
+	}
+	if sent := h.Pubsub.Messages("zigbee2mqtt/kitchen_light/set/"); len(sent) != 1 || string(sent[0].Data) != `{"state":"ON"}` {
+		t.Error("the set command should be published without envelope")
+	}
+
+	h.Inject("state/light/automation/", []byte(`{"name": "Kitchen", "stringattrs": [{"name": "power", "value": "toggle"}]}`))
+	if payload, _ := h.LastPublished("zigbee2mqtt/kitchen_light/set/"); string(payload) != `{"state":"TOGGLE"}` {
+		t.Errorf("expected the kitchen light to be toggled, got '%s'", string(payload))
+	}
+}
+
+var testZigbee2MQTTConfig = `
+{
+    "base_topic": "zigbee2mqtt",
+    "sensors.out": "state/sensor/conbee/",
+    "commands": [ "state/light/automation/" ],
+    "devices": [
+        { "friendly_name": "kitchen_motion", "name": "Kitchen Motion", "type": "switch" },
+        { "friendly_name": "front_door", "name": "Front Door Magnet", "type": "switch" },
+        { "friendly_name": "bedroom_switch", "name": "Bedroom Switch", "type": "switch" },
+        { "friendly_name": "climate", "name": "Livingroom Climate", "type": "climate" },
+        { "friendly_name": "kitchen_light", "name": "Kitchen", "type": "light" }
+    ]
+}
+`